@@ -8,20 +8,28 @@ import (
 )
 
 // ./app INIT server_id -> Sets up the required files, and requests the client ID from the server
-// ./app SEND target -> usa o client_id, o target e o address do server
+// ./app SEND target -> usa o client_id, o target e o address do server, SEND ALL envia para todos os clientes ligados
+//   o estado de cada msg enviada e mostrado: a enviar, enviada (ou em espera no server), entregue, lida ou falhou
+//   termina no fim do input (Ctrl-D), depois de esperar pelas respostas do que foi enviado
 // ./app CREATE_SECRET -> usa o client_id, o timestamp_atual e avisa o server do mesmo processo com o timestamp_atual
+// ./app KEYRING list|add|remove|export ... -> gere as chaves guardadas no keyring encriptado
+// ./app VERIFY peer_id [ok] -> mostra o safety number da conversa com o peer, com ok marca-o como verificado
+//
+// O keyring e desbloqueado com uma passphrase, ou com o key file indicado em $CRYPTR_KEYRING_KEYFILE
 
 // CLI ARGS
 const (
 	Init         = "INIT"
 	Send         = "SEND"
 	CreateSecret = "CREATE_SECRET"
+	Keyring      = "KEYRING"
+	Verify       = "VERIFY"
 )
 
 func main() {
 	args := os.Args[1:]
 
-	if len(args) > 3 {
+	if len(args) > 5 {
 		log.Fatalf("Demasiados argumentos")
 	}
 
@@ -38,6 +46,12 @@ func main() {
 			client.HandleServerComunication(args[i+1:])
 		case CreateSecret:
 			log.Println("A criar o secret")
+		case Keyring:
+			client.HandleKeyring(args[i+1:])
+			return
+		case Verify:
+			client.HandleVerify(args[i+1:])
+			return
 		}
 	}
 }
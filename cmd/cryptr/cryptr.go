@@ -1,65 +1,312 @@
 package main
 
 import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
 
 	"github.com/TP-TS-Go/internal/crypto"
 )
 
+// Usage:
+//
+//	cryptr keygen keyfile                        -> writes a new random key, readable only by the owner
+//	cryptr keygen -x25519 identityfile           -> writes a new identity and prints its public key (recipient)
+//	cryptr encrypt -k keyfile input output       -> encrypts input into output
+//	cryptr encrypt -p input output               -> encrypts input with a key derived from a passphrase
+//	cryptr encrypt -r recipient -R team input output -> encrypts input so any of the recipients can decrypt it
+//	cryptr decrypt -k keyfile input output       -> decrypts input into output
+//	cryptr decrypt -i identityfile input output  -> decrypts a file encrypted to one of our recipients
+//	cryptr decrypt input output                  -> decrypts a passphrase encrypted input, asking for the passphrase
+//	cryptr split -n 5 -t 3 secretfile prefix     -> splits a secret (a server key, ...) into prefix.1 ... prefix.5
+//	cryptr combine output prefix.1 prefix.4 ...  -> rebuilds the secret from any 3 of the shares
+const usage = `usage:
+  cryptr keygen [-f] [-x25519] keyfile
+  cryptr encrypt -k keyfile [-suite aes|chacha|xchacha] [-padding none|pow2|padme] input output
+  cryptr encrypt -p [-kdf argon2id|scrypt] [cost flags] [-suite aes|chacha|xchacha] [-padding none|pow2|padme] input output
+  cryptr encrypt [-r recipient]... [-R recipientsfile]... [-suite aes|chacha|xchacha] [-padding none|pow2|padme] input output
+  cryptr decrypt [-k keyfile | -i identityfile...] input output
+  cryptr split [-f] -n shares -t threshold secretfile prefix
+  cryptr combine [-f] output sharefile...
+`
+
+// CLI subcommands
+const (
+	KeyGen  = "keygen"
+	Encrypt = "encrypt"
+	Decrypt = "decrypt"
+	Split   = "split"
+	Combine = "combine"
+)
+
 func main() {
+	log.SetFlags(0)
+
 	// Retrieve command-line arguments (ignoring the program name)
 	args := os.Args[1:]
 
-	// Ensure no more than 3 arguments are provided
-	if len(args) > 3 {
-		log.Fatalf("Too many arguments. Expected 3 arguments: input file, output encrypted file, output decrypted file.")
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
 	}
 
-	// Generate raw random bytes to use as a base for secret generation
-	rb, err := crypto.GenerateRawRandomBytes(32)
-	if err != nil {
-		log.Fatalf("Failed to generate random bytes: %v", err)
+	switch args[0] {
+	case KeyGen:
+		runKeyGen(args[1:])
+	case Encrypt:
+		runEncrypt(args[1:])
+	case Decrypt:
+		runDecrypt(args[1:])
+	case Split:
+		runSplit(args[1:])
+	case Combine:
+		runCombine(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s", args[0], usage)
+		os.Exit(2)
 	}
+}
 
-	// Generate a derived secret based on the random bytes
-	secret, _, err := crypto.GenerateSecret(rb)
-	if err != nil {
-		log.Fatalf("Failed to generate secret: %v", err)
+// newFlagSet creates the flag set of a subcommand, printing the general usage on errors
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses the subcommand flags and checks the number of positional arguments left
+func parseFlags(fs *flag.FlagSet, args []string, positional int) []string {
+	if err := fs.Parse(args); err != nil {
+		os.Exit(2)
+	}
+
+	if fs.NArg() != positional {
+		log.Printf("%s: expected %d arguments, got %d", fs.Name(), positional, fs.NArg())
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	return fs.Args()
+}
+
+func runKeyGen(args []string) {
+	fs := newFlagSet(KeyGen)
+	force := fs.Bool("f", false, "overwrite the key file if it exists")
+	x25519 := fs.Bool("x25519", false, "generate an identity (private key) for recipient encryption")
+	paths := parseFlags(fs, args, 1)
+
+	if *x25519 {
+		recipient, err := writeIdentityFile(paths[0], *force)
+		if err != nil {
+			log.Fatalf("Failed to generate identity: %v", err)
+		}
+
+		log.Printf("Identity written to %s, public key:", paths[0])
+		fmt.Println(recipient)
+		return
 	}
 
-	// Read the input file specified in the arguments
-	data, err := os.ReadFile(args[0])
+	if err := writeKeyFile(paths[0], *force); err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+
+	log.Printf("Key written to %s", paths[0])
+}
+
+func runEncrypt(args []string) {
+	fs := newFlagSet(Encrypt)
+	keyPath := fs.String("k", "", "key file created by cryptr keygen")
+	suiteName := fs.String("suite", "aes", "cipher suite: aes, chacha or xchacha")
+	paddingName := fs.String("padding", "none", "hide the file size: none, pow2 (next power of two) or padme (at most 12% larger)")
+	passphrase := addPassphraseFlags(fs)
+	var recipients, recipientFiles stringList
+	fs.Var(&recipients, "r", "recipient public key (tpr1...), may be repeated")
+	fs.Var(&recipientFiles, "R", "file with one recipient per line, may be repeated")
+	paths := parseFlags(fs, args, 2)
+
+	suite, err := parseSuite(*suiteName)
 	if err != nil {
-		log.Fatalf("Failed to read input file: %v", err)
+		log.Fatal(err)
+	}
+	padding, err := crypto.ParsePaddingPolicy(*paddingName)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Check if the file is empty
-	if len(data) < 1 {
-		log.Fatalf("Input file is empty.")
+	modes := 0
+	for _, used := range []bool{*keyPath != "", *passphrase.enabled, len(recipients)+len(recipientFiles) > 0} {
+		if used {
+			modes++
+		}
+	}
+	if modes != 1 {
+		log.Fatalf("Use exactly one of -k keyfile, -p or -r/-R recipients.")
 	}
+	checkDistinctPaths(paths[0], paths[1])
 
-	// Encrypt the data using the generated secret
-	ciphertext, err := crypto.Encrypt(data, secret)
+	var key crypto.SecretBytes
+	var header func(io.Writer) error
+
+	switch {
+	case len(recipients)+len(recipientFiles) > 0:
+		publicKeys, err := loadRecipients(recipients, recipientFiles)
+		if err != nil {
+			log.Fatalf("Failed to read recipients: %v", err)
+		}
+
+		key, header, err = newRecipientsKey(publicKeys)
+		if err != nil {
+			log.Fatalf("Failed to generate file key: %v", err)
+		}
+	case *passphrase.enabled:
+		params, err := passphrase.params()
+		if err != nil {
+			log.Fatalf("Invalid passphrase parameters: %v", err)
+		}
+
+		key, header, err = newPassphraseKey(params)
+		if err != nil {
+			log.Fatalf("Failed to derive key from passphrase: %v", err)
+		}
+	default:
+		key = mustReadKeyFile(*keyPath)
+	}
+
+	err = encryptFile(paths[0], paths[1], key, crypto.StreamOptions{Suite: suite, Padding: padding}, header)
+	key.Destroy()
 	if err != nil {
 		log.Fatalf("Failed to encrypt data: %v", err)
 	}
 
-	// Decrypt the ciphertext back to original data
-	decrypted, err := crypto.Decrypt(ciphertext, secret)
+	log.Printf("Encrypted %s into %s", paths[0], paths[1])
+}
+
+func runDecrypt(args []string) {
+	fs := newFlagSet(Decrypt)
+	keyPath := fs.String("k", "", "key file used to encrypt, not needed for passphrase or recipient encrypted files")
+	var identityFiles stringList
+	fs.Var(&identityFiles, "i", "identity file of a recipient, may be repeated")
+	paths := parseFlags(fs, args, 2)
+
+	checkDistinctPaths(paths[0], paths[1])
+
+	identities, err := loadIdentities(identityFiles)
 	if err != nil {
+		log.Fatalf("Failed to read identities: %v", err)
+	}
+
+	resolve := func(br *bufio.Reader) (crypto.SecretBytes, error) {
+		magic, _ := br.Peek(3)
+		switch {
+		case crypto.HasPassphraseMagic(magic):
+			return readPassphraseKey(br)
+		case crypto.HasRecipientsMagic(magic):
+			return readRecipientsKey(br, identities)
+		default:
+			return loadKeyFile(*keyPath)
+		}
+	}
+
+	if err := decryptFile(paths[0], paths[1], resolve); err != nil {
 		log.Fatalf("Failed to decrypt data: %v", err)
 	}
 
-	// Write the encrypted data to the specified output file
-	if err := os.WriteFile(args[1], ciphertext, 0644); err != nil {
-		log.Fatalf("Failed to write encrypted file: %v", err)
+	log.Printf("Decrypted %s into %s", paths[0], paths[1])
+}
+
+func runSplit(args []string) {
+	fs := newFlagSet(Split)
+	force := fs.Bool("f", false, "overwrite the share files if they exist")
+	shares := fs.Int("n", 0, "number of shares to write")
+	threshold := fs.Int("t", 0, "number of shares needed to rebuild the secret")
+	paths := parseFlags(fs, args, 2)
+
+	written, err := writeShareFiles(paths[0], paths[1], *shares, *threshold, *force)
+	if err != nil {
+		log.Fatalf("Failed to split secret: %v", err)
+	}
+
+	log.Printf("Split %s into %d shares, any %d rebuild it:", paths[0], len(written), *threshold)
+	for _, path := range written {
+		fmt.Println(path)
+	}
+}
+
+func runCombine(args []string) {
+	fs := newFlagSet(Combine)
+	force := fs.Bool("f", false, "overwrite the output if it exists")
+	if err := fs.Parse(args); err != nil {
+		os.Exit(2)
+	}
+	if fs.NArg() < 3 {
+		log.Printf("%s: expected the output and at least 2 share files, got %d arguments", Combine, fs.NArg())
+		fs.Usage()
+		os.Exit(2)
+	}
+	output, sharePaths := fs.Arg(0), fs.Args()[1:]
+
+	if _, err := os.Stat(output); err == nil && !*force {
+		log.Fatalf("%s already exists, use -f to overwrite it", output)
 	}
 
-	// Write the decrypted data to the specified output file
-	if err := os.WriteFile(args[2], decrypted, 0644); err != nil {
-		log.Fatalf("Failed to write decrypted file: %v", err)
+	shares := make([][]byte, 0, len(sharePaths))
+	for _, path := range sharePaths {
+		share, err := readShareFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read share: %v", err)
+		}
+		shares = append(shares, share)
 	}
 
-	log.Println("Encryption and decryption processes completed successfully.")
+	secret, err := crypto.CombineShares(shares)
+	if err != nil {
+		log.Fatalf("Failed to combine shares: %v", err)
+	}
+	defer clear(secret)
+
+	err = writeAtomically(output, keyFileMode, func(out io.Writer) error {
+		_, err := out.Write(secret)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Failed to write secret: %v", err)
+	}
+
+	log.Printf("Rebuilt the secret from %d shares into %s", len(shares), output)
+}
+
+// parseSuite maps the -suite flag to a cipher suite
+func parseSuite(name string) (crypto.CipherSuiteID, error) {
+	switch name {
+	case "aes":
+		return crypto.SuiteAESGCM, nil
+	case "chacha":
+		return crypto.SuiteChaCha20Poly1305, nil
+	case "xchacha":
+		return crypto.SuiteXChaCha20Poly1305, nil
+	default:
+		return 0, fmt.Errorf("unknown cipher suite %q, expected aes, chacha or xchacha", name)
+	}
+}
+
+// checkDistinctPaths refuses to write the output over the input, which would destroy it while it is being read
+func checkDistinctPaths(in, out string) {
+	inInfo, err := os.Stat(in)
+	if err != nil {
+		log.Fatalf("Failed to read input file: %v", err)
+	}
+	if !inInfo.Mode().IsRegular() {
+		log.Fatalf("Input %s is not a regular file.", in)
+	}
+
+	outInfo, err := os.Stat(out)
+	if err == nil && os.SameFile(inInfo, outInfo) {
+		log.Fatalf("Input and output are the same file.")
+	}
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/TP-TS-Go/internal/crypto"
+)
+
+// keyResolver returns the key of an encrypted file, reading the key header at the start of br when the file has one
+type keyResolver func(br *bufio.Reader) (crypto.SecretBytes, error)
+
+// encryptFile encrypts inPath into outPath as a chunked stream, memory use does not depend on the file size.
+// opts picks the cipher suite and the padding. header, when set, writes the key header (passphrase parameters, ...) in front of the stream.
+func encryptFile(inPath, outPath string, key []byte, opts crypto.StreamOptions, header func(io.Writer) error) error {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return writeAtomically(outPath, 0644, func(out io.Writer) error {
+		if header != nil {
+			if err := header(out); err != nil {
+				return err
+			}
+		}
+
+		stream, err := crypto.NewStreamWriterOptions(out, key, opts)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(stream, in); err != nil {
+			return err
+		}
+		return stream.Close()
+	})
+}
+
+// decryptFile decrypts inPath into outPath with the key given by resolve. Streams are decrypted chunk by chunk,
+// files sealed whole by crypto.Encrypt (envelopes or bare legacy blobs) are still accepted.
+func decryptFile(inPath, outPath string, resolve keyResolver) error {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// the key is resolved before the output is created, a missing or bad key leaves nothing behind
+	br := bufio.NewReader(in)
+	key, err := resolve(br)
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+
+	return writeAtomically(outPath, 0600, func(out io.Writer) error {
+		if !isStream(br) {
+			data, err := io.ReadAll(br)
+			if err != nil {
+				return err
+			}
+
+			plaintext, err := crypto.Decrypt(data, key)
+			if err != nil {
+				return err
+			}
+
+			_, err = out.Write(plaintext)
+			return err
+		}
+
+		stream, err := crypto.NewStreamReader(br, key)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(out, stream)
+		return err
+	})
+}
+
+// isStream peeks at the magic bytes written by crypto.StreamWriter
+func isStream(br *bufio.Reader) bool {
+	magic, err := br.Peek(3)
+	return err == nil && crypto.HasStreamMagic(magic)
+}
+
+// writeAtomically runs write against a temporary file next to path and only renames it into place on success,
+// a failed decryption never leaves partial plaintext behind under the output name.
+func writeAtomically(path string, mode os.FileMode, write func(io.Writer) error) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".cryptr-*")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+
+	buffered := bufio.NewWriter(tmp)
+	if err = write(buffered); err != nil {
+		return err
+	}
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return errors.Join(err, os.Remove(tmp.Name()))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/TP-TS-Go/internal/crypto"
+)
+
+// keySize is the size of the keys written by keygen (AES-256 / ChaCha20)
+const keySize = 32
+
+// keyFileMode only lets the owner read and write key files
+const keyFileMode = 0600
+
+// writeKeyFile generates a random key and writes it hex encoded to path, only readable by the owner.
+// An existing file is never replaced unless force is set.
+func writeKeyFile(path string, force bool) error {
+	key, err := crypto.NewSecretBytes(keySize)
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(path, flags, keyFileMode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// An overwritten file keeps its old mode, make sure it ends up private
+	if err := file.Chmod(keyFileMode); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintln(file, hex.EncodeToString(key)); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// readKeyFile reads a key written by writeKeyFile
+func readKeyFile(path string) (crypto.SecretBytes, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Printf("[WARN] key file %s is accessible by other users (mode %s), it should be %s", path, info.Mode().Perm(), os.FileMode(keyFileMode))
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(content)
+
+	key, err := hex.DecodeString(string(bytes.TrimSpace(content)))
+	if err != nil {
+		return nil, fmt.Errorf("key file is not hex encoded: %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("invalid key size: %d bytes; must be %d bytes", len(key), keySize)
+	}
+
+	return key, nil
+}
+
+// errMissingKeyFile is returned when a key file is needed but -k was not given
+var errMissingKeyFile = errors.New("missing key file, use -k keyfile (create one with cryptr keygen)")
+
+// loadKeyFile reads the key given with -k, failing when it is missing or invalid
+func loadKeyFile(path string) (crypto.SecretBytes, error) {
+	if path == "" {
+		return nil, errMissingKeyFile
+	}
+
+	key, err := readKeyFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	return key, nil
+}
+
+// mustReadKeyFile is loadKeyFile exiting on error, only call it before any output file is opened
+func mustReadKeyFile(path string) crypto.SecretBytes {
+	key, err := loadKeyFile(path)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	return key
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/prompt"
+)
+
+// maxArgonMemoryMiB is the largest -argon-memory, 4 GiB: the parameters keep the memory in KiB on 32 bits
+const maxArgonMemoryMiB = 4 * 1024
+
+// passphraseFlags are the encrypt flags of the passphrase mode
+type passphraseFlags struct {
+	enabled      *bool
+	kdf          *string
+	argonTime    *uint
+	argonMemory  *uint
+	argonThreads *uint
+	scryptLogN   *uint
+}
+
+func addPassphraseFlags(fs *flag.FlagSet) passphraseFlags {
+	return passphraseFlags{
+		enabled:      fs.Bool("p", false, "derive the key from a passphrase instead of a key file"),
+		kdf:          fs.String("kdf", "argon2id", "passphrase KDF: argon2id or scrypt"),
+		argonTime:    fs.Uint("argon-time", crypto.DefaultArgon2Time, "argon2id passes"),
+		argonMemory:  fs.Uint("argon-memory", crypto.DefaultArgon2Memory/1024, "argon2id memory in MiB"),
+		argonThreads: fs.Uint("argon-threads", crypto.DefaultArgon2Threads, "argon2id threads"),
+		scryptLogN:   fs.Uint("scrypt-logn", crypto.DefaultScryptLogN, "scrypt cost, log2 of N"),
+	}
+}
+
+// params builds the KDF parameters from the flags, with a fresh salt
+func (pf passphraseFlags) params() (crypto.PassphraseParams, error) {
+	var kdf crypto.PassphraseKDF
+	switch *pf.kdf {
+	case "argon2id":
+		kdf = crypto.KDFArgon2id
+	case "scrypt":
+		kdf = crypto.KDFScrypt
+	default:
+		return crypto.PassphraseParams{}, fmt.Errorf("unknown KDF %q, expected argon2id or scrypt", *pf.kdf)
+	}
+
+	params, err := crypto.NewPassphraseParams(kdf)
+	if err != nil {
+		return crypto.PassphraseParams{}, err
+	}
+
+	switch kdf {
+	case crypto.KDFArgon2id:
+		// Checked before the conversions, a value that does not fit would wrap into a valid looking one
+		if *pf.argonTime == 0 || uint64(*pf.argonTime) > math.MaxUint32 {
+			return crypto.PassphraseParams{}, fmt.Errorf("-argon-time must be between 1 and %d", uint32(math.MaxUint32))
+		}
+		if *pf.argonMemory == 0 || *pf.argonMemory > maxArgonMemoryMiB {
+			return crypto.PassphraseParams{}, fmt.Errorf("-argon-memory must be between 1 and %d MiB", maxArgonMemoryMiB)
+		}
+		params.Time = uint32(*pf.argonTime)
+		params.Memory = uint32(*pf.argonMemory * 1024)
+		params.Threads = uint8(min(*pf.argonThreads, 255))
+	case crypto.KDFScrypt:
+		params.LogN = uint8(min(*pf.scryptLogN, 255))
+	}
+
+	return params, params.Validate()
+}
+
+// newPassphraseKey asks for a new passphrase and derives the file key from it,
+// the returned header must be written in front of the stream
+func newPassphraseKey(params crypto.PassphraseParams) (crypto.SecretBytes, func(io.Writer) error, error) {
+	passphrase, err := prompt.ReadNewPassphrase("Passphrase")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer clear(passphrase)
+
+	key, err := crypto.DeriveKeyFromPassphrase(passphrase, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := func(w io.Writer) error {
+		return crypto.WritePassphraseHeader(w, params)
+	}
+	return key, header, nil
+}
+
+// readPassphraseKey reads the passphrase header at the start of br, asks for the passphrase and derives the file key
+func readPassphraseKey(br *bufio.Reader) (crypto.SecretBytes, error) {
+	params, err := crypto.ReadPassphraseHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase, err := prompt.ReadPassphrase("Passphrase")
+	if err != nil {
+		return nil, err
+	}
+	defer clear(passphrase)
+
+	return crypto.DeriveKeyFromPassphrase(passphrase, params)
+}
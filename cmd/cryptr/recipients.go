@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TP-TS-Go/internal/crypto"
+)
+
+// stringList is a flag that can be given several times
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+// writeIdentityFile generates an X25519 identity and writes it to path, only readable by the owner.
+// The public key is written as a comment too, and returned so it can be shared with whoever encrypts files for us.
+func writeIdentityFile(path string, force bool) (string, error) {
+	identity, err := crypto.GenerateX25519Identity()
+	if err != nil {
+		return "", err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(path, flags, keyFileMode)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if err := file.Chmod(keyFileMode); err != nil {
+		return "", err
+	}
+
+	recipient := crypto.FormatRecipient(identity.Recipient())
+	_, err = fmt.Fprintf(file, "# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), recipient, identity)
+	if err != nil {
+		return "", err
+	}
+
+	return recipient, file.Close()
+}
+
+// loadRecipients collects the recipients given with -r and the ones listed in the -R files
+func loadRecipients(recipients, recipientFiles []string) ([][]byte, error) {
+	var out [][]byte
+
+	for _, text := range recipients {
+		public, err := crypto.ParseRecipient(text)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, public)
+	}
+
+	for _, path := range recipientFiles {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed, err := crypto.ParseRecipients(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		out = append(out, parsed...)
+	}
+
+	return out, nil
+}
+
+// loadIdentities reads the identity files given with -i
+func loadIdentities(paths []string) ([]*crypto.X25519Identity, error) {
+	var out []*crypto.X25519Identity
+
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+			fmt.Fprintf(os.Stderr, "[WARN] identity file %s is accessible by other users (mode %s)\n", path, info.Mode().Perm())
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed, err := crypto.ParseIdentities(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		out = append(out, parsed...)
+	}
+
+	return out, nil
+}
+
+// newRecipientsKey generates a random file key, the returned header wraps it for every recipient
+func newRecipientsKey(recipients [][]byte) (crypto.SecretBytes, func(io.Writer) error, error) {
+	fileKey, err := crypto.NewFileKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := func(w io.Writer) error {
+		return crypto.WriteRecipientsHeader(w, fileKey, recipients)
+	}
+	return fileKey, header, nil
+}
+
+// readRecipientsKey unwraps the file key of the recipients header at the start of br with one of the identities
+func readRecipientsKey(br *bufio.Reader, identities []*crypto.X25519Identity) (crypto.SecretBytes, error) {
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("file is encrypted to recipients, use -i identityfile")
+	}
+	return crypto.ReadRecipientsHeader(br, identities)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/TP-TS-Go/internal/crypto"
+)
+
+// maxSplitSize bounds the secrets split into shares, they are meant for keys, not for files
+const maxSplitSize = 64 * 1024
+
+// writeShareFiles splits the secret in secretPath into n shares, any threshold of which rebuild it,
+// and writes share i to prefix.i, only readable by the owner
+func writeShareFiles(secretPath, prefix string, n, threshold int, force bool) ([]string, error) {
+	info, err := os.Stat(secretPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxSplitSize {
+		return nil, fmt.Errorf("%s is too large to split: %d bytes; at most %d bytes", secretPath, info.Size(), maxSplitSize)
+	}
+
+	secret, err := os.ReadFile(secretPath)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(secret)
+
+	shares, err := crypto.SplitSecret(secret, n, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	paths := make([]string, 0, n)
+	for i, share := range shares {
+		path := fmt.Sprintf("%s.%d", prefix, i+1)
+
+		file, err := os.OpenFile(path, flags, keyFileMode)
+		if err != nil {
+			return paths, err
+		}
+
+		_, err = fmt.Fprintf(file, "# share %d of %d of %s, any %d rebuild it with cryptr combine\n%s\n",
+			i+1, n, filepath.Base(secretPath), threshold, crypto.FormatShare(share))
+		if err == nil {
+			err = file.Chmod(keyFileMode)
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return paths, err
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+// readShareFile reads the share written by writeShareFiles, skipping empty lines and # comments
+func readShareFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), 4*maxSplitSize)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		share, err := crypto.ParseShare(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return share, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("%s: no share found", path)
+}
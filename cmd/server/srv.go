@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"time"
 
+	"github.com/TP-TS-Go/internal/crypto"
 	"github.com/TP-TS-Go/internal/server"
 )
 
@@ -17,6 +19,30 @@ const (
 )
 
 func main() {
+	paddingName := flag.String("padding", "none", "hide the length of the messages: none, pow2 or padme")
+	queueDir := flag.String("queue-dir", "queue", "directory of the messages kept for offline clients")
+	queueTTL := flag.Duration("queue-ttl", 7*24*time.Hour, "how long a message is kept for an offline client")
+	queueQuota := flag.Int("queue-quota", 256, "most messages kept for one offline client")
+	// The sessions only live in memory, what survives a restart is in these two directories:
+	// the ids with their identity keys, and the messages waiting for them. A returning client re-keys under its id.
+	clientsDir := flag.String("clients-dir", "clients", "directory of the identity keys of the registered clients")
+	flag.Parse()
+
+	padding, err := crypto.ParsePaddingPolicy(*paddingName)
+	if err != nil {
+		log.Fatalf("ERRO - PADDING: %s", err.Error())
+	}
+
+	queue, err := server.NewOfflineQueue(*queueDir, *queueTTL, *queueQuota)
+	if err != nil {
+		log.Fatalf("ERRO - FILA OFFLINE: %s", err.Error())
+	}
+
+	clients, err := server.NewClientRegistry(*clientsDir)
+	if err != nil {
+		log.Fatalf("ERRO - CLIENTES: %s", err.Error())
+	}
+
 	address := fmt.Sprintf("%s:%d", HOST, PORT)
 
 	tcp_listener_conf := net.ListenConfig{
@@ -32,7 +58,7 @@ func main() {
 		log.Fatalf("ERRO - TCP LISTENER: %s", err.Error())
 	}
 
-	serverSate := server.NewServerState()
+	serverSate := server.NewServerState(padding, queue, clients)
 
 	for {
 		conn, err := tcp_listener.Accept()
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/keyring"
+	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
+)
+
+// identityName is the keyring entry of the server's long-term signing key
+const identityName = "wserver"
+
+// loadServerIdentity returns the long-term signing key of the server, created in the keyring at path on the first run.
+// The keyring is unlocked with the key file of $CRYPTR_KEYRING_KEYFILE or a passphrase.
+func loadServerIdentity(path string) (*crypto.IdentityKey, error) {
+	ring, err := keyring.Load(path, keyring.DefaultCredentials())
+	if err != nil {
+		return nil, err
+	}
+	defer ring.Close()
+
+	seed, exists := ring.Get(keyring.KindIdentity, identityName)
+	if exists {
+		defer seed.Destroy()
+		return crypto.NewIdentityKeyFromSeed(seed)
+	}
+
+	identity, err := crypto.GenerateIdentityKey()
+	if err != nil {
+		return nil, err
+	}
+
+	seed = identity.Seed()
+	defer seed.Destroy()
+	if err := ring.Set(keyring.KindIdentity, identityName, seed); err != nil {
+		return nil, err
+	}
+	log.Println("Nova chave de identidade do server criada")
+	return identity, nil
+}
+
+// signedIdentityDocument encodes the public key of the server, signed by itself, as served by /public/identity
+func signedIdentityDocument(identity *crypto.IdentityKey) ([]byte, error) {
+	document := msgpacktyps.ServerIdentity{
+		PublicKey: identity.PublicKey(),
+		Created:   time.Now().UnixMilli(),
+	}
+	document.Signature = identity.Sign(document.SignedPayload())
+
+	return msgpack.Marshal(&document)
+}
@@ -2,18 +2,22 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/keyring"
+	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
 )
 
 const (
@@ -23,9 +27,12 @@ const (
 
 type Client struct {
 	Id           []byte
-	Secret       []byte
+	Session      *crypto.Session
 	RecvChannel  chan []byte
 	WsConnection *websocket.Conn
+	// writeMu serializes the writes on WsConnection, gorilla allows one writer at a time
+	// and the handler of every other member writes to this client
+	writeMu sync.Mutex
 }
 
 func NewClient(id []byte, wsc *websocket.Conn) *Client {
@@ -38,7 +45,7 @@ func NewClient(id []byte, wsc *websocket.Conn) *Client {
 	go func() {
 		for {
 			msg := <-client.RecvChannel
-			err := client.WsConnection.WriteMessage(websocket.TextMessage, msg)
+			err := client.Write(websocket.TextMessage, msg)
 			if err != nil {
 				log.Printf("falha ao escrever a mensagem de outro client: %s", err.Error())
 			}
@@ -48,25 +55,86 @@ func NewClient(id []byte, wsc *websocket.Conn) *Client {
 	return client
 }
 
+// Write sends one message on the client's websocket
+func (c *Client) Write(msgType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.WsConnection.WriteMessage(msgType, data)
+}
+
+// Room keeps every registered client, the ones with a WsConnection are in the chat.
+// It is safe for concurrent use, every gin handler goes through it.
 type Room struct {
+	mu      sync.RWMutex
 	clients map[string]*Client
 }
 
-func (r *Room) BroadcastMsg(msgType int, msg []byte) (err error) {
-	for _, target := range r.clients {
+// Add registers the client, it joins the chat once it connects
+func (r *Room) Add(id string, client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clients[id] = client
+}
+
+// Connect puts the registered client in the chat on ws
+func (r *Room) Connect(id string, ws *websocket.Conn) (*Client, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, exists := r.clients[id]
+	if !exists {
+		return nil, false
+	}
+
+	client.writeMu.Lock()
+	client.WsConnection = ws
+	client.writeMu.Unlock()
+	return client, true
+}
+
+// members returns a snapshot of the clients in the chat, to be walked without holding the room
+func (r *Room) members() map[string]*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
+	out := make(map[string]*Client, len(r.clients))
+	for id, client := range r.clients {
+		// Registered but not in the chat yet
+		if client.WsConnection != nil {
+			out[id] = client
+		}
+	}
+	return out
+}
+
+// sealFor encrypts the content for the target client, bound to the message metadata, and encodes the message
+func sealFor(target *Client, msg msgpacktyps.Message, content []byte) ([]byte, error) {
+	var err error
+	msg.Sequence = target.Session.NextSequence()
+	msg.Content, err = target.Session.Seal(content, msg.SessionAD())
+	if err != nil {
+		return nil, err
+	}
+
+	return msgpack.Marshal(&msg)
+}
+
+func (r *Room) BroadcastMsg(msgType int, msg msgpacktyps.Message, content []byte) (err error) {
+	for _, target := range r.members() {
 		log.Printf("BROAD TARGET ID: %x", target.Id)
-		// log.Printf("BROAD TARGET secret: %x", target.Secret)
 
-		encMessage, err := crypto.Encrypt(msg, target.Secret)
+		encMessage, err := sealFor(target, msg, content)
 		if err != nil {
-			log.Fatalf("BROAD falha ao encrypt msg para o user %x: %s", target.Id, err.Error())
+			log.Printf("BROAD falha ao encrypt msg para o user %x: %s", target.Id, err.Error())
+			continue
+		}
+		if target.Session.NeedsRekey() {
+			log.Printf("[WARN] a chave do user %x esta perto do limite de uso, e preciso novo handshake", target.Id)
 		}
-		_ = encMessage
-
-		// log.Printf("ENC MSG: %x", encMessage)
 
-		err = target.WsConnection.WriteMessage(msgType, encMessage)
+		err = target.Write(msgType, encMessage)
 		if err != nil {
 			log.Printf("falha ao enviar msg em broadcast: %s", err.Error())
 			break
@@ -75,21 +143,19 @@ func (r *Room) BroadcastMsg(msgType int, msg []byte) (err error) {
 	return
 }
 
-func (r *Room) SendMsg(msgType int, msg []byte, target string) error {
-	msgTarget, exists := r.clients[target]
+func (r *Room) SendMsg(msgType int, msg msgpacktyps.Message, content []byte, target string) error {
+	msgTarget, exists := r.members()[target]
 	if !exists {
 		return fmt.Errorf("alvo nao existe")
 	}
 
-	// usrId, _ := hex.DecodeString(msgTarget.Id)
-	// userSecret := r.clients[msgTarget.Id].Secret
-
-	encMessage, err := crypto.Encrypt(msg, msgTarget.Id)
+	encMessage, err := sealFor(msgTarget, msg, content)
 	if err != nil {
 		log.Printf("falha ao encrypt msg: %s", err.Error())
+		return err
 	}
 
-	err = msgTarget.WsConnection.WriteMessage(msgType, encMessage)
+	err = msgTarget.Write(msgType, encMessage)
 	if err != nil {
 		log.Printf("falha ao enviar msg para um cliente : %s", err.Error())
 	}
@@ -98,35 +164,86 @@ func (r *Room) SendMsg(msgType int, msg []byte, target string) error {
 	return err
 }
 
+// announceMember tells the target that the member joined or left the room, so it can hand out or rotate its sender key
+func (r *Room) announceMember(msgType msgpacktyps.MessageType, memberId string, target *Client) {
+	msg := msgpacktyps.NewMessage(msgType, "", fmt.Sprintf("%x", target.Id))
+
+	encMessage, err := sealFor(target, msg, []byte(memberId))
+	if err != nil {
+		log.Printf("falha ao encrypt aviso para o user %x: %s", target.Id, err.Error())
+		return
+	}
+
+	if err := target.Write(websocket.BinaryMessage, encMessage); err != nil {
+		log.Printf("falha ao enviar aviso para o user %x: %s", target.Id, err.Error())
+	}
+}
+
+// Join introduces the new member and the members already in the chat to each other
+func (r *Room) Join(memberId string) {
+	members := r.members()
+	member, exists := members[memberId]
+	if !exists {
+		return
+	}
+
+	for id, other := range members {
+		if id == memberId {
+			continue
+		}
+
+		r.announceMember(msgpacktyps.RoomJoin, memberId, other)
+		r.announceMember(msgpacktyps.RoomJoin, id, member)
+	}
+}
+
+// Leave removes the member and tells the others, who then rotate their sender keys
+func (r *Room) Leave(memberId string) {
+	r.mu.Lock()
+	delete(r.clients, memberId)
+	r.mu.Unlock()
+
+	for _, other := range r.members() {
+		r.announceMember(msgpacktyps.RoomLeave, memberId, other)
+	}
+}
+
 type ServerState struct {
-	publicRawMaterial []byte
 	Room
+	// padding hides the length of the messages sent to the clients
+	padding crypto.PaddingPolicy
+	// identity signs the handshake replies, identityDocument is its public key as served by /public/identity
+	identity         *crypto.IdentityKey
+	identityDocument []byte
 }
 
-func NewServerState() *ServerState {
-	rawMaterial, err := crypto.GenerateRawRandomBytes(32)
+func NewServerState(padding crypto.PaddingPolicy, identity *crypto.IdentityKey) (*ServerState, error) {
+	document, err := signedIdentityDocument(identity)
 	if err != nil {
-		log.Fatalf("falha ao gerar raw material para o public: %s", err.Error())
+		return nil, err
 	}
+
 	state := ServerState{
-		publicRawMaterial: rawMaterial,
 		Room: Room{
 			clients: make(map[string]*Client),
 		},
+		padding:          padding,
+		identity:         identity,
+		identityDocument: document,
 	}
 
-	return &state
+	return &state, nil
 }
 
-func (ss *ServerState) ResgisterNewClient(clientId []byte, clientSecret []byte) {
+func (ss *ServerState) ResgisterNewClient(clientId []byte, session *crypto.Session) {
 	id := fmt.Sprintf("%x", clientId)
 
-	ss.Room.clients[id] = &Client{
-		Id:     clientId,
-		Secret: clientSecret,
-	}
+	ss.Room.Add(id, &Client{
+		Id:      clientId,
+		Session: session,
+	})
 
-	log.Printf("Client Secret: %x", ss.Room.clients[id].Secret)
+	log.Printf("Client %s registered, key id: %x", id, session.KeyID())
 }
 
 var WsUpgrader = websocket.Upgrader{
@@ -139,6 +256,22 @@ var WsUpgrader = websocket.Upgrader{
 }
 
 func main() {
+	paddingName := flag.String("padding", "none", "hide the length of the messages: none, pow2 or padme")
+	keyringPath := flag.String("keyring", "wserver.keyring", "keyring with the server's signing key, unlocked with $"+keyring.KeyFileEnv+" or a passphrase")
+	flag.Parse()
+
+	padding, err := crypto.ParsePaddingPolicy(*paddingName)
+	if err != nil {
+		log.Fatalf("Erro na configuracao: %s", err.Error())
+	}
+
+	// Long-term key the clients pin, it signs every handshake so nobody in the middle can answer in our place
+	identity, err := loadServerIdentity(*keyringPath)
+	if err != nil {
+		log.Fatalf("Erro ao carregar a chave de identidade: %s", err.Error())
+	}
+	log.Printf("Chave de identidade do server: %s", crypto.Fingerprint(identity.PublicKey()))
+
 	address := fmt.Sprintf("%s:%d", HOST, PORT)
 
 	tcp_listener_conf := net.ListenConfig{
@@ -155,12 +288,14 @@ func main() {
 	}
 
 	app := gin.Default()
-	serverState := NewServerState()
+	serverState, err := NewServerState(padding, identity)
+	if err != nil {
+		log.Fatalf("Erro ao assinar a identidade do server: %s", err.Error())
+	}
 
 	app.GET("/public/identity", func(ctx *gin.Context) {
-		getServerRawPublicMaterial(ctx, serverState)
+		ctx.Data(http.StatusOK, "application/msgpack", serverState.identityDocument)
 	})
-
 	app.POST("/create/client", func(ctx *gin.Context) {
 		newClient(ctx, serverState)
 	})
@@ -171,21 +306,64 @@ func main() {
 	log.Fatal(app.RunListener(tcp_listener))
 }
 
-func getServerRawPublicMaterial(c *gin.Context, ss *ServerState) {
-	c.Data(http.StatusOK, http.DetectContentType(ss.publicRawMaterial), ss.publicRawMaterial)
-}
-
-// newClient creates the new client ID and secret, returns only the ID and stores the custom secret.
-// The client will then use the public available raw material, and based on its OWN ID and a Sha256 algo, will generate the same secret on its own
+// newClient answers the client's X25519 offer (msgpack encoded in the body) with the server's ephemeral public key
+// and the cipher suite picked from the client's list, signed with the server's identity key.
+// Both sides derive the same secret from the exchange, the secret itself is never sent, only the client ID goes in the cookie.
 func newClient(c *gin.Context, ss *ServerState) {
-	clientId, clientSecret := generateNewClientData(ss.publicRawMaterial)
+	var offer msgpacktyps.KeyExchangeOffer
+	if err := msgpack.NewDecoder(c.Request.Body).Decode(&offer); err != nil {
+		log.Printf("pedido de handshake invalido: %s", err.Error())
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	suite, err := crypto.NegotiateSuite(crypto.SuitesFromBytes(offer.Suites))
+	if err != nil {
+		log.Printf("falha ao negociar a cipher suite: %s", err.Error())
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	clientId, serverPublic, clientSecret, err := generateNewClientData(offer.PublicKey)
+	if err != nil {
+		log.Printf("falha no handshake: %s", err.Error())
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	// Only the session's AEAD needs the key from now on
+	defer clientSecret.Destroy()
+
+	session, err := crypto.NewSession(suite.ID(), clientSecret)
+	if err != nil {
+		log.Printf("falha ao preparar a sessao: %s", err.Error())
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if err := session.SetPadding(ss.padding); err != nil {
+		log.Printf("falha ao preparar a sessao: %s", err.Error())
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	ss.ResgisterNewClient(clientId, session)
 
-	// log.Printf("The secret is: %x", clientSecret)
-	// log.Printf("The clientID is: %x", clientId)
-	ss.ResgisterNewClient(clientId, clientSecret)
+	reply := msgpacktyps.KeyExchangeReply{
+		ClientId:  fmt.Sprintf("%x", clientId),
+		PublicKey: serverPublic,
+		Suite:     byte(suite.ID()),
+		Padding:   byte(ss.padding),
+	}
+	reply.Signature = ss.identity.Sign(reply.SignedPayload(offer))
+
+	encodedReply, err := msgpack.Marshal(&reply)
+	if err != nil {
+		log.Printf("falha ao encodificar a resposta do handshake: %s", err.Error())
+		c.Status(http.StatusInternalServerError)
+		return
+	}
 
 	c.SetCookie("client", fmt.Sprintf("%x", clientId), 3600, "/", "localhost", false, true)
-	c.Status(http.StatusOK)
+	c.Data(http.StatusOK, "application/msgpack", encodedReply)
 }
 
 func connectToRoom(c *gin.Context, ss *ServerState) {
@@ -210,12 +388,12 @@ func connectToRoom(c *gin.Context, ss *ServerState) {
 	}
 	currentClientId := fmt.Sprintf("%x", x1)
 
-	client, clientExists := ss.Room.clients[currentClientId]
+	client, clientExists := ss.Room.Connect(currentClientId, ws)
 
 	if !clientExists {
 		log.Fatalf("erro ao obter o cliente: %s", currentClientId)
 	}
-	client.WsConnection = ws
+	ss.Room.Join(currentClientId)
 
 	for {
 		mt, message, err := ws.ReadMessage()
@@ -226,35 +404,70 @@ func connectToRoom(c *gin.Context, ss *ServerState) {
 		if mt == -1 {
 			log.Println("closing WsConnection, could be an error on the client, could be a Ctrl-C ...")
 			// Drop closed client
-			delete(ss.clients, currentClientId)
+			ss.Room.Leave(currentClientId)
 			return
 		}
 
-		dencMessage, err := crypto.Decrypt(message, ss.clients[fmt.Sprintf("%x", x1)].Secret)
+		var msg msgpacktyps.Message
+		if err := msgpack.Unmarshal(message, &msg); err != nil {
+			log.Printf("mensagem mal formada: %s", err.Error())
+			continue
+		}
+
+		// The sender is authenticated by the cookie, a client can not speak for another one
+		if msg.SenderId != currentClientId {
+			log.Printf("remetente %s nao corresponde ao cliente %s, mensagem ignorada", msg.SenderId, currentClientId)
+			continue
+		}
+
+		// Membership announcements only come from the server
+		if msg.Type == msgpacktyps.RoomJoin || msg.Type == msgpacktyps.RoomLeave {
+			log.Printf("cliente %s tentou enviar um aviso de membro, mensagem ignorada", currentClientId)
+			continue
+		}
+
+		// Only the session layer comes off, the content is still encrypted with the sender's room sender key
+		dencMessage, err := client.Session.Open(msg.Content, msg.SessionAD())
 		if err != nil {
-			fmt.Printf("failed to encrypt the messages")
+			log.Printf("failed to decrypt the message: %s", err.Error())
+			continue
+		}
+
+		// A captured message sent again must not be relayed again
+		if err := client.Session.CheckSequence(msg.Sequence); err != nil {
+			log.Printf("mensagem repetida de %s rejeitada (%d ate agora): %s", currentClientId, client.Session.Replays(), err.Error())
+			continue
+		}
+
+		// Direct conversations only reach their target, the content is a ratchet message the server can not read
+		if msg.Target != "" {
+			if err := ss.Room.SendMsg(websocket.BinaryMessage, msg, dencMessage, msg.Target); err != nil {
+				log.Printf("falha ao enviar msg direta de %s para %s: %s", currentClientId, msg.Target, err.Error())
+			}
+			continue
 		}
 
-		_ = ss.Room.BroadcastMsg(mt, dencMessage)
+		_ = ss.Room.BroadcastMsg(websocket.BinaryMessage, msg, dencMessage)
 	}
 }
 
-// generateNewClientData generates a client ID and client specific secret
-func generateNewClientData(rawBytes []byte) ([]byte, []byte) {
+// generateNewClientData generates a client ID and answers the client's X25519 public key,
+// returning the ID, the server's ephemeral public key and the derived client specific secret
+func generateNewClientData(clientPublic []byte) ([]byte, []byte, crypto.SecretBytes, error) {
 	clientID, err := crypto.GenerateRawRandomBytes(24)
 	if err != nil {
 		log.Fatalf("Erro ao gerar ID do cliente: %s", err.Error())
 	}
 
-	// Rehash the secret with the client id
-	hash := sha256.New()
-	hash.Write(append(rawBytes, clientID...))
-	rawBytesForSecret := hash.Sum(nil)
+	kx, err := crypto.NewKeyExchange()
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	clientSecret, _, err := crypto.GenerateSecret(rawBytesForSecret)
+	clientSecret, err := kx.DeriveSecret(clientPublic, []byte(fmt.Sprintf("%s%x", msgpacktyps.WsHandshakeInfo, clientID)))
 	if err != nil {
-		log.Fatalf("Erro ao gerar raw bytes for secret: %s", err.Error())
+		return nil, nil, nil, err
 	}
 
-	return clientID, clientSecret
+	return clientID, kx.PublicKey(), clientSecret, nil
 }
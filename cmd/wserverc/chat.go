@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/direct"
+	"github.com/TP-TS-Go/internal/keyring"
+	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
+)
+
+// queuedMessage waits for the direct conversation with its target to be able to send
+type queuedMessage struct {
+	msgType msgpacktyps.MessageType
+	content []byte
+}
+
+// chat is the client side of the room: the session with the server, the direct conversations,
+// and the sender keys that keep the room messages end to end encrypted
+type chat struct {
+	selfId        string
+	ws            *websocket.Conn
+	session       *crypto.Session
+	identity      *crypto.IdentityKey
+	ring          *keyring.Keyring
+	peers         *crypto.PeerKeys
+	conversations *direct.Conversations
+
+	// writeMu serializes the writes of the reader routine (handshakes, keys) and of the input loop
+	writeMu sync.Mutex
+
+	mu     sync.Mutex
+	queued map[string][]queuedMessage
+	// members are the other clients in the room, each with the sender key it gave us (nil until it arrives)
+	members   map[string]*crypto.SenderKey
+	senderKey *crypto.SenderKey
+}
+
+func newChat(selfId string, ws *websocket.Conn, session *crypto.Session, identity *crypto.IdentityKey, ring *keyring.Keyring) (*chat, error) {
+	senderKey, err := crypto.NewSenderKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &chat{
+		selfId:        selfId,
+		ws:            ws,
+		session:       session,
+		identity:      identity,
+		ring:          ring,
+		peers:         loadPeerKeys(ring),
+		conversations: direct.NewConversations(selfId, identity),
+		queued:        make(map[string][]queuedMessage),
+		members:       make(map[string]*crypto.SenderKey),
+		senderKey:     senderKey,
+	}, nil
+}
+
+// send seals the content with the session, bound to the message metadata, and writes it on the websocket
+func (c *chat) send(msg msgpacktyps.Message, content []byte) error {
+	var err error
+	msg.Sequence = c.session.NextSequence()
+	msg.Content, err = c.session.Seal(content, msg.SessionAD())
+	if err != nil {
+		return fmt.Errorf("erro ao encriptar a msg: %s", err.Error())
+	}
+
+	data, err := msgpack.Marshal(&msg)
+	if err != nil {
+		return fmt.Errorf("erro ao encodificar a msg: %s", err.Error())
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// sendRoom encrypts the content once with our sender key, the server relays the same ciphertext to every member
+func (c *chat) sendRoom(content []byte) error {
+	c.mu.Lock()
+	senderKey := c.senderKey
+	c.mu.Unlock()
+
+	msg := msgpacktyps.NewMessage(msgpacktyps.SendContent, c.selfId, "")
+	sealed, err := senderKey.Encrypt(content, msg.AssociatedData())
+	if err != nil {
+		return err
+	}
+
+	// Signed over the ciphertext, only the sender could have written it, even though every member holds the chain
+	msg.SignerKey = c.identity.PublicKey()
+	msg.Signature = c.identity.Sign(msg.SignedPayload(sealed))
+
+	return c.send(msg, sealed)
+}
+
+// sendDirect encrypts the content for the peer with the ratchet of the conversation,
+// starting the conversation and queuing the content if it can not send yet
+func (c *chat) sendDirect(peerId string, msgType msgpacktyps.MessageType, content []byte) error {
+	c.mu.Lock()
+	if !c.conversations.CanSend(peerId) {
+		first := len(c.queued[peerId]) == 0
+		c.queued[peerId] = append(c.queued[peerId], queuedMessage{msgType: msgType, content: content})
+		c.mu.Unlock()
+
+		if !first {
+			return nil
+		}
+		log.Printf("A iniciar conversa com %s ...", peerId)
+		init, err := c.conversations.Start(peerId)
+		if err != nil {
+			return err
+		}
+		return c.send(init.Message, init.Content)
+	}
+	c.mu.Unlock()
+
+	out, err := c.conversations.SealType(msgType, peerId, content)
+	if err != nil {
+		return err
+	}
+	return c.send(out.Message, out.Content)
+}
+
+// flushDirect sends what was queued for the peer, once the conversation can send
+func (c *chat) flushDirect(peerId string) {
+	c.mu.Lock()
+	if !c.conversations.CanSend(peerId) {
+		c.mu.Unlock()
+		return
+	}
+	pending := c.queued[peerId]
+	delete(c.queued, peerId)
+	c.mu.Unlock()
+
+	for _, queued := range pending {
+		if err := c.sendDirect(peerId, queued.msgType, queued.content); err != nil {
+			log.Printf("erro ao enviar msg para %s: %s", peerId, err.Error())
+		}
+	}
+}
+
+// memberJoined hands our sender key to the new member
+func (c *chat) memberJoined(memberId string) {
+	c.mu.Lock()
+	if _, known := c.members[memberId]; !known {
+		c.members[memberId] = nil
+	}
+	distribution := c.senderKey.Distribution()
+	c.mu.Unlock()
+
+	log.Printf("%s entrou na sala", memberId)
+	if err := c.sendDirect(memberId, msgpacktyps.SenderKeyDistribution, distribution); err != nil {
+		log.Printf("erro ao enviar a sender key para %s: %s", memberId, err.Error())
+	}
+}
+
+// memberLeft forgets the member and rotates our sender key, so it can not read what we send from now on
+func (c *chat) memberLeft(memberId string) {
+	senderKey, err := crypto.NewSenderKey()
+	if err != nil {
+		log.Printf("erro ao rodar a sender key: %s", err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.members, memberId)
+	delete(c.queued, memberId)
+	c.senderKey = senderKey
+	remaining := make([]string, 0, len(c.members))
+	for id := range c.members {
+		remaining = append(remaining, id)
+	}
+	c.mu.Unlock()
+
+	log.Printf("%s saiu da sala, nova sender key %08x", memberId, senderKey.ID())
+	for _, id := range remaining {
+		if err := c.sendDirect(id, msgpacktyps.SenderKeyDistribution, senderKey.Distribution()); err != nil {
+			log.Printf("erro ao enviar a sender key para %s: %s", id, err.Error())
+		}
+	}
+}
+
+// receive handles a message read from the websocket
+func (c *chat) receive(data []byte) {
+	var msg msgpacktyps.Message
+	if err := msgpack.Unmarshal(data, &msg); err != nil {
+		log.Printf("mensagem mal formada: %s", err.Error())
+		return
+	}
+
+	// Fails if the server or someone in the middle changed the sender, target, type or timestamp
+	denc, err := c.session.Open(msg.Content, msg.SessionAD())
+	if err != nil {
+		log.Printf("erro ao desencriptar a msg: %s", err.Error())
+		return
+	}
+
+	if err := c.session.CheckSequence(msg.Sequence); err != nil {
+		log.Printf("mensagem repetida rejeitada (%d ate agora): %s", c.session.Replays(), err.Error())
+		return
+	}
+
+	switch {
+	case msg.Type == msgpacktyps.RoomJoin && msg.SenderId == "":
+		c.memberJoined(string(denc))
+	case msg.Type == msgpacktyps.RoomLeave && msg.SenderId == "":
+		c.memberLeft(string(denc))
+	case msg.Target == "":
+		c.receiveRoom(msg, denc)
+	default:
+		c.receiveDirect(msg, denc)
+	}
+}
+
+// receiveRoom decrypts a room message with the sender key of its sender
+func (c *chat) receiveRoom(msg msgpacktyps.Message, sealed []byte) {
+	// The server relays our own messages back
+	if msg.SenderId == c.selfId {
+		return
+	}
+
+	c.mu.Lock()
+	senderKey := c.members[msg.SenderId]
+	c.mu.Unlock()
+
+	if senderKey == nil {
+		log.Printf("mensagem de %s ignorada, ainda sem a sender key dele", msg.SenderId)
+		return
+	}
+
+	plaintext, err := senderKey.Decrypt(sealed, msg.AssociatedData())
+	if err != nil {
+		log.Printf("mensagem de %s rejeitada: %s", msg.SenderId, err.Error())
+		return
+	}
+
+	status := c.verify(msg, sealed)
+	log.Printf("%sReceived message from %s: %s", verificationMarker(status), msg.SenderId, plaintext)
+}
+
+// receiveDirect handles the messages of a direct conversation: handshakes, sender keys and chat messages
+func (c *chat) receiveDirect(msg msgpacktyps.Message, content []byte) {
+	status := crypto.PeerUnverified
+	if msg.Signature != nil {
+		status = c.verify(msg, content)
+	}
+
+	// A conversation is only started by a key exchange signed with the key pinned for the peer
+	if (msg.Type == msgpacktyps.RatchetInit || msg.Type == msgpacktyps.RatchetAccept) && !status.Trusted() {
+		log.Printf("%spedido de conversa de %s rejeitado", verificationMarker(status), msg.SenderId)
+		return
+	}
+
+	plaintext, reply, err := c.conversations.Handle(msg, content)
+	if err != nil {
+		log.Printf("mensagem direta rejeitada de %s: %s", msg.SenderId, err.Error())
+		return
+	}
+	if reply != nil {
+		if err := c.send(reply.Message, reply.Content); err != nil {
+			log.Printf("erro ao responder a %s: %s", msg.SenderId, err.Error())
+		}
+	}
+	c.flushDirect(msg.SenderId)
+
+	if plaintext == nil {
+		return
+	}
+
+	if msg.Type == msgpacktyps.SenderKeyDistribution {
+		senderKey, err := crypto.ParseSenderKey(plaintext)
+		if err != nil {
+			log.Printf("sender key invalida de %s: %s", msg.SenderId, err.Error())
+			return
+		}
+
+		c.mu.Lock()
+		_, member := c.members[msg.SenderId]
+		if member {
+			c.members[msg.SenderId] = senderKey
+		}
+		c.mu.Unlock()
+
+		if member {
+			log.Printf("Recebida a sender key %08x de %s", senderKey.ID(), msg.SenderId)
+		}
+		return
+	}
+
+	log.Printf("Direct message from %s: %s", msg.SenderId, plaintext)
+}
+
+// verify checks the signature of the message against the key pinned for its sender, pinning it in the keyring if it is the first
+func (c *chat) verify(msg msgpacktyps.Message, content []byte) crypto.PeerStatus {
+	status := c.peers.Verify(msg.SenderId, msg.SignerKey, msg.SignedPayload(content), msg.Signature)
+	if status == crypto.PeerNew {
+		if err := c.ring.Set(keyring.KindPeer, msg.SenderId, msg.SignerKey); err != nil {
+			log.Printf("erro ao guardar a chave de %s: %s", msg.SenderId, err.Error())
+		}
+	}
+	return status
+}
+
+// verifyPeer shows the safety number of our identity key and the key pinned for the peer, to be compared with
+// the one the peer sees. With confirm the numbers matched: the peer is marked as verified, in the keyring too.
+func (c *chat) verifyPeer(peerId string, confirm bool) error {
+	peerKey, exists := c.peers.Key(peerId)
+	if !exists {
+		return fmt.Errorf("ainda nao ha chave de %s, troque uma mensagem primeiro", peerId)
+	}
+
+	number, err := crypto.ComputeSafetyNumber(c.identity.PublicKey(), peerKey)
+	if err != nil {
+		return err
+	}
+
+	groups := number.Groups()
+	fmt.Printf("Safety number com %s:\n\n", peerId)
+	for i := 0; i < len(groups); i += 4 {
+		fmt.Printf("    %s\n", strings.Join(groups[i:min(i+4, len(groups))], " "))
+	}
+	fmt.Printf("\n    %s\n\n", strings.Join(number.Words(), " "))
+
+	if !confirm {
+		log.Printf("Se o numero for igual no dispositivo de %s, escreva /verify %s ok", peerId, peerId)
+		return nil
+	}
+
+	c.peers.MarkVerified(peerId, peerKey)
+	if err := c.ring.Set(keyring.KindVerified, peerId, peerKey); err != nil {
+		return fmt.Errorf("erro ao guardar a verificacao: %s", err.Error())
+	}
+	log.Printf("%s marcado como verificado", peerId)
+	return nil
+}
+
+// verificationMarker is shown in front of received messages whose sender could not be verified
+func verificationMarker(status crypto.PeerStatus) string {
+	switch status {
+	case crypto.PeerVerified:
+		return "[verificado] "
+	case crypto.PeerUnverified:
+		return "[NAO VERIFICADO] "
+	case crypto.PeerKeyChanged:
+		return "[NAO VERIFICADO - A CHAVE DO REMETENTE MUDOU] "
+	default:
+		return ""
+	}
+}
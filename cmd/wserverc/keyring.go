@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+
+	"github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/keyring"
+)
+
+// openKeyring unlocks the keyring shared with the TCP client, with the key file of $CRYPTR_KEYRING_KEYFILE or a passphrase
+func openKeyring() (*keyring.Keyring, error) {
+	keyringPath, err := keyring.DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return keyring.Load(keyringPath, keyring.DefaultCredentials())
+}
+
+// loadIdentity returns our identity key for the server, so the other clients see the same key across runs
+func loadIdentity(ring *keyring.Keyring, server string) (*crypto.IdentityKey, error) {
+	seed, exists := ring.Get(keyring.KindIdentity, server)
+	if exists {
+		defer seed.Destroy()
+		return crypto.NewIdentityKeyFromSeed(seed)
+	}
+
+	identity, err := crypto.GenerateIdentityKey()
+	if err != nil {
+		return nil, err
+	}
+
+	seed = identity.Seed()
+	defer seed.Destroy()
+	if err := ring.Set(keyring.KindIdentity, server, seed); err != nil {
+		return nil, err
+	}
+	log.Println("Nova chave de identidade criada")
+	return identity, nil
+}
+
+// loadPeerKeys returns the store of the peer keys pinned in the keyring, with the ones the user verified marked
+func loadPeerKeys(ring *keyring.Keyring) *crypto.PeerKeys {
+	pinned := make(map[string][]byte)
+	for _, entry := range ring.List(keyring.KindPeer) {
+		pinned[entry.Name] = entry.Material
+	}
+
+	peers := crypto.NewPeerKeys(pinned)
+	for _, entry := range ring.List(keyring.KindVerified) {
+		if !peers.MarkVerified(entry.Name, entry.Material) {
+			log.Printf("[WARN] a chave verificada de %s nao e a chave guardada, verifique de novo", entry.Name)
+		}
+	}
+	return peers
+}
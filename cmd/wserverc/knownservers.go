@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/TP-TS-Go/internal/crypto"
+	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
+)
+
+// ErrServerKeyChanged is returned when a server answers with another key than the one pinned for it
+var ErrServerKeyChanged = errors.New("a chave de identidade do server mudou")
+
+// maxIdentityDocumentSize bounds the answer of /public/identity, a key, a timestamp and a signature
+const maxIdentityDocumentSize = 1024
+
+// knownServersPath returns $(home)/.config/cryptr_known_servers, next to the keyring.
+// Like ssh's known_hosts, each line is "<server> <key fingerprint>", lines starting with # are comments.
+func knownServersPath() (string, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("erro ao obter o utilizador atual: %w", err)
+	}
+
+	return filepath.Join(currentUser.HomeDir, ".config", "cryptr_known_servers"), nil
+}
+
+// fetchServerIdentity gets the identity document of the server and checks it is signed by the key it carries
+func fetchServerIdentity(baseServerUrl *url.URL) ([]byte, error) {
+	resp, err := http.Get(baseServerUrl.JoinPath("public", "identity").String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("o server respondeu %s", resp.Status)
+	}
+
+	var document msgpacktyps.ServerIdentity
+	if err := msgpack.NewDecoder(io.LimitReader(resp.Body, maxIdentityDocumentSize)).Decode(&document); err != nil {
+		return nil, fmt.Errorf("documento de identidade invalido: %w", err)
+	}
+
+	if err := crypto.VerifySignature(document.PublicKey, document.SignedPayload(), document.Signature); err != nil {
+		return nil, fmt.Errorf("documento de identidade mal assinado: %w", err)
+	}
+
+	return document.PublicKey, nil
+}
+
+// checkKnownServer compares the fingerprint of the server key with the one pinned for the server in path,
+// pinning it on the first contact (trust on first use). It reports whether the server was new.
+func checkKnownServer(path, server string, public []byte) (bool, error) {
+	fingerprint := crypto.Fingerprint(public)
+
+	pinned, found, err := lookupKnownServer(path, server)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		if pinned != fingerprint {
+			return false, fmt.Errorf("%w: %s era %s, agora e %s", ErrServerKeyChanged, server, pinned, fingerprint)
+		}
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintf(file, "%s %s\n", server, fingerprint); err != nil {
+		return false, err
+	}
+	return true, file.Close()
+}
+
+// lookupKnownServer returns the fingerprint pinned for the server in path, the first line for it wins
+func lookupKnownServer(path, server string) (string, bool, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return "", false, fmt.Errorf("%s:%d: esperado \"<server> <fingerprint>\"", path, lineNumber)
+		}
+		if fields[0] == server {
+			return fields[1], true, nil
+		}
+	}
+
+	return "", false, scanner.Err()
+}
+
+// warnServerKeyChanged tells the user, as loudly as ssh does, that the server may be impersonated
+func warnServerKeyChanged(path, server string, err error) {
+	log.Println("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	log.Println("@   AVISO: A IDENTIDADE DO SERVER MUDOU!                  @")
+	log.Println("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	log.Println("Alguem pode estar a intercetar a ligacao (man-in-the-middle),")
+	log.Println("ou o server trocou a chave de identidade.")
+	log.Println(err.Error())
+	log.Printf("Se a mudanca e legitima, confirme a nova chave com o administrador e remova a linha de %s em %s", server, path)
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"bufio"
-	"crypto/sha256"
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -11,10 +11,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 
 	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/TP-TS-Go/internal/crypto"
+	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
 )
 
 type GivenClientInformation struct {
@@ -28,6 +31,13 @@ func getArgsNoProg() []string {
 }
 
 // Usage wserverc 0.0.0.0 8080
+// "/verify <client id>" shows the safety number to compare with that client out of band, "/verify <client id> ok" marks it verified.
+// Lines typed as "@<client id> text" go only to that client, end to end encrypted with a Double Ratchet,
+// the other lines go to the whole room, end to end encrypted with our sender key.
+// The identity key and the pinned peer keys are kept in the keyring shared with the TCP client,
+// unlocked with a passphrase or the key file of $CRYPTR_KEYRING_KEYFILE.
+// The server's identity key is pinned in ~/.config/cryptr_known_servers on the first connection,
+// a server answering with another key later is refused
 func main() {
 	args := getArgsNoProg()
 
@@ -44,26 +54,66 @@ func main() {
 
 	log.Printf("Connecting to <%s> ...\n", baseServerUrl)
 
-	serverPublicMaterialUrl := baseServerUrl.JoinPath("public", "identity")
+	// The server's long-term key, pinned on the first contact, it must sign the handshake
+	serverKey, err := fetchServerIdentity(baseServerUrl)
+	if err != nil {
+		log.Fatalf("erro ao obter a identidade do server: %s", err.Error())
+	}
 
-	materialResp, err := http.Get(serverPublicMaterialUrl.String())
+	knownServers, err := knownServersPath()
 	if err != nil {
-		log.Fatalf("erro ao ler raw public material: %s", err.Error())
+		log.Fatalf("erro ao abrir os servers conhecidos: %s", err.Error())
+	}
+
+	newServer, err := checkKnownServer(knownServers, serverHostname, serverKey)
+	if errors.Is(err, ErrServerKeyChanged) {
+		warnServerKeyChanged(knownServers, serverHostname, err)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("erro ao verificar a identidade do server: %s", err.Error())
+	}
+	if newServer {
+		log.Printf("Primeira ligacao a %s, chave %s guardada em %s", serverHostname, crypto.Fingerprint(serverKey), knownServers)
 	}
 
-	material, err := io.ReadAll(materialResp.Body)
+	// Ephemeral half of the X25519 handshake, the secret is derived on both ends and never sent
+	kx, err := crypto.NewKeyExchange()
 	if err != nil {
-		log.Fatalf("error reading the response body: %s", err.Error())
+		log.Fatalf("erro ao gerar chave efemera: %s", err.Error())
+	}
+
+	offer := msgpacktyps.KeyExchangeOffer{
+		PublicKey: kx.PublicKey(),
+		Suites:    crypto.SuitesToBytes(crypto.PreferredSuites()),
+	}
+	encodedOffer, err := msgpack.Marshal(&offer)
+	if err != nil {
+		log.Fatalf("erro ao encodificar o pedido de handshake: %s", err.Error())
 	}
 
 	serverCreateNewClientUrl := baseServerUrl.JoinPath("create", "client")
 
-	resp, err := http.Post(serverCreateNewClientUrl.String(), "", nil)
+	resp, err := http.Post(serverCreateNewClientUrl.String(), "application/msgpack", bytes.NewReader(encodedOffer))
 	if err != nil {
 		log.Fatalf("erro ao criar user: %s", err.Error())
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("o server recusou o handshake: %s", resp.Status)
+	}
+
+	var reply msgpacktyps.KeyExchangeReply
+	if err := msgpack.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		log.Fatalf("erro ao ler a resposta do handshake: %s", err.Error())
+	}
+
+	// Without this anyone in the middle could answer with its own ephemeral key
+	if err := crypto.VerifySignature(serverKey, reply.SignedPayload(offer), reply.Signature); err != nil {
+		log.Fatalf("a resposta do handshake nao foi assinada pelo server: %s", err.Error())
+	}
+
 	clientInfo := GivenClientInformation{
 		IdBytes:  make([]byte, 0),
 		IdCookie: nil,
@@ -83,14 +133,41 @@ func main() {
 		}
 	}
 
-	secret := hashMaterialWithClientId(material, clientInfo)
+	if clientInfo.IdCookie == nil || clientInfo.IdCookie.Value != reply.ClientId {
+		log.Fatalf("o ID do cookie nao corresponde ao ID do handshake")
+	}
+
+	clientSecret, err := kx.DeriveSecret(reply.PublicKey, []byte(msgpacktyps.WsHandshakeInfo+reply.ClientId))
+	if err != nil {
+		log.Fatalf("erro ao derivar o secret: %s", err.Error())
+	}
+
+	suite, err := crypto.SuiteByID(crypto.CipherSuiteID(reply.Suite))
+	if err != nil {
+		log.Fatalf("o server escolheu uma cipher suite invalida: %s", err.Error())
+	}
+	log.Printf("Cipher suite: %s", suite.Name())
+
+	session, err := crypto.NewSession(suite.ID(), clientSecret)
+	clientSecret.Destroy()
+	if err != nil {
+		log.Fatalf("erro ao preparar a sessao: %s", err.Error())
+	}
+	// Pad what we send like the server pads what it sends
+	if err := session.SetPadding(crypto.PaddingPolicy(reply.Padding)); err != nil {
+		log.Fatalf("o server escolheu um padding invalido: %s", err.Error())
+	}
 
-	clientSecret, _, err := crypto.GenerateSecret(secret)
+	ring, err := openKeyring()
 	if err != nil {
-		log.Fatalf("Erro ao gerar raw bytes for secret: %s", err.Error())
+		log.Fatalf("erro ao abrir o keyring: %s", err.Error())
 	}
 
-	log.Printf("The secret is: %x", clientSecret)
+	// Signs our messages, so the other clients can tell who wrote them even though the server relays everything
+	identity, err := loadIdentity(ring, serverHostname)
+	if err != nil {
+		log.Fatalf("erro ao carregar a chave de identidade: %s", err.Error())
+	}
 
 	serverEnterChatRoomUrl := baseServerUrl.JoinPath("chat")
 	serverEnterChatRoomUrl.Scheme = "wss"
@@ -105,19 +182,19 @@ func main() {
 		return
 	}
 
+	chat, err := newChat(reply.ClientId, ws, session, identity, ring)
+	if err != nil {
+		log.Fatalf("erro ao preparar a sala: %s", err.Error())
+	}
+
 	go func() {
 		for {
-			_, msg, err := ws.ReadMessage()
+			_, data, err := ws.ReadMessage()
 			if err != nil {
-				log.Printf("Erro ao ler: %s", err.Error())
+				log.Fatalf("Erro ao ler: %s", err.Error())
 			}
 
-			denc, err := crypto.Decrypt(msg, clientSecret)
-			if err != nil {
-				log.Fatalf("erro ao desencriptar a msg: %s", err.Error())
-			}
-
-			log.Printf("Received message: %s", denc)
+			chat.receive(data)
 		}
 	}()
 
@@ -131,21 +208,56 @@ func main() {
 			log.Fatalf("erro ao ler user input: %s", err.Error())
 		}
 
-		encMsg, err := crypto.Encrypt(inputBytes, clientSecret)
-		if err != nil {
-			log.Fatalf("erro ao encriptar a msg: %s", err.Error())
+		// "/verify <id> [ok]" shows the safety number of the conversation with a peer, ok marks the peer as verified
+		if peerId, confirm, isVerify := parseVerify(inputBytes); isVerify {
+			if peerId == "" {
+				log.Println("uso: /verify <id> [ok]")
+				continue
+			}
+			if err := chat.verifyPeer(peerId, confirm); err != nil {
+				log.Printf("erro ao verificar %s: %s", peerId, err.Error())
+			}
+			continue
 		}
 
-		err = ws.WriteMessage(websocket.TextMessage, encMsg)
-		if err != nil {
+		// "@<id> text" starts or continues a direct conversation, anything else goes to the whole room
+		if target, content, isDirect := parseDirect(inputBytes); isDirect {
+			if err := chat.sendDirect(target, msgpacktyps.SendContent, content); err != nil {
+				log.Printf("erro ao enviar msg para %s: %s", target, err.Error())
+			}
+			continue
+		}
+
+		if err := chat.sendRoom(inputBytes); err != nil {
 			log.Fatalf("erro ao escrever na conexao: %s", err.Error())
 		}
 	}
 }
 
-func hashMaterialWithClientId(material []byte, clientInfo GivenClientInformation) []byte {
-	hash := sha256.New()
-	hash.Write(append(material, clientInfo.IdBytes...))
-	secret := hash.Sum(nil)
-	return secret
+// parseVerify splits a "/verify <id> [ok]" input line into the peer id and whether the user confirms the number
+func parseVerify(input []byte) (string, bool, bool) {
+	fields := strings.Fields(string(input))
+	if len(fields) == 0 || fields[0] != "/verify" {
+		return "", false, false
+	}
+	// A malformed command must not end up sent to the room, it has no peer id instead
+	if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "ok") {
+		return "", false, true
+	}
+
+	return fields[1], len(fields) == 3, true
+}
+
+// parseDirect splits an "@<id> text" input line into the target id and the text
+func parseDirect(input []byte) (string, []byte, bool) {
+	if !bytes.HasPrefix(input, []byte("@")) {
+		return "", nil, false
+	}
+
+	target, content, found := bytes.Cut(input[1:], []byte(" "))
+	if !found || len(target) == 0 {
+		return "", nil, false
+	}
+
+	return string(target), content, true
 }
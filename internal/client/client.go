@@ -1,7 +1,6 @@
 package client
 
 import (
-	"bytes"
 	"log"
 	"sync"
 	"time"
@@ -9,6 +8,9 @@ import (
 	"github.com/pelletier/go-toml/v2"
 	"github.com/vmihailenco/msgpack/v5"
 
+	"github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/framing"
+	"github.com/TP-TS-Go/internal/keyring"
 	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
 )
 
@@ -24,6 +26,29 @@ func InitClient(args []string) {
 		ServerAddress: args[0],
 	}
 
+	// The secret and the identity key only ever go to the encrypted keyring
+	ring, err := openKeyring(nil)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	identity, err := crypto.GenerateIdentityKey()
+	if err != nil {
+		log.Fatalf("erro ao gerar chave de identidade: %s", err.Error())
+	}
+	seed := identity.Seed()
+	if err := ring.Set(keyring.KindIdentity, config.ServerAddress, seed); err != nil {
+		log.Fatalf("erro ao guardar a chave de identidade: %s", err.Error())
+	}
+	seed.Destroy()
+	defer identity.Destroy()
+
+	// Ephemeral half of the X25519 handshake, the secret is derived locally and never sent
+	kx, err := crypto.NewKeyExchange()
+	if err != nil {
+		log.Fatalf("erro ao gerar chave efemera: %s", err.Error())
+	}
+
 	// Connect to the server specefied in the config file
 	comHandler := NewComHandler("", args[0], config.ServerAddress)
 
@@ -31,32 +56,47 @@ func InitClient(args []string) {
 	wg.Add(1)
 
 	comHandler.SetOnMsgReceive(func(m msgpacktyps.Message) {
+		if m.Type != msgpacktyps.RequestIdResponse {
+			return
+		}
+
 		// Handle config response
-		config.ClientId = string(m.Content[0:16])
-		config.RawMaterial = string(m.Content[18:])
+		var reply msgpacktyps.KeyExchangeReply
+		if err := msgpack.Unmarshal(m.Content, &reply); err != nil {
+			log.Fatalf("erro ao descodificar a resposta do handshake: %s", err.Error())
+		}
+
+		secret, err := kx.DeriveSecret(reply.PublicKey, []byte(msgpacktyps.HandshakeInfo+reply.ClientId))
+		if err != nil {
+			log.Fatalf("erro ao derivar o secret: %s", err.Error())
+		}
+
+		if err := ring.Set(keyring.KindSecret, config.ServerAddress, secret); err != nil {
+			log.Fatalf("erro ao guardar o secret: %s", err.Error())
+		}
+		secret.Destroy()
+
+		config.ClientId = reply.ClientId
+		config.Suite = reply.Suite
+		config.Padding = reply.Padding
 		comHandler.senderId = config.ClientId
 
 		wg.Done()
 	})
 
-	err := comHandler.CreateConnection()
+	err = comHandler.CreateConnection()
 	if err != nil {
 		log.Fatalf("erro ao iniciar o comHandler: %s", err.Error())
 	}
 
-	var encoderBuffer bytes.Buffer
-	encoder := msgpack.NewEncoder(&encoderBuffer)
-	// encoder.UseArrayEncodedStructs(true)
-
-	msg := msgpacktyps.NewMessage(msgpacktyps.RequestId, "", "0", 0x0)
-
-	err = encoder.Encode(msg)
+	// Signed with the identity key, the server registers it with the id it gives: after a restart of the server
+	// the client gets a new session under the same id by signing with it again (see rekey)
+	data, err := newOffer(kx, "", identity)
 	if err != nil {
-		log.Fatalf("erro ao encodificar mensagem: %s", err.Error())
+		log.Fatal(err.Error())
 	}
 
-	_, err = comHandler.connection.Write(encoderBuffer.Bytes())
-	if err != nil {
+	if err := framing.WriteFrame(comHandler.connection, data); err != nil {
 		log.Fatal(err)
 	}
 
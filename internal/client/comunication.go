@@ -8,13 +8,15 @@ import (
 	"log"
 	"net"
 	"os"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/direct"
+	"github.com/TP-TS-Go/internal/framing"
+	"github.com/TP-TS-Go/internal/keyring"
 	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
 )
 
@@ -22,22 +24,43 @@ type ComHandler struct {
 	senderId   string
 	srvAddress string
 	target     string
+	session    *crypto.Session
+	sequences  *sequenceStore
+	identity   *crypto.IdentityKey
 	connection net.Conn
+	frames     *framing.Reader
+	writeMu    sync.Mutex
+	// conversations keeps the ratchet of the direct conversation with the target,
+	// queued holds what the user typed before the conversation could send
+	conversations *direct.Conversations
+	queued        [][]byte
+	queueMu       sync.Mutex
+	// outbox follows the state of the messages the user sent and sends again those the server did not ack
+	outbox    *outbox
+	retryStop chan struct{}
 	//---
 	onMsgReceive func(msgpacktyps.Message)
 	// ---
 	listenConCloseChn   chan bool
 	listenUsrIoCloseChn chan bool
+	// inputClosed is closed once the user input ends
+	inputClosed chan struct{}
 }
 
 func NewComHandler(sender string, target string, srvAddress string) *ComHandler {
-	handler := ComHandler{
+	handler := &ComHandler{
 		senderId:   sender,
 		target:     target,
 		srvAddress: srvAddress,
+		retryStop:  make(chan struct{}),
+
+		listenConCloseChn:   make(chan bool),
+		listenUsrIoCloseChn: make(chan bool),
+		inputClosed:         make(chan struct{}),
 	}
+	handler.outbox = newOutbox(handler.writeMessage)
 
-	return &handler
+	return handler
 }
 
 func (ch *ComHandler) spawnUserIoListenerRoutine() {
@@ -46,38 +69,38 @@ func (ch *ComHandler) spawnUserIoListenerRoutine() {
 	go func() {
 		for {
 			inputBytes, err := userInputBuffer.ReadBytes(0x0a)
+			// The end of the input ends the run, see HandleServerComunication
 			if err != nil && errors.Is(err, io.EOF) {
-				ch.connection.Close()
+				close(ch.inputClosed)
+				return
 			}
 			if err != nil {
 				log.Fatalf("erro ao ler user input: %s", err.Error())
 			}
 
-			if strings.Contains(string(inputBytes), "#!createSecret") {
-				config, _ := loadConfingFromFile()
-				secret, time := crypto.GenerateSecret([]byte(config.RawMaterial))
-				config.Secret = string(secret)
-
-				writeToConfigFile(*config)
-
-				log.Printf("Secret: %s", secret)
-
-				x := fmt.Sprintf("%d", time.Unix())
-				log.Printf("CREATED AT: %s\n", x)
-				inputBytes = append(inputBytes, []byte(x)...)
+			if ch.session == nil {
+				log.Println("sem secret, e preciso correr INIT primeiro")
+				continue
 			}
 
-			// Create and encode the message into the MsgPack Format
-			msg := msgpacktyps.NewMessage(msgpacktyps.SendContent, ch.senderId, ch.target, inputBytes...)
+			if ch.conversations != nil && ch.target != msgpacktyps.BroadcastTarget {
+				if err := ch.SendDirect(inputBytes); err != nil {
+					log.Fatalf("erro ao enviar a msg: %s", err.Error())
+				}
+				continue
+			}
 
-			b, err := msgpack.Marshal(&msg)
-			if err != nil {
-				log.Fatalf("erro no marshaling: %s", err.Error())
+			// Create and encode the message into the MsgPack Format, the content is bound to the message metadata
+			msg := msgpacktyps.NewMessage(msgpacktyps.SendContent, ch.senderId, ch.target)
+			if ch.identity != nil {
+				msg.SignerKey = ch.identity.PublicKey()
+				msg.Signature = ch.identity.Sign(msg.SignedPayload(inputBytes))
 			}
 
-			_, err = ch.connection.Write(b)
-			if err != nil {
-				log.Fatalf("erro ao escrever na conexao: %s", err.Error())
+			// Tracked first, the ack may come back before writeMessage returns
+			ch.outbox.Track(msg, inputBytes, inputBytes)
+			if err := ch.writeMessage(msg, inputBytes); err != nil {
+				log.Fatalf("erro ao enviar a msg: %s", err.Error())
 			}
 
 			// if nn < len(inputBytes) {
@@ -92,23 +115,21 @@ func (ch *ComHandler) spawnUserIoListenerRoutine() {
 }
 
 func (ch *ComHandler) spawnConnectionListenerRoutine() {
-	connectionRespBuff := bufio.NewReader(ch.connection)
-
 	go func() {
 		for {
-			data, err := connectionRespBuff.ReadBytes(0x0a)
+			frame, err := ch.frames.ReadFrame()
+			// Closed by ShutDown
+			if err != nil && errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			if len(data) < 1 {
-				continue
-			}
-
 			var msgM msgpacktyps.Message
-			err = msgpack.Unmarshal(data, &msgM)
-			if err != nil && !errors.Is(err, io.EOF) {
-				log.Printf("erro ao descodificar a msg: %s", err.Error())
+			if err := msgpack.Unmarshal(frame, &msgM); err != nil {
+				log.Printf("mensagem mal formada do server: %s", err.Error())
+				continue
 			}
 
 			ch.onMsgReceive(msgM)
@@ -127,19 +148,34 @@ func (ch *ComHandler) CreateConnection() error {
 		return fmt.Errorf("impossivel criar conexao sem onResponseHandler")
 	}
 
-	conn, err := net.Dial("tcp", ch.srvAddress)
-	if err != nil {
-		return fmt.Errorf("falha ao iciar a conexao: %s", err.Error())
+	if ch.connection == nil {
+		if err := ch.Dial(); err != nil {
+			return err
+		}
 	}
 
-	ch.connection = conn
-
 	// Reads the data sent from the server, on a coroutine
 	go ch.spawnConnectionListenerRoutine()
 
 	// Reads the users input from the os.StdIo, on a coroutine
 	go ch.spawnUserIoListenerRoutine()
 
+	// Sends again what the server does not ack in time
+	go ch.outbox.RunRetries(ch.retryStop)
+
+	return nil
+}
+
+// Dial connects to the server, what is read before CreateConnection starts the listener is read with readMessage
+func (ch *ComHandler) Dial() error {
+	conn, err := net.Dial("tcp", ch.srvAddress)
+	if err != nil {
+		return fmt.Errorf("falha ao iciar a conexao: %s", err.Error())
+	}
+
+	ch.connection = conn
+	// Each message comes in its own length prefixed frame
+	ch.frames = framing.NewReader(bufio.NewReader(conn))
 	return nil
 }
 
@@ -147,7 +183,171 @@ func (ch *ComHandler) SetOnMsgReceive(function func(msgpacktyps.Message)) {
 	ch.onMsgReceive = function
 }
 
+// SetSession sets the session built from the secret shared with the server, used to encrypt the outgoing messages
+func (ch *ComHandler) SetSession(session *crypto.Session) {
+	ch.session = session
+}
+
+// SetSequenceStore sets where the sequence numbers of the session are saved before they are used
+func (ch *ComHandler) SetSequenceStore(sequences *sequenceStore) {
+	ch.sequences = sequences
+}
+
+// writeMessage seals the content with the session, bound to the message metadata, and writes the message on the connection
+func (ch *ComHandler) writeMessage(msg msgpacktyps.Message, content []byte) error {
+	var err error
+	msg.Sequence = ch.session.NextSequence()
+	if ch.sequences != nil {
+		if err := ch.sequences.Reserve(msg.Sequence); err != nil {
+			return fmt.Errorf("erro ao guardar o numero de sequencia: %s", err.Error())
+		}
+	}
+	msg.Content, err = ch.session.Seal(content, msg.SessionAD())
+	if err != nil {
+		return fmt.Errorf("erro ao encriptar a msg: %s", err.Error())
+	}
+
+	b, err := msgpack.Marshal(&msg)
+	if err != nil {
+		return fmt.Errorf("erro no marshaling: %s", err.Error())
+	}
+
+	ch.writeMu.Lock()
+	defer ch.writeMu.Unlock()
+
+	if err := framing.WriteFrame(ch.connection, b); err != nil {
+		return fmt.Errorf("erro ao escrever na conexao: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Authenticate proves the session to the server as soon as the connection is up,
+// what the server kept for this client while it was offline comes without waiting for it to send anything
+func (ch *ComHandler) Authenticate() error {
+	return ch.writeMessage(msgpacktyps.NewMessage(msgpacktyps.Authenticate, ch.senderId, ""), nil)
+}
+
+// Send writes a message of a direct conversation
+func (ch *ComHandler) Send(out direct.Outgoing) error {
+	return ch.writeMessage(out.Message, out.Content)
+}
+
+// StartDirect asks the target for a new conversation, unless the saved one can already send
+func (ch *ComHandler) StartDirect() error {
+	if ch.target == msgpacktyps.BroadcastTarget || ch.conversations.CanSend(ch.target) {
+		return nil
+	}
+
+	init, err := ch.conversations.Start(ch.target)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("A iniciar conversa com %s ...", ch.target)
+	return ch.Send(init)
+}
+
+// SendDirect encrypts the content for the target with the ratchet, or queues it until the conversation is ready
+func (ch *ComHandler) SendDirect(content []byte) error {
+	ch.queueMu.Lock()
+	if !ch.conversations.CanSend(ch.target) {
+		ch.queued = append(ch.queued, content)
+		ch.queueMu.Unlock()
+		log.Printf("a aguardar a conversa com %s, a msg sera enviada depois", ch.target)
+		return nil
+	}
+	ch.queueMu.Unlock()
+
+	out, err := ch.conversations.Seal(ch.target, content)
+	if err != nil {
+		return err
+	}
+	ch.outbox.Track(out.Message, out.Content, content)
+	return ch.Send(out)
+}
+
+// SendReceipt tells the peer, inside the conversation, that its messages got here or were read
+func (ch *ComHandler) SendReceipt(peerId string, state msgpacktyps.ReceiptState, messageIds ...string) error {
+	if !ch.conversations.CanSend(peerId) {
+		return fmt.Errorf("sem conversa com %s", peerId)
+	}
+
+	content, err := msgpack.Marshal(&msgpacktyps.ReceiptContent{MessageIds: messageIds, State: state})
+	if err != nil {
+		return err
+	}
+
+	out, err := ch.conversations.SealType(msgpacktyps.Receipt, peerId, content)
+	if err != nil {
+		return err
+	}
+	return ch.Send(out)
+}
+
+// FlushDirect sends the queued messages once the conversation with the target can send
+func (ch *ComHandler) FlushDirect() error {
+	ch.queueMu.Lock()
+	if len(ch.queued) == 0 || !ch.conversations.CanSend(ch.target) {
+		ch.queueMu.Unlock()
+		return nil
+	}
+	queued := ch.queued
+	ch.queued = nil
+	ch.queueMu.Unlock()
+
+	for _, content := range queued {
+		if err := ch.SendDirect(content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetConversations sets the ratchets used for the direct conversation with the target
+func (ch *ComHandler) SetConversations(conversations *direct.Conversations) {
+	ch.conversations = conversations
+}
+
+// SetIdentity sets the key that signs the outgoing messages
+func (ch *ComHandler) SetIdentity(identity *crypto.IdentityKey) {
+	ch.identity = identity
+}
+
+// InputClosed is closed once the user input ends
+func (ch *ComHandler) InputClosed() <-chan struct{} {
+	return ch.inputClosed
+}
+
+// Drain waits, up to timeout, for the acks of the server and the receipts of the targets of what was sent,
+// the messages still waiting for their conversation included
+func (ch *ComHandler) Drain(timeout time.Duration) {
+	ticker := time.NewTicker(ackTimeout / 4)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+
+	for {
+		ch.queueMu.Lock()
+		unsettled := ch.outbox.Unsettled() + len(ch.queued)
+		ch.queueMu.Unlock()
+
+		if unsettled == 0 {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			log.Printf("%d mensagens ainda sem resposta", unsettled)
+			return
+		}
+	}
+}
+
 func (ch *ComHandler) ShutDown() {
+	close(ch.retryStop)
+	ch.outbox.Summary()
+
 	ch.listenConCloseChn <- true
 	ch.listenUsrIoCloseChn <- true
 
@@ -155,9 +355,8 @@ func (ch *ComHandler) ShutDown() {
 	close(ch.listenUsrIoCloseChn)
 }
 
-func testExample(msg msgpacktyps.Message) {
-	log.Printf("MSG DATA: %s\n", msg.Content)
-}
+// BroadcastArg is the SEND target that sends to every connected client
+const BroadcastArg = "ALL"
 
 func HandleServerComunication(args []string) {
 	if len(args) != 1 {
@@ -170,27 +369,219 @@ func HandleServerComunication(args []string) {
 		log.Fatalf("erro a ler configuracao: %s", err.Error())
 	}
 
+	ring, err := openKeyring(config)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	secret, exists := ring.Get(keyring.KindSecret, config.ServerAddress)
+	if !exists {
+		log.Fatalf("o keyring nao tem o secret de %s, corre INIT primeiro", config.ServerAddress)
+	}
+
+	// SEND ALL goes to every connected client, anything else is the id of the only one that gets it
+	target := args[0]
+	if target == BroadcastArg {
+		target = msgpacktyps.BroadcastTarget
+	}
+
 	// Connect to the server specefied in the config file
-	comHandler := NewComHandler(config.ClientId, args[0], config.ServerAddress)
+	comHandler := NewComHandler(config.ClientId, target, config.ServerAddress)
+	session, err := crypto.NewSession(crypto.CipherSuiteID(config.Suite), secret)
+	secret.Destroy()
+	if err != nil {
+		log.Fatalf("erro ao preparar a sessao: %s", err.Error())
+	}
+	if err := session.SetPadding(crypto.PaddingPolicy(config.Padding)); err != nil {
+		log.Fatalf("padding invalido na configuracao: %s", err.Error())
+	}
+	// The secret outlives this run, so must the numbering: start past anything a previous run could have sent or accepted
+	sequences := newSequenceStore(*config)
+	session.SetSequence(sequences.Last())
+	session.SetReceived(sequences.LastReceived())
+	comHandler.SetSession(session)
+	comHandler.SetSequenceStore(sequences)
+
+	identity, err := loadIdentity(config, ring)
+	if err != nil {
+		log.Fatalf("erro ao carregar a chave de identidade: %s", err.Error())
+	}
+	comHandler.SetIdentity(identity)
+
+	peers := loadPeerKeys(ring)
+
+	conversations := loadConversations(config, ring, identity)
+	comHandler.SetConversations(conversations)
+
+	// The messages already shown, by sender and id, a message sent again is only acknowledged again
+	seen := make(map[string]bool)
+
+	comHandler.SetOnMsgReceive(func(msg msgpacktyps.Message) {
+		content, err := session.Open(msg.Content, msg.SessionAD())
+		if err != nil {
+			log.Printf("mensagem rejeitada de %s: %s", msg.SenderId, err.Error())
+			return
+		}
+
+		if err := session.CheckSequence(msg.Sequence); err != nil {
+			log.Printf("mensagem repetida rejeitada (%d ate agora): %s", session.Replays(), err.Error())
+			return
+		}
+		if err := sequences.Accept(msg.Sequence); err != nil {
+			log.Printf("erro ao guardar a sequencia recebida: %s", err.Error())
+		}
+
+		// The server routes by Target, this only guards against it sending us what is not ours
+		if msg.Target != msgpacktyps.BroadcastTarget && msg.Target != config.ClientId {
+			return
+		}
+
+		// Sent by the server itself, authenticated by the session
+		if msg.Type == msgpacktyps.SendContentResponse && msg.SenderId == "" {
+			handleSendResponse(comHandler, content)
+			return
+		}
+
+		// A message the sender sent again, because the ack of the server was late or lost
+		seenKey := msg.SenderId + " " + msg.Id
+		if msg.Type == msgpacktyps.SendContent && seen[seenKey] {
+			if msg.Target != msgpacktyps.BroadcastTarget {
+				if err := comHandler.SendReceipt(msg.SenderId, msgpacktyps.ReceiptRead, msg.Id); err != nil {
+					log.Printf("erro ao enviar recibo a %s: %s", msg.SenderId, err.Error())
+				}
+			}
+			return
+		}
+
+		// The server relays the message, only the sender's signature proves who wrote it
+		status := crypto.PeerUnverified
+		if msg.Signature != nil {
+			status = peers.Verify(msg.SenderId, msg.SignerKey, msg.SignedPayload(content), msg.Signature)
+			if status == crypto.PeerNew {
+				savePeerKey(ring, msg.SenderId, msg.SignerKey)
+			}
+		}
+
+		if msg.Target == msgpacktyps.BroadcastTarget {
+			seen[seenKey] = true
+			log.Printf("MSG DATA %s[%s]: %s\n", verificationMarker(status), msg.SenderId, content)
+			return
+		}
+
+		// A conversation is only started by a key exchange signed with the key pinned for the peer
+		if (msg.Type == msgpacktyps.RatchetInit || msg.Type == msgpacktyps.RatchetAccept) && !status.Trusted() {
+			log.Printf("%spedido de conversa de %s rejeitado", verificationMarker(status), msg.SenderId)
+			return
+		}
+
+		plaintext, reply, err := conversations.Handle(msg, content)
+		if err != nil {
+			log.Printf("mensagem direta rejeitada de %s: %s", msg.SenderId, err.Error())
+			return
+		}
+		if reply != nil {
+			if err := comHandler.Send(*reply); err != nil {
+				log.Printf("erro ao responder a %s: %s", msg.SenderId, err.Error())
+			}
+		}
+		if err := comHandler.FlushDirect(); err != nil {
+			log.Printf("erro ao enviar as msgs em espera: %s", err.Error())
+		}
+
+		if plaintext == nil {
+			return
+		}
+
+		if msg.Type == msgpacktyps.Receipt {
+			var receipt msgpacktyps.ReceiptContent
+			if err := msgpack.Unmarshal(plaintext, &receipt); err != nil {
+				log.Printf("recibo invalido de %s: %s", msg.SenderId, err.Error())
+				return
+			}
+			comHandler.outbox.Receipt(msg.SenderId, receipt)
+			return
+		}
+
+		seen[seenKey] = true
+		if err := comHandler.SendReceipt(msg.SenderId, msgpacktyps.ReceiptDelivered, msg.Id); err != nil {
+			log.Printf("erro ao enviar recibo a %s: %s", msg.SenderId, err.Error())
+		}
+		log.Printf("MSG DIRETA [%s]: %s\n", msg.SenderId, plaintext)
+		if err := comHandler.SendReceipt(msg.SenderId, msgpacktyps.ReceiptRead, msg.Id); err != nil {
+			log.Printf("erro ao enviar recibo a %s: %s", msg.SenderId, err.Error())
+		}
+	})
+
+	if err := comHandler.Dial(); err != nil {
+		log.Fatalf("erro ao iniciar o comHandler: %s", err.Error())
+	}
+
+	if err := comHandler.Authenticate(); err != nil {
+		log.Fatalf("erro ao autenticar no server: %s", err.Error())
+	}
+	reply, err := comHandler.readMessage(handshakeTimeout)
+	if err != nil {
+		log.Fatalf("erro ao autenticar no server: %s", err.Error())
+	}
 
-	comHandler.SetOnMsgReceive(testExample)
+	// The server restarted since the last handshake, the id is kept but the session must be made again
+	if reply.Type == msgpacktyps.Rekey {
+		log.Println("o server ja nao tem a sessao, a refazer o handshake")
+		session, sequences, err = rekey(comHandler, config, ring, identity)
+		if err != nil {
+			log.Fatalf("erro no novo handshake: %s", err.Error())
+		}
+		comHandler.SetSession(session)
+		comHandler.SetSequenceStore(sequences)
+
+		if err := comHandler.Authenticate(); err != nil {
+			log.Fatalf("erro ao autenticar no server: %s", err.Error())
+		}
+		if reply, err = comHandler.readMessage(handshakeTimeout); err != nil {
+			log.Fatalf("erro ao autenticar no server: %s", err.Error())
+		}
+	}
+
+	// Sealed like anything else the server sends, only the server holding the session could answer
+	if reply.Type != msgpacktyps.AuthenticateResponse {
+		log.Fatalf("resposta inesperada do server ao autenticar: tipo %d", reply.Type)
+	}
+	if _, err := session.Open(reply.Content, reply.SessionAD()); err != nil {
+		log.Fatalf("resposta do server ao autenticar rejeitada: %s", err.Error())
+	}
+	if err := session.CheckSequence(reply.Sequence); err != nil {
+		log.Fatalf("resposta do server ao autenticar repetida: %s", err.Error())
+	}
+	if err := sequences.Accept(reply.Sequence); err != nil {
+		log.Printf("erro ao guardar a sequencia recebida: %s", err.Error())
+	}
 
 	err = comHandler.CreateConnection()
 	if err != nil {
 		log.Fatalf("erro ao iniciar o comHandler: %s", err.Error())
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	if err := comHandler.StartDirect(); err != nil {
+		log.Fatalf("erro ao iniciar a conversa: %s", err.Error())
+	}
 
-	go func() {
-		time.Sleep(time.Second * 5)
-		comHandler.ShutDown()
-		wg.Done()
-		log.Println("Quitting")
-	}()
+	// The run ends with the user input (Ctrl-D, or the end of a pipe), once what was sent got its answers
+	<-comHandler.InputClosed()
+	comHandler.Drain(shutdownGrace)
+	comHandler.ShutDown()
+	log.Println("Quitting")
+}
 
-	// TODO - Tell the server that I want to talk to the client with id == target
+// handleSendResponse applies the ack of the server to the message it answers, and shows why a message was not delivered
+func handleSendResponse(ch *ComHandler, content []byte) {
+	var response msgpacktyps.SendResponse
+	if err := msgpack.Unmarshal(content, &response); err != nil {
+		log.Printf("resposta do server invalida: %s", err.Error())
+		return
+	}
 
-	wg.Wait()
+	if !response.Accepted() {
+		log.Printf("msg %s para %s de %s nao entregue: %s", shortId(response.MessageId), response.Target, time.UnixMilli(response.Created).Format(time.TimeOnly), response.Reason)
+	}
+	ch.outbox.Acknowledge(response)
 }
@@ -6,16 +6,91 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"sync"
 
 	"github.com/pelletier/go-toml/v2"
 )
 
+// Config is the public part of the client configuration, the secret, the identity key, the pinned peer keys
+// and the conversations are kept in the encrypted keyring (see keyring.go)
 type Config struct {
-	RawMaterial   string `toml:"raw_material"`
 	CreatedAt     int64  `toml:"created_ts"`
 	ClientId      string `toml:"client_id"`
-	Secret        string `toml:"secret"`
+	Suite         byte   `toml:"suite"`   // cipher suite negotiated in the handshake
+	Padding       byte   `toml:"padding"` // length-hiding policy announced by the server in the handshake
 	ServerAddress string `toml:"server"`
+	// Sequence is the last sequence number of the session reserved by a run, the next run numbers its messages after it
+	Sequence uint64 `toml:"sequence"`
+	// Received is the highest sequence number accepted from the server, anything at or below it is a replay
+	Received uint64 `toml:"received"`
+}
+
+// sequenceBlock is how many sequence numbers are reserved at a time, the config is written once per block
+const sequenceBlock = 1024
+
+// sequenceStore saves in the config how far the session numbered its messages, and the highest number it accepted
+// from the server. The secret outlives a run, so must the numbering: each side rejects a number it already got as a replay.
+type sequenceStore struct {
+	mu     sync.Mutex
+	config Config
+}
+
+func newSequenceStore(config Config) *sequenceStore {
+	return &sequenceStore{config: config}
+}
+
+// Last returns the last number reserved by the previous runs
+func (s *sequenceStore) Last() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.config.Sequence
+}
+
+// Reserve makes sure seq is saved as used before the message that carries it is sent.
+// A run that ends without using its whole block only skips the rest of it.
+func (s *sequenceStore) Reserve(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq <= s.config.Sequence {
+		return nil
+	}
+
+	config := s.config
+	config.Sequence = seq + sequenceBlock - 1
+	if err := saveConfig(config); err != nil {
+		return err
+	}
+	s.config = config
+	return nil
+}
+
+// LastReceived returns the highest number accepted from the server by the previous runs
+func (s *sequenceStore) LastReceived() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.config.Received
+}
+
+// Accept saves seq as received when it is the highest so far. It is written on every new highest number,
+// unlike Reserve the receiving side can not know ahead of time what it will get.
+func (s *sequenceStore) Accept(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq <= s.config.Received {
+		return nil
+	}
+
+	config := s.config
+	config.Received = seq
+	if err := saveConfig(config); err != nil {
+		return err
+	}
+	s.config = config
+	return nil
 }
 
 func getConfFolderPath() (string, error) {
@@ -70,27 +145,47 @@ func loadConfingFromFile() (config *Config, err error) {
 }
 
 func writeToConfigFile(config Config) {
+	if err := saveConfig(config); err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+// saveConfig replaces the config file through a temporary file, a crash never leaves it half written
+func saveConfig(config Config) error {
 	path_conf, err := getConfFolderPath()
 	if err != nil {
-		log.Fatalf("erro: %s", err.Error())
+		return fmt.Errorf("erro: %s", err.Error())
 	}
 
 	if err := os.MkdirAll(path_conf, 0760); err != nil {
-		log.Fatalf("erro ao escrever no ficheiro de configuracao: %s", err.Error())
+		return fmt.Errorf("erro ao escrever no ficheiro de configuracao: %s", err.Error())
 	}
 
-	file, err := os.Create(path.Join(path_conf, "cryptr.toml"))
+	content, err := toml.Marshal(config)
 	if err != nil {
-		log.Fatalf("erro ao criar o ficheiro de configuracao: %s", err.Error())
+		return fmt.Errorf("falha ao ler a configuracao do cliente: %s", err.Error())
 	}
 
-	content, err := toml.Marshal(config)
+	tmp, err := os.CreateTemp(path_conf, ".cryptr-*.toml")
 	if err != nil {
-		log.Fatalf("falha ao ler a configuracao do cliente: %s", err.Error())
+		return fmt.Errorf("erro ao criar o ficheiro de configuracao: %s", err.Error())
 	}
+	defer os.Remove(tmp.Name())
 
-	_, err = file.Write(content)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("erro ao escrever no ficheiro de configuracao: %s", err.Error())
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("erro ao escrever no ficheiro de configuracao: %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("erro ao escrever no ficheiro de configuracao: %s", err.Error())
+	}
+
+	if err := os.Rename(tmp.Name(), path.Join(path_conf, "cryptr.toml")); err != nil {
+		return fmt.Errorf("erro ao escrever no ficheiro de configuracao: %s", err.Error())
 	}
+	return nil
 }
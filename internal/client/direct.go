@@ -0,0 +1,32 @@
+package client
+
+import (
+	"log"
+
+	"github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/direct"
+	"github.com/TP-TS-Go/internal/keyring"
+)
+
+// loadConversations restores the ratchets saved in the keyring, and saves them back every time they move
+func loadConversations(config *Config, ring *keyring.Keyring, identity *crypto.IdentityKey) *direct.Conversations {
+	conversations := direct.NewConversations(config.ClientId, identity)
+
+	for _, entry := range ring.List(keyring.KindRatchet) {
+		if err := conversations.Restore(entry.Name, entry.Material); err != nil {
+			log.Printf("[WARN] conversa com %s invalida no keyring, sera iniciada de novo: %s", entry.Name, err.Error())
+		}
+	}
+
+	conversations.SetOnUpdate(func(peerId string, ratchet *crypto.Ratchet) {
+		state, err := ratchet.MarshalBinary()
+		if err == nil {
+			err = ring.Set(keyring.KindRatchet, peerId, state)
+		}
+		if err != nil {
+			log.Printf("erro ao guardar a conversa com %s: %s", peerId, err.Error())
+		}
+	})
+
+	return conversations
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/keyring"
+)
+
+// loadIdentity returns the client's Ed25519 identity key for the server, creating (and saving) one if the keyring has none
+func loadIdentity(config *Config, ring *keyring.Keyring) (*crypto.IdentityKey, error) {
+	seed, exists := ring.Get(keyring.KindIdentity, config.ServerAddress)
+	if !exists {
+		identity, err := crypto.GenerateIdentityKey()
+		if err != nil {
+			return nil, err
+		}
+
+		seed = identity.Seed()
+		defer seed.Destroy()
+		if err := ring.Set(keyring.KindIdentity, config.ServerAddress, seed); err != nil {
+			return nil, err
+		}
+		log.Println("Nova chave de identidade criada")
+		return identity, nil
+	}
+	defer seed.Destroy()
+
+	return crypto.NewIdentityKeyFromSeed(seed)
+}
+
+// loadPeerKeys returns the store of the peer keys pinned in the keyring, with the ones the user verified marked
+func loadPeerKeys(ring *keyring.Keyring) *crypto.PeerKeys {
+	pinned := make(map[string][]byte)
+	for _, entry := range ring.List(keyring.KindPeer) {
+		pinned[entry.Name] = entry.Material
+	}
+
+	peers := crypto.NewPeerKeys(pinned)
+	for _, entry := range ring.List(keyring.KindVerified) {
+		if !peers.MarkVerified(entry.Name, entry.Material) {
+			log.Printf("[WARN] a chave verificada de %s nao e a chave guardada, verifique de novo", entry.Name)
+		}
+	}
+	return peers
+}
+
+// savePeerKey pins the key of a peer seen for the first time in the keyring
+func savePeerKey(ring *keyring.Keyring, peerId string, key []byte) {
+	if err := ring.Set(keyring.KindPeer, peerId, key); err != nil {
+		log.Printf("erro ao guardar a chave de %s: %s", peerId, err.Error())
+	}
+}
+
+// verificationMarker is shown in front of received messages whose sender could not be verified
+func verificationMarker(status crypto.PeerStatus) string {
+	switch status {
+	case crypto.PeerVerified:
+		return "[verificado] "
+	case crypto.PeerKnown, crypto.PeerNew:
+		return ""
+	case crypto.PeerKeyChanged:
+		return "[NAO VERIFICADO - A CHAVE DO REMETENTE MUDOU] "
+	default:
+		return "[NAO VERIFICADO] "
+	}
+}
+
+// HandleVerify shows the safety number of our identity key and the key pinned for a peer, to be compared with
+// the one the peer sees (in person, over the phone, ...):
+//
+//	VERIFY <peer id>       -> shows the safety number
+//	VERIFY <peer id> ok    -> the numbers match, marks the peer as verified
+func HandleVerify(args []string) {
+	if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "ok") {
+		log.Fatalf("uso: VERIFY <peer id> [ok]")
+	}
+	peerId := args[0]
+
+	config, err := loadConfingFromFile()
+	if err != nil {
+		log.Fatalf("erro a ler configuracao: %s", err.Error())
+	}
+
+	ring, err := openKeyring(config)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer ring.Close()
+
+	identity, err := loadIdentity(config, ring)
+	if err != nil {
+		log.Fatalf("erro ao carregar a chave de identidade: %s", err.Error())
+	}
+	defer identity.Destroy()
+
+	peerKey, exists := ring.Get(keyring.KindPeer, peerId)
+	if !exists {
+		log.Fatalf("ainda nao ha chave de %s, troque uma mensagem primeiro", peerId)
+	}
+
+	if err := showSafetyNumber(identity.PublicKey(), peerId, peerKey); err != nil {
+		log.Fatalf("erro ao calcular o safety number: %s", err.Error())
+	}
+
+	verifiedKey, verified := ring.Get(keyring.KindVerified, peerId)
+	verified = verified && verifiedKey.Equal(peerKey)
+
+	switch {
+	case len(args) == 2:
+		if err := ring.Set(keyring.KindVerified, peerId, peerKey); err != nil {
+			log.Fatalf("erro ao guardar a verificacao: %s", err.Error())
+		}
+		log.Printf("%s marcado como verificado", peerId)
+	case verified:
+		log.Printf("%s ja esta verificado", peerId)
+	default:
+		log.Printf("Se o numero for igual no dispositivo de %s, corra VERIFY %s ok", peerId, peerId)
+	}
+}
+
+// showSafetyNumber prints the safety number of the two identity keys, as digits and as words
+func showSafetyNumber(localKey []byte, peerId string, peerKey []byte) error {
+	number, err := crypto.ComputeSafetyNumber(localKey, peerKey)
+	if err != nil {
+		return err
+	}
+
+	groups := number.Groups()
+	fmt.Printf("Safety number com %s:\n\n", peerId)
+	for i := 0; i < len(groups); i += 4 {
+		fmt.Printf("    %s\n", strings.Join(groups[i:min(i+4, len(groups))], " "))
+	}
+	fmt.Printf("\n    %s\n\n", strings.Join(number.Words(), " "))
+	return nil
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+
+	"github.com/TP-TS-Go/internal/keyring"
+)
+
+// legacySecrets are the fields older versions kept in plaintext in cryptr.toml, moved to the keyring on first use
+type legacySecrets struct {
+	Secret      string            `toml:"secret"`
+	IdentityKey string            `toml:"identity_key"`
+	Peers       map[string]string `toml:"peers"`
+	Ratchets    map[string]string `toml:"ratchets"`
+}
+
+// openKeyring unlocks the keyring (creating it if needed), with the key file of $CRYPTR_KEYRING_KEYFILE or a passphrase
+func openKeyring(config *Config) (*keyring.Keyring, error) {
+	keyringPath, err := keyring.DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+
+	ring, err := keyring.Load(keyringPath, keyring.DefaultCredentials())
+	if err != nil {
+		return nil, fmt.Errorf("erro ao abrir o keyring: %s", err.Error())
+	}
+
+	if config != nil {
+		if err := migrateLegacySecrets(config, ring); err != nil {
+			return nil, fmt.Errorf("erro ao mover os segredos da configuracao para o keyring: %s", err.Error())
+		}
+	}
+
+	return ring, nil
+}
+
+// migrateLegacySecrets moves the secrets of a config written by an older version into the keyring,
+// then rewrites the config without them
+func migrateLegacySecrets(config *Config, ring *keyring.Keyring) error {
+	path_conf, err := getConfFolderPath()
+	if err != nil {
+		return err
+	}
+
+	confContents, err := os.ReadFile(path.Join(path_conf, "cryptr.toml"))
+	if err != nil {
+		return err
+	}
+
+	var legacy legacySecrets
+	if err := toml.Unmarshal(confContents, &legacy); err != nil {
+		return err
+	}
+	if legacy.Secret == "" && legacy.IdentityKey == "" && len(legacy.Peers) == 0 && len(legacy.Ratchets) == 0 {
+		return nil
+	}
+
+	moves := []struct {
+		kind    keyring.Kind
+		entries map[string]string
+	}{
+		{keyring.KindSecret, map[string]string{config.ServerAddress: legacy.Secret}},
+		{keyring.KindIdentity, map[string]string{config.ServerAddress: legacy.IdentityKey}},
+		{keyring.KindPeer, legacy.Peers},
+		{keyring.KindRatchet, legacy.Ratchets},
+	}
+	for _, move := range moves {
+		for name, value := range move.entries {
+			if value == "" {
+				continue
+			}
+
+			material, err := hex.DecodeString(value)
+			if err != nil {
+				log.Printf("[WARN] %s %s invalido na configuracao, ignorado", move.kind, name)
+				continue
+			}
+
+			// What is already in the keyring is newer
+			if err := ring.Add(move.kind, name, material); err != nil && !errors.Is(err, keyring.ErrExists) {
+				return err
+			}
+		}
+	}
+
+	writeToConfigFile(*config)
+	log.Printf("Segredos movidos da configuracao para o keyring %s", ring.Path())
+	return nil
+}
+
+// HandleKeyring runs the keyring subcommands:
+//
+//	KEYRING list                       -> kind, name and creation date of every entry
+//	KEYRING add <kind> <name> <hex>    -> adds an entry, for instance the pinned key of a peer
+//	KEYRING remove <kind> <name>       -> removes an entry
+//	KEYRING export [kind [name]]       -> prints the entries as "kind name hex" lines, in the clear
+func HandleKeyring(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("falta o comando do keyring: list, add, remove ou export")
+	}
+
+	ring, err := openKeyring(nil)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	switch args[0] {
+	case "list":
+		for _, entry := range ring.List("") {
+			fmt.Printf("%-8s %s (%d bytes, %s)\n", entry.Kind, entry.Name, len(entry.Material), time.Unix(entry.CreatedAt, 0).Format(time.DateTime))
+		}
+	case "add":
+		if len(args) != 4 {
+			log.Fatalf("uso: KEYRING add <kind> <name> <hex>")
+		}
+
+		material, err := hex.DecodeString(args[3])
+		if err != nil {
+			log.Fatalf("material invalido: %s", err.Error())
+		}
+		if err := ring.Add(keyring.Kind(args[1]), args[2], material); err != nil {
+			log.Fatal(err.Error())
+		}
+	case "remove":
+		if len(args) != 3 {
+			log.Fatalf("uso: KEYRING remove <kind> <name>")
+		}
+
+		if err := ring.Remove(keyring.Kind(args[1]), args[2]); err != nil {
+			log.Fatal(err.Error())
+		}
+	case "export":
+		var kind keyring.Kind
+		var name string
+		if len(args) > 1 {
+			kind = keyring.Kind(args[1])
+		}
+		if len(args) > 2 {
+			name = args[2]
+		}
+
+		if err := ring.Export(os.Stdout, kind, name); err != nil {
+			log.Fatal(err.Error())
+		}
+	default:
+		log.Fatalf("comando do keyring desconhecido: %s", args[0])
+	}
+}
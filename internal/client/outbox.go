@@ -0,0 +1,289 @@
+package client
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
+)
+
+const (
+	// ackTimeout is how long a message waits for the ack of the server before it is sent again
+	ackTimeout = 2 * time.Second
+	// maxSendAttempts bounds how many times a message is sent without an ack before it is given up
+	maxSendAttempts = 3
+	// shutdownGrace bounds how long a client that is quitting waits for the acks and receipts of what it sent,
+	// a message that is never acked fails within it
+	shutdownGrace = ackTimeout*(maxSendAttempts+1) + time.Second
+	// previewLength bounds how much of a message is shown next to its state
+	previewLength = 24
+	// maxOutboxHistory bounds how many messages the outbox remembers, the oldest ones past waiting for an ack are forgotten first
+	maxOutboxHistory = 256
+)
+
+// MessageState is how far a message sent by the user got, each state only moves forward
+type MessageState byte
+
+const (
+	// StatePending means the message was written but the server did not ack it yet
+	StatePending MessageState = iota
+	// StateSent means the server relayed the message
+	StateSent
+	// StateQueued means the target was offline and the server kept the message for it
+	StateQueued
+	// StateDelivered means the target's client got the message
+	StateDelivered
+	// StateRead means the message was shown to the target
+	StateRead
+	// StateFailed means the server could not deliver the message, or never acked it
+	StateFailed
+)
+
+func (s MessageState) String() string {
+	switch s {
+	case StatePending:
+		return "a enviar"
+	case StateSent:
+		return "enviada"
+	case StateQueued:
+		return "em espera no server"
+	case StateDelivered:
+		return "entregue"
+	case StateRead:
+		return "lida"
+	case StateFailed:
+		return "falhou"
+	default:
+		return "estado desconhecido"
+	}
+}
+
+// outboxEntry is a message sent by the user, kept as written so it can be sent again unchanged
+type outboxEntry struct {
+	msg      msgpacktyps.Message
+	content  []byte
+	preview  string
+	state    MessageState
+	attempts int
+	lastSent time.Time
+}
+
+// outbox follows the messages sent by the user: the acks of the server, the receipts of the target,
+// and sends again the messages the server did not ack in time
+type outbox struct {
+	mu      sync.Mutex
+	entries map[string]*outboxEntry
+	// order keeps the ids in the order the messages were sent, for the summary
+	order []string
+	// forgotten counts the messages dropped to keep the history under maxOutboxHistory
+	forgotten int
+	resend    func(msg msgpacktyps.Message, content []byte) error
+}
+
+// newOutbox returns an empty outbox, resend writes a message on the connection again
+func newOutbox(resend func(msg msgpacktyps.Message, content []byte) error) *outbox {
+	return &outbox{
+		entries: make(map[string]*outboxEntry),
+		resend:  resend,
+	}
+}
+
+// Track records a message that was just written, text is what the user typed
+func (o *outbox) Track(msg msgpacktyps.Message, content []byte, text []byte) {
+	entry := &outboxEntry{
+		msg:      msg,
+		content:  content,
+		preview:  messagePreview(text),
+		state:    StatePending,
+		attempts: 1,
+		lastSent: time.Now(),
+	}
+
+	o.mu.Lock()
+	o.entries[msg.Id] = entry
+	o.order = append(o.order, msg.Id)
+	o.prune()
+	o.mu.Unlock()
+
+	logState(msg.Id, entry)
+}
+
+// Acknowledge applies the response of the server to one of our messages, the others (handshakes, receipts) are not followed
+func (o *outbox) Acknowledge(response msgpacktyps.SendResponse) {
+	state := StateSent
+	switch {
+	case !response.Accepted():
+		state = StateFailed
+	case response.Queued:
+		state = StateQueued
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entry, exists := o.entries[response.MessageId]
+	if !exists {
+		return
+	}
+	// The ack of a message sent twice may come after its receipts
+	if entry.state == StatePending || (entry.state == StateFailed && response.Accepted()) {
+		o.advance(response.MessageId, entry, state)
+	}
+}
+
+// Receipt applies the receipt sent by peerId, only the target of a message can tell it got it
+func (o *outbox) Receipt(peerId string, receipt msgpacktyps.ReceiptContent) {
+	state := StateDelivered
+	if receipt.State == msgpacktyps.ReceiptRead {
+		state = StateRead
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, id := range receipt.MessageIds {
+		entry, exists := o.entries[id]
+		if !exists || entry.msg.Target != peerId {
+			continue
+		}
+		// Delivered after a failed ack still is delivered
+		if entry.state < state || entry.state == StateFailed {
+			o.advance(id, entry, state)
+		}
+	}
+}
+
+// Retry sends again the messages without an ack for ackTimeout, and gives up on those sent maxSendAttempts times
+func (o *outbox) Retry(now time.Time) {
+	var due []outboxEntry
+
+	o.mu.Lock()
+	for _, id := range o.order {
+		entry := o.entries[id]
+		if entry.state != StatePending || now.Sub(entry.lastSent) < ackTimeout {
+			continue
+		}
+		if entry.attempts >= maxSendAttempts {
+			log.Printf("msg %s sem resposta do server depois de %d envios", shortId(id), entry.attempts)
+			o.advance(id, entry, StateFailed)
+			continue
+		}
+		entry.attempts++
+		entry.lastSent = now
+		due = append(due, *entry)
+	}
+	o.mu.Unlock()
+
+	// Written outside the lock, the listener may need it to apply an ack meanwhile
+	for _, entry := range due {
+		log.Printf("msg %s sem resposta do server, a enviar de novo (%d/%d)", shortId(entry.msg.Id), entry.attempts, maxSendAttempts)
+		if err := o.resend(entry.msg, entry.content); err != nil {
+			log.Printf("erro ao enviar de novo a msg %s: %s", shortId(entry.msg.Id), err.Error())
+		}
+	}
+}
+
+// RunRetries calls Retry until stop is closed
+func (o *outbox) RunRetries(stop <-chan struct{}) {
+	ticker := time.NewTicker(ackTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			o.Retry(now)
+		}
+	}
+}
+
+// Unsettled counts the messages still waiting for the ack of the server, or for the receipts of their target
+// (a broadcast has none, and a message kept by the server waits for a target that is not connected)
+func (o *outbox) Unsettled() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	unsettled := 0
+	for _, entry := range o.entries {
+		direct := entry.msg.Target != msgpacktyps.BroadcastTarget
+		if entry.state == StatePending || (direct && (entry.state == StateSent || entry.state == StateDelivered)) {
+			unsettled++
+		}
+	}
+	return unsettled
+}
+
+// Summary shows the state of every message sent, in the order they were sent
+func (o *outbox) Summary() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.order) == 0 {
+		return
+	}
+	log.Println("Estado das mensagens enviadas:")
+	if o.forgotten > 0 {
+		log.Printf("(%d mensagens mais antigas esquecidas)", o.forgotten)
+	}
+	for _, id := range o.order {
+		logState(id, o.entries[id])
+	}
+}
+
+// prune forgets the oldest messages over maxOutboxHistory, never one still waiting for the ack of the server.
+// A late receipt for a forgotten message is ignored. o.mu must be held
+func (o *outbox) prune() {
+	excess := len(o.order) - maxOutboxHistory
+	if excess <= 0 {
+		return
+	}
+
+	kept := o.order[:0]
+	for _, id := range o.order {
+		if excess > 0 && o.entries[id].state != StatePending {
+			delete(o.entries, id)
+			o.forgotten++
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	clear(o.order[len(kept):])
+	o.order = kept
+}
+
+// advance moves the entry to state and shows it, o.mu must be held.
+// Only a pending message is sent again, the content of the others is not kept.
+func (o *outbox) advance(id string, entry *outboxEntry, state MessageState) {
+	entry.state = state
+	entry.content = nil
+	logState(id, entry)
+}
+
+func logState(id string, entry *outboxEntry) {
+	target := entry.msg.Target
+	if target == msgpacktyps.BroadcastTarget {
+		target = BroadcastArg
+	}
+	log.Printf("msg %s para %s %q: %s", shortId(id), target, entry.preview, entry.state)
+}
+
+// shortId is the start of a message id, enough to tell the messages of a conversation apart
+func shortId(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// messagePreview is the start of the text typed by the user, on one line
+func messagePreview(text []byte) string {
+	preview := []rune(strings.TrimSpace(string(text)))
+	if len(preview) > previewLength {
+		return string(preview[:previewLength]) + "..."
+	}
+	return string(preview)
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/framing"
+	"github.com/TP-TS-Go/internal/keyring"
+	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
+)
+
+// handshakeTimeout bounds the wait for the server's answer to Authenticate and to a new handshake
+const handshakeTimeout = 10 * time.Second
+
+// newOffer encodes the RequestId that starts the X25519 handshake, signed with the identity key. A new client
+// (empty clientId) registers the key with the id it gets, a known one asks for a new session under its id.
+func newOffer(kx *crypto.KeyExchange, clientId string, identity *crypto.IdentityKey) ([]byte, error) {
+	offer := msgpacktyps.KeyExchangeOffer{
+		PublicKey:   kx.PublicKey(),
+		Suites:      crypto.SuitesToBytes(crypto.PreferredSuites()),
+		ClientId:    clientId,
+		IdentityKey: identity.PublicKey(),
+		Created:     time.Now().UnixMilli(),
+	}
+	offer.Signature = identity.Sign(offer.SignedPayload())
+
+	content, err := msgpack.Marshal(&offer)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao encodificar o pedido de handshake: %s", err.Error())
+	}
+
+	msg := msgpacktyps.NewMessage(msgpacktyps.RequestId, clientId, "0", content...)
+	data, err := msgpack.Marshal(&msg)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao encodificar mensagem: %s", err.Error())
+	}
+	return data, nil
+}
+
+// readMessage reads the next message from the server on the calling goroutine, before the listener takes over the connection
+func (ch *ComHandler) readMessage(timeout time.Duration) (msgpacktyps.Message, error) {
+	ch.connection.SetReadDeadline(time.Now().Add(timeout))
+	defer ch.connection.SetReadDeadline(time.Time{})
+
+	var msg msgpacktyps.Message
+	frame, err := ch.frames.ReadFrame()
+	if err != nil {
+		return msg, fmt.Errorf("sem resposta do server: %s", err.Error())
+	}
+	if err := msgpack.Unmarshal(frame, &msg); err != nil {
+		return msg, fmt.Errorf("mensagem mal formada do server: %s", err.Error())
+	}
+	return msg, nil
+}
+
+// rekey runs the handshake again under the client's id, when the server lost its session (it restarted).
+// The new secret replaces the old one in the keyring, and the numbering of the new session starts over.
+func rekey(ch *ComHandler, config *Config, ring *keyring.Keyring, identity *crypto.IdentityKey) (*crypto.Session, *sequenceStore, error) {
+	kx, err := crypto.NewKeyExchange()
+	if err != nil {
+		return nil, nil, fmt.Errorf("erro ao gerar chave efemera: %s", err.Error())
+	}
+
+	data, err := newOffer(kx, config.ClientId, identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := framing.WriteFrame(ch.connection, data); err != nil {
+		return nil, nil, fmt.Errorf("erro ao escrever na conexao: %s", err.Error())
+	}
+
+	msg, err := ch.readMessage(handshakeTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg.Type != msgpacktyps.RequestIdResponse {
+		return nil, nil, fmt.Errorf("resposta inesperada ao handshake: tipo %d", msg.Type)
+	}
+
+	var reply msgpacktyps.KeyExchangeReply
+	if err := msgpack.Unmarshal(msg.Content, &reply); err != nil {
+		return nil, nil, fmt.Errorf("erro ao descodificar a resposta do handshake: %s", err.Error())
+	}
+	if reply.ClientId != config.ClientId {
+		return nil, nil, fmt.Errorf("o server deu outro id: %s", reply.ClientId)
+	}
+
+	secret, err := kx.DeriveSecret(reply.PublicKey, []byte(msgpacktyps.HandshakeInfo+reply.ClientId))
+	if err != nil {
+		return nil, nil, fmt.Errorf("erro ao derivar o secret: %s", err.Error())
+	}
+	defer secret.Destroy()
+
+	session, err := crypto.NewSession(crypto.CipherSuiteID(reply.Suite), secret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("erro ao preparar a sessao: %s", err.Error())
+	}
+	if err := session.SetPadding(crypto.PaddingPolicy(reply.Padding)); err != nil {
+		return nil, nil, fmt.Errorf("o server escolheu um padding invalido: %s", err.Error())
+	}
+
+	if err := ring.Set(keyring.KindSecret, config.ServerAddress, secret); err != nil {
+		return nil, nil, fmt.Errorf("erro ao guardar o secret: %s", err.Error())
+	}
+	config.Suite = reply.Suite
+	config.Padding = reply.Padding
+	config.Sequence = 0
+	config.Received = 0
+	if err := saveConfig(*config); err != nil {
+		return nil, nil, err
+	}
+
+	return session, newSequenceStore(*config), nil
+}
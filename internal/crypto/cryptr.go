@@ -2,64 +2,128 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
-	"time"
 )
 
-// Encrypt encrypts content using AES-GCM with the provided secret.
+// Encrypt encrypts content using AES-GCM with the provided secret, see EncryptWithSuite for the other algorithms.
 // It ensures that a unique nonce is created for each encryption, adding randomness to the output.
+// The output is a self describing envelope (see envelope.go) tagged with the secret's key ID.
 func Encrypt(content, secret []byte) ([]byte, error) {
-	// Validate secret size for AES (must be 16, 24, or 32 bytes)
-	if len(secret) != 16 && len(secret) != 24 && len(secret) != 32 {
-		return nil, fmt.Errorf("invalid secret size: %d bytes; must be 16, 24, or 32 bytes", len(secret))
+	return EncryptWithAD(content, secret, nil)
+}
+
+// EncryptWithAD encrypts content like Encrypt and binds it to ad (associated data), ad is authenticated but not encrypted
+// nor included in the output. The same ad must be given to DecryptWithAD, usually it is rebuilt from message metadata.
+func EncryptWithAD(content, secret, ad []byte) ([]byte, error) {
+	return EncryptWithOptions(content, secret, ad, EnvelopeOptions{KeyID: KeyIDFor(secret)})
+}
+
+// EncryptWithSuite encrypts content like EncryptWithAD, sealed by the given cipher suite.
+func EncryptWithSuite(suite CipherSuiteID, content, secret, ad []byte) ([]byte, error) {
+	return EncryptWithOptions(content, secret, ad, EnvelopeOptions{Suite: suite, KeyID: KeyIDFor(secret)})
+}
+
+// EncryptWithOptions encrypts content like EncryptWithAD, with the envelope suite, key ID and flags chosen by the caller.
+func EncryptWithOptions(content, secret, ad []byte, opts EnvelopeOptions) ([]byte, error) {
+	if opts.Suite == 0 {
+		opts.Suite = SuiteAESGCM
 	}
 
-	// Create a new AES cipher block from the secret
-	block, err := aes.NewCipher(secret)
+	suite, err := SuiteByID(opts.Suite)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher block: %w", err)
+		return nil, err
 	}
 
-	// Create a new GCM (Galois/Counter Mode) cipher, which provides encryption + integrity/authentication
-	gcm, err := cipher.NewGCM(block)
+	aead, err := suite.NewAEAD(secret)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		return nil, err
 	}
 
-	// Generate a 12-byte nonce (recommended size for AES-GCM)
-	nonce := make([]byte, 12)
+	header, err := marshalEnvelopeHeader(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err = Pad(content, opts.Padding)
+	if err != nil {
+		return nil, err
+	}
+
+	// Random nonce of the size the suite expects (12 bytes for AES-GCM)
+	nonce := make([]byte, aead.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
-	// Encrypt the content and append the nonce at the beginning
-	ciphertext := gcm.Seal(nonce, nonce, content, nil)
-	return ciphertext, nil
+	// The header is authenticated along with ad, so its fields can not be swapped
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, content, envelopeAD(header, ad)), nil
 }
 
-// Decrypt decrypts content using AES-GCM with the provided secret.
-// It extracts the nonce and uses it to decrypt the ciphertext.
+// Decrypt decrypts content using the provided secret.
+// Envelopes are dispatched on their version and cipher suite, bare nonce || ciphertext blobs
+// produced before the envelope existed are still accepted.
 func Decrypt(ciphertext, secret []byte) ([]byte, error) {
-	// Validate secret size for AES (must be 16, 24, or 32 bytes)
-	if len(secret) != 16 && len(secret) != 24 && len(secret) != 32 {
-		return nil, fmt.Errorf("invalid secret size: %d bytes; must be 16, 24, or 32 bytes", len(secret))
+	return DecryptWithAD(ciphertext, secret, nil)
+}
+
+// DecryptWithAD decrypts content sealed by EncryptWithAD, it fails if ad differs from the one used to encrypt.
+// Legacy blobs carry no associated data, they are only accepted when ad is empty.
+func DecryptWithAD(ciphertext, secret, ad []byte) ([]byte, error) {
+	return DecryptWithLookup(ciphertext, ad, func(keyID []byte) ([]byte, error) {
+		if len(keyID) != 0 && !bytes.Equal(keyID, KeyIDFor(secret)) {
+			return nil, fmt.Errorf("%w: %x", ErrUnknownKeyID, keyID)
+		}
+		return secret, nil
+	})
+}
+
+// DecryptWithLookup decrypts an envelope with the secret returned by lookup for the envelope's key ID,
+// which allows several keys to be live at once during a rotation.
+// Bare legacy blobs carry no key ID, lookup is then called with an empty ID.
+func DecryptWithLookup(ciphertext, ad []byte, lookup KeyLookup) ([]byte, error) {
+	env, err := ParseEnvelope(ciphertext)
+	if errors.Is(err, ErrNotEnvelope) && len(ad) == 0 {
+		return decryptLegacyWithLookup(ciphertext, lookup)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	// Create a new AES cipher block from the secret
-	block, err := aes.NewCipher(secret)
+	plaintext, err := env.open(lookup, ad)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher block: %w", err)
+		// A legacy blob has a random nonce in front, it may begin with the magic bytes by chance
+		if len(ad) != 0 {
+			return nil, err
+		}
+		if legacy, legacyErr := decryptLegacyWithLookup(ciphertext, lookup); legacyErr == nil {
+			return legacy, nil
+		}
+		return nil, err
 	}
 
-	// Create a new GCM cipher for decryption
-	gcm, err := cipher.NewGCM(block)
+	return plaintext, nil
+}
+
+func decryptLegacyWithLookup(ciphertext []byte, lookup KeyLookup) ([]byte, error) {
+	secret, err := lookup(nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		return nil, err
+	}
+	return decryptLegacy(ciphertext, secret)
+}
+
+// decryptLegacy decrypts the original nonce || ciphertext format, AES-GCM without additional data.
+func decryptLegacy(ciphertext, secret []byte) ([]byte, error) {
+	gcm, err := newAESGCM(secret)
+	if err != nil {
+		return nil, err
 	}
 
 	// Ensure the ciphertext includes the nonce at the beginning
@@ -79,51 +143,26 @@ func Decrypt(ciphertext, secret []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-// singleByteHash generates a simple hash for index calculation using SHA-256.
-// This is a secure operation, providing a consistent way to derive indices.
-func singleByteHash(i byte) byte {
-	hash := sha256.New()
-	hash.Write([]byte{i})
-	// Return the first byte of the hash as the result
-	return hash.Sum(nil)[0]
-}
-
-// GenerateSecret creates a derived secret using the rawBytes and optionally a specific timestamp.
-// It ensures that the derived secret is exactly 32 bytes long by using portions of rawBytes.
-func GenerateSecret(rawBytes []byte, when ...time.Time) (secret []byte, generatedAt time.Time, err error) {
-	// Use the provided timestamp or the current time
-	if len(when) != 0 {
-		generatedAt = when[0]
-	} else {
-		generatedAt = time.Now()
+// newAESGCM validates the secret and builds the AES-GCM AEAD for it.
+func newAESGCM(secret []byte) (cipher.AEAD, error) {
+	// Validate secret size for AES (must be 16, 24, or 32 bytes)
+	if len(secret) != 16 && len(secret) != 24 && len(secret) != 32 {
+		return nil, fmt.Errorf("invalid secret size: %d bytes; must be 16, 24, or 32 bytes", len(secret))
 	}
 
-	// Ensure rawBytes is at least 32 bytes long
-	if len(rawBytes) < 32 {
-		return nil, generatedAt, fmt.Errorf("rawBytes must be at least 32 bytes long")
+	// Create a new AES cipher block from the secret
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher block: %w", err)
 	}
 
-	// Initialize the secret array with a capacity of 32 bytes
-	secret = make([]byte, 0, 32)
-
-	// Derive indices from the current minute and second using a hash
-	indexFromTheMinutes := int(singleByteHash(byte(generatedAt.Minute()))) % (len(rawBytes) - 16)
-	indexFromTheSeconds := int(singleByteHash(byte(generatedAt.Second()))) % (len(rawBytes) - 16)
-
-	// Append 16 bytes based on the derived minute and second indices
-	secret = append(secret, rawBytes[indexFromTheMinutes:indexFromTheMinutes+16]...)
-	secret = append(secret, rawBytes[indexFromTheSeconds:indexFromTheSeconds+16]...)
-
-	// Ensure the secret is exactly 32 bytes long
-	if len(secret) > 32 {
-		secret = secret[:32]
-	} else if len(secret) < 32 {
-		// Pad with zeros if the secret is too short
-		padding := make([]byte, 32-len(secret))
-		secret = append(secret, padding...)
+	// Create a new GCM (Galois/Counter Mode) cipher, which provides encryption + integrity/authentication
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
 	}
 
-	return secret, generatedAt, nil
+	return gcm, nil
 }
 
 // GenerateRawRandomBytes generates a large pool of random bytes for use in secret derivation.
@@ -0,0 +1,180 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Envelope layout, every field up to the nonce is authenticated as additional data, followed by the caller's own AD:
+//
+//	magic "TPX" | version (1) | suite (1) | flags (1) | key ID length (1) | key ID | nonce | ciphertext || tag
+var envelopeMagic = []byte("TPX")
+
+const (
+	// EnvelopeVersion is the envelope format written by Encrypt
+	EnvelopeVersion byte = 1
+	// MaxKeyIDSize is the largest key ID an envelope can carry
+	MaxKeyIDSize = 255
+	// envelopeFixedSize is the size of the header without the key ID
+	envelopeFixedSize = 7
+)
+
+// Envelope flags, unknown flags are rejected so new ones can change the meaning of the payload.
+const (
+	FlagNone byte = 0
+	// FlagPadded means the plaintext was padded with Pad before sealing, the reader strips it with Unpad
+	FlagPadded byte = 1 << 0
+)
+
+// knownFlags are the flags this version of the package knows how to handle.
+const knownFlags = FlagPadded
+
+var (
+	// ErrNotEnvelope is returned when the data does not start with the envelope magic bytes
+	ErrNotEnvelope = errors.New("not an envelope")
+	// ErrUnknownKeyID is returned when no secret is known for the envelope's key ID
+	ErrUnknownKeyID = errors.New("unknown key ID")
+)
+
+// KeyLookup returns the secret for an envelope key ID.
+type KeyLookup func(keyID []byte) ([]byte, error)
+
+// EnvelopeOptions are the caller chosen envelope fields.
+type EnvelopeOptions struct {
+	// Suite is the AEAD used to seal, defaults to SuiteAESGCM
+	Suite CipherSuiteID
+	// KeyID names the secret used, so the reader can pick it out of several live keys
+	KeyID []byte
+	Flags byte
+	// Padding hides the plaintext length in a size bucket, it sets FlagPadded
+	Padding PaddingPolicy
+}
+
+// Envelope is a parsed ciphertext envelope.
+type Envelope struct {
+	Version    byte
+	Suite      CipherSuiteID
+	Flags      byte
+	KeyID      []byte
+	Nonce      []byte
+	Ciphertext []byte
+	// header holds the raw authenticated header bytes
+	header []byte
+}
+
+// KeyIDFor returns the default key ID of a secret, a truncated SHA-256 that does not reveal the secret.
+func KeyIDFor(secret []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte("tp-ts-go key id"))
+	hash.Write(secret)
+	return hash.Sum(nil)[:8]
+}
+
+// marshalEnvelopeHeader writes the header fields that come before the nonce.
+func marshalEnvelopeHeader(opts EnvelopeOptions) ([]byte, error) {
+	if len(opts.KeyID) > MaxKeyIDSize {
+		return nil, fmt.Errorf("key ID too long: %d bytes; must be at most %d bytes", len(opts.KeyID), MaxKeyIDSize)
+	}
+	if opts.Flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("unknown envelope flags: %08b", opts.Flags)
+	}
+	if _, err := opts.Padding.PaddedSize(0); err != nil {
+		return nil, err
+	}
+
+	flags := opts.Flags
+	if opts.Padding != PaddingNone {
+		flags |= FlagPadded
+	}
+
+	header := make([]byte, 0, envelopeFixedSize+len(opts.KeyID))
+	header = append(header, envelopeMagic...)
+	header = append(header, EnvelopeVersion, byte(opts.Suite), flags, byte(len(opts.KeyID)))
+	header = append(header, opts.KeyID...)
+	return header, nil
+}
+
+// ParseEnvelope splits data into its envelope fields without decrypting it.
+func ParseEnvelope(data []byte) (*Envelope, error) {
+	if !bytes.HasPrefix(data, envelopeMagic) {
+		return nil, ErrNotEnvelope
+	}
+	if len(data) < envelopeFixedSize {
+		return nil, fmt.Errorf("envelope too short")
+	}
+
+	env := &Envelope{
+		Version: data[3],
+		Suite:   CipherSuiteID(data[4]),
+		Flags:   data[5],
+	}
+
+	if env.Version != EnvelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version: %d", env.Version)
+	}
+	if env.Flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("unknown envelope flags: %08b", env.Flags)
+	}
+
+	headerSize := envelopeFixedSize + int(data[6])
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("envelope too short")
+	}
+	env.KeyID = data[envelopeFixedSize:headerSize]
+	env.header = data[:headerSize]
+
+	suite, err := SuiteByID(env.Suite)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := suite.NonceSize()
+	if len(data) < headerSize+nonceSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	env.Nonce = data[headerSize : headerSize+nonceSize]
+	env.Ciphertext = data[headerSize+nonceSize:]
+
+	return env, nil
+}
+
+// open decrypts the envelope with the secret returned by lookup for its key ID.
+func (env *Envelope) open(lookup KeyLookup, ad []byte) ([]byte, error) {
+	secret, err := lookup(env.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	suite, err := SuiteByID(env.Suite)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := suite.NewAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, env.Nonce, env.Ciphertext, envelopeAD(env.header, ad))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return env.unpad(plaintext)
+}
+
+// unpad strips the padding of a plaintext opened from a padded envelope.
+func (env *Envelope) unpad(plaintext []byte) ([]byte, error) {
+	if env.Flags&FlagPadded == 0 {
+		return plaintext, nil
+	}
+	return Unpad(plaintext)
+}
+
+// envelopeAD joins the envelope header and the caller's associated data, the header length is
+// encoded in the header itself so the concatenation is unambiguous.
+func envelopeAD(header, ad []byte) []byte {
+	out := make([]byte, 0, len(header)+len(ad))
+	out = append(out, header...)
+	return append(out, ad...)
+}
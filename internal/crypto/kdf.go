@@ -0,0 +1,120 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// KDFVersion identifies the key derivation scheme used by GenerateSecret.
+// It is part of the derivation inputs so both sides of a conversation always run the same scheme.
+type KDFVersion byte
+
+const (
+	// KDFUnset is the zero value, it is rejected so a caller that forgets the version gets an error, not a scheme
+	KDFUnset KDFVersion = 0
+	// KDFHKDFSHA256 expands the raw bytes with HKDF-SHA256, bound to the salt, info label and key epoch.
+	KDFHKDFSHA256 KDFVersion = 1
+	// KDFLegacyTimeWindow is the original scheme, it slices two 16 byte windows out of the raw bytes
+	// picked by the minute and second of SecretParams.When. It must be asked for by name.
+	// Deprecated: only 3600 keys per raw material, kept to read data produced by it.
+	KDFLegacyTimeWindow KDFVersion = 0xff
+)
+
+// DefaultSecretSize is the size of a derived secret when SecretParams.Size is not set (AES-256).
+const DefaultSecretSize = 32
+
+// SecretParams are the explicit inputs of a key derivation, nothing is read from the environment or the clock,
+// so two callers with the same raw bytes and params always derive the same secret.
+type SecretParams struct {
+	Version KDFVersion
+	// Salt should be random or unique per raw material, it may be empty
+	Salt []byte
+	// Info is the context label, different labels yield independent secrets from the same raw bytes
+	Info []byte
+	// Epoch is the key rotation counter, bumping it derives a fresh secret from the same raw bytes
+	Epoch uint64
+	// Size is the length of the derived secret, defaults to DefaultSecretSize
+	Size int
+	// When is only used by KDFLegacyTimeWindow and must be set explicitly
+	When time.Time
+}
+
+// GenerateSecret derives a secret from rawBytes according to params.Version.
+func GenerateSecret(rawBytes []byte, params SecretParams) ([]byte, error) {
+	if params.Size == 0 {
+		params.Size = DefaultSecretSize
+	}
+
+	switch params.Version {
+	case KDFHKDFSHA256:
+		return generateSecretHKDF(rawBytes, params)
+	case KDFLegacyTimeWindow:
+		if params.When.IsZero() {
+			return nil, fmt.Errorf("legacy key derivation needs an explicit timestamp")
+		}
+		if params.Size != 32 {
+			return nil, fmt.Errorf("legacy key derivation only produces 32 byte secrets")
+		}
+		return generateSecretLegacy(rawBytes, params.When)
+	case KDFUnset:
+		return nil, fmt.Errorf("key derivation version not set")
+	default:
+		return nil, fmt.Errorf("unknown key derivation version: %d", params.Version)
+	}
+}
+
+// generateSecretHKDF runs HKDF-SHA256 over rawBytes, the epoch is appended to the info label
+// as a big endian uint64 so it is bound to the output like the rest of the context.
+func generateSecretHKDF(rawBytes []byte, params SecretParams) ([]byte, error) {
+	// Ensure rawBytes carries enough entropy for a 256 bit key
+	if len(rawBytes) < 32 {
+		return nil, fmt.Errorf("rawBytes must be at least 32 bytes long")
+	}
+
+	info := make([]byte, 0, len(params.Info)+8)
+	info = append(info, params.Info...)
+	info = binary.BigEndian.AppendUint64(info, params.Epoch)
+
+	secret := make([]byte, params.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, rawBytes, params.Salt, info), secret); err != nil {
+		return nil, fmt.Errorf("failed to derive secret: %w", err)
+	}
+
+	return secret, nil
+}
+
+// singleByteHash generates a simple hash for index calculation using SHA-256.
+// This is a secure operation, providing a consistent way to derive indices.
+func singleByteHash(i byte) byte {
+	hash := sha256.New()
+	hash.Write([]byte{i})
+	// Return the first byte of the hash as the result
+	return hash.Sum(nil)[0]
+}
+
+// generateSecretLegacy creates a derived secret using the rawBytes and a specific timestamp.
+// It ensures that the derived secret is exactly 32 bytes long by using portions of rawBytes.
+func generateSecretLegacy(rawBytes []byte, when time.Time) ([]byte, error) {
+	// Ensure rawBytes is at least 32 bytes long
+	if len(rawBytes) < 32 {
+		return nil, fmt.Errorf("rawBytes must be at least 32 bytes long")
+	}
+
+	// Initialize the secret array with a capacity of 32 bytes
+	secret := make([]byte, 0, 32)
+
+	// Derive indices from the minute and second using a hash
+	indexFromTheMinutes := int(singleByteHash(byte(when.Minute()))) % (len(rawBytes) - 16)
+	indexFromTheSeconds := int(singleByteHash(byte(when.Second()))) % (len(rawBytes) - 16)
+
+	// Append 16 bytes based on the derived minute and second indices
+	secret = append(secret, rawBytes[indexFromTheMinutes:indexFromTheMinutes+16]...)
+	secret = append(secret, rawBytes[indexFromTheSeconds:indexFromTheSeconds+16]...)
+
+	return secret, nil
+}
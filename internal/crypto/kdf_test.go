@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestGenerateSecretNeedsVersion(t *testing.T) {
+	raw := bytes.Repeat([]byte{7}, 64)
+
+	// Not even a timestamp picks the legacy scheme, it has to be named
+	for _, params := range []SecretParams{{}, {When: time.Now()}, {Info: []byte("info"), Epoch: 1}} {
+		if _, err := GenerateSecret(raw, params); err == nil {
+			t.Fatalf("secret derived without a version: %+v", params)
+		}
+	}
+
+	if _, err := GenerateSecret(raw, SecretParams{Version: KDFLegacyTimeWindow, When: time.Now()}); err != nil {
+		t.Fatalf("legacy scheme: %v", err)
+	}
+	if _, err := GenerateSecret(raw, SecretParams{Version: 7}); err == nil {
+		t.Fatal("secret derived with an unknown version")
+	}
+}
+
+func TestGenerateSecretHKDF(t *testing.T) {
+	raw := bytes.Repeat([]byte{7}, 32)
+	params := SecretParams{Version: KDFHKDFSHA256, Salt: []byte("salt"), Info: []byte("info")}
+
+	first, err := GenerateSecret(raw, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := GenerateSecret(raw, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != DefaultSecretSize || !bytes.Equal(first, again) {
+		t.Fatalf("derivation is not deterministic: %x %x", first, again)
+	}
+
+	// Every input is bound to the output
+	for name, changed := range map[string]SecretParams{
+		"salt":  {Version: KDFHKDFSHA256, Salt: []byte("other"), Info: []byte("info")},
+		"info":  {Version: KDFHKDFSHA256, Salt: []byte("salt"), Info: []byte("other")},
+		"epoch": {Version: KDFHKDFSHA256, Salt: []byte("salt"), Info: []byte("info"), Epoch: 1},
+	} {
+		other, err := GenerateSecret(raw, changed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(first, other) {
+			t.Errorf("changing the %s gives the same secret", name)
+		}
+	}
+
+	if _, err := GenerateSecret(raw[:31], params); err == nil {
+		t.Fatal("secret derived from 31 raw bytes")
+	}
+}
@@ -0,0 +1,73 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// KeyExchangePublicKeySize is the size, in bytes, of an X25519 public key as sent over the wire.
+const KeyExchangePublicKeySize = 32
+
+// KeyExchange holds one side of an ephemeral X25519 (ECDH) handshake.
+// Each handshake must use a fresh KeyExchange, the private half never leaves the process.
+type KeyExchange struct {
+	private *ecdh.PrivateKey
+}
+
+// NewKeyExchange generates a fresh ephemeral X25519 key pair.
+func NewKeyExchange() (*KeyExchange, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate X25519 key: %w", err)
+	}
+
+	return &KeyExchange{private: private}, nil
+}
+
+// PublicKey returns the public half of the key pair, to be sent to the peer.
+func (kx *KeyExchange) PublicKey() []byte {
+	return kx.private.PublicKey().Bytes()
+}
+
+// DeriveSecret runs X25519 against the peer's public key and expands the shared point with GenerateSecret
+// (KDFHKDFSHA256) into a 32 byte session secret. Both public keys are used as the HKDF salt, in a fixed order,
+// so both sides derive the same secret no matter who initiated the handshake.
+// The info parameter binds the secret to its context (protocol name, client id, ...).
+func (kx *KeyExchange) DeriveSecret(peerPublic []byte, info []byte) (SecretBytes, error) {
+	if len(peerPublic) != KeyExchangePublicKeySize {
+		return nil, fmt.Errorf("invalid peer public key size: %d bytes; must be %d bytes", len(peerPublic), KeyExchangePublicKeySize)
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer public key: %w", err)
+	}
+
+	// Fails on low order points, which would otherwise yield an all zero shared secret
+	shared, err := kx.private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	defer clear(shared)
+
+	return GenerateSecret(shared, SecretParams{
+		Version: KDFHKDFSHA256,
+		Salt:    handshakeSalt(kx.PublicKey(), peerPublic),
+		Info:    info,
+	})
+}
+
+// handshakeSalt hashes both public keys, smallest first, into the salt used by DeriveSecret.
+func handshakeSalt(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+
+	hash := sha256.New()
+	hash.Write(a)
+	hash.Write(b)
+	return hash.Sum(nil)
+}
@@ -0,0 +1,117 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// PaddingPolicy picks the padded length of a plaintext, so the ciphertext length only reveals a size bucket.
+type PaddingPolicy byte
+
+const (
+	// PaddingNone leaves the length as is
+	PaddingNone PaddingPolicy = 0
+	// PaddingPowerOfTwo rounds up to the next power of two, at least MinPaddedSize: few buckets, up to 100% overhead
+	PaddingPowerOfTwo PaddingPolicy = 1
+	// PaddingPadme rounds up with PADMÉ (Nikitin et al., "Reducing Metadata Leakage from Encrypted Files and
+	// Communication with PURBs"): at most 12% overhead, leaking O(log log n) bits of the length
+	PaddingPadme PaddingPolicy = 2
+)
+
+// MinPaddedSize is the smallest padded length, so short answers ("yes", "no", ...) all look the same.
+const MinPaddedSize = 32
+
+// Padding is ISO/IEC 7816-4 style: the plaintext, a 0x80 marker, then zeros up to the padded length.
+const paddingMarker = 0x80
+
+// ErrInvalidPadding is returned when padded data does not end with the marker and zeros.
+var ErrInvalidPadding = errors.New("invalid padding")
+
+// ParsePaddingPolicy maps "none", "pow2" or "padme" to its policy.
+func ParsePaddingPolicy(name string) (PaddingPolicy, error) {
+	switch name {
+	case "", "none":
+		return PaddingNone, nil
+	case "pow2":
+		return PaddingPowerOfTwo, nil
+	case "padme":
+		return PaddingPadme, nil
+	default:
+		return PaddingNone, fmt.Errorf("unknown padding policy %q, expected none, pow2 or padme", name)
+	}
+}
+
+// String returns the name accepted by ParsePaddingPolicy.
+func (p PaddingPolicy) String() string {
+	switch p {
+	case PaddingNone:
+		return "none"
+	case PaddingPowerOfTwo:
+		return "pow2"
+	case PaddingPadme:
+		return "padme"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(p))
+	}
+}
+
+// PaddedSize returns the length a plaintext of size bytes is padded to, marker included.
+func (p PaddingPolicy) PaddedSize(size uint64) (uint64, error) {
+	// Room for the marker
+	n := size + 1
+
+	switch p {
+	case PaddingNone:
+		return size, nil
+	case PaddingPowerOfTwo:
+		if n <= MinPaddedSize {
+			return MinPaddedSize, nil
+		}
+		if n > 1<<63 {
+			return 0, fmt.Errorf("plaintext too long to pad")
+		}
+		return 1 << bits.Len64(n-1), nil
+	case PaddingPadme:
+		if n <= MinPaddedSize {
+			return MinPaddedSize, nil
+		}
+		// Keep the top floor(log2 E)+1 bits of the length, where E = floor(log2 n), and round up the rest
+		e := uint64(bits.Len64(n) - 1)
+		s := uint64(bits.Len64(e))
+		mask := uint64(1)<<(e-s) - 1
+		if n > ^uint64(0)-mask {
+			return 0, fmt.Errorf("plaintext too long to pad")
+		}
+		return (n + mask) &^ mask, nil
+	default:
+		return 0, fmt.Errorf("unknown padding policy: %d", p)
+	}
+}
+
+// Pad appends the marker and the zeros that bring content to the policy's padded size.
+func Pad(content []byte, policy PaddingPolicy) ([]byte, error) {
+	if policy == PaddingNone {
+		return content, nil
+	}
+
+	size, err := policy.PaddedSize(uint64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+
+	padded := make([]byte, size)
+	copy(padded, content)
+	padded[len(content)] = paddingMarker
+	return padded, nil
+}
+
+// Unpad strips the padding added by Pad, whatever the policy was.
+func Unpad(padded []byte) ([]byte, error) {
+	i := len(bytes.TrimRight(padded, "\x00")) - 1
+	if i < 0 || padded[i] != paddingMarker {
+		return nil, ErrInvalidPadding
+	}
+	return padded[:i], nil
+}
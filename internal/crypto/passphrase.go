@@ -0,0 +1,258 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PassphraseKDF identifies the password hashing function that turns a passphrase into a key.
+type PassphraseKDF byte
+
+const (
+	// KDFArgon2id is the default, memory hard and resistant to GPU and side channel attacks
+	KDFArgon2id PassphraseKDF = 1
+	// KDFScrypt is the fallback, for machines where Argon2id can not get the memory it needs
+	KDFScrypt PassphraseKDF = 2
+)
+
+// Default costs, about a second on a laptop. Argon2id follows the RFC 9106 second recommendation.
+const (
+	DefaultArgon2Time    = 3
+	DefaultArgon2Memory  = 64 * 1024 // KiB
+	DefaultArgon2Threads = 4
+	DefaultScryptLogN    = 16
+	DefaultScryptR       = 8
+	DefaultScryptP       = 1
+)
+
+// Upper bounds accepted when reading parameters from a file, so a crafted header can not make
+// the reader burn unbounded memory or time before the passphrase is even checked.
+const (
+	maxArgon2Time    = 64
+	maxArgon2Memory  = 4 * 1024 * 1024 // KiB
+	maxArgon2Threads = 64
+	maxScryptLogN    = 24
+	maxScryptR       = 32
+	maxScryptP       = 16
+)
+
+const (
+	passphraseSaltSize = 16
+	passphraseKeySize  = 32
+	// passphraseParamsSize is kdf (1) | salt (16) | cost (4) | cost (4) | cost (1)
+	passphraseParamsSize = 1 + passphraseSaltSize + 4 + 4 + 1
+)
+
+// Passphrase header layout, written in front of a stream so decryption only needs the passphrase:
+//
+//	magic "TPP" | version (1) | kdf (1) | salt (16) | cost fields (9)
+//
+// Argon2id stores time (4) | memory in KiB (4) | threads (1), scrypt stores r (4) | p (4) | log2 N (1).
+var passphraseMagic = []byte("TPP")
+
+// PassphraseHeaderVersion is the passphrase header format written by WritePassphraseHeader
+const PassphraseHeaderVersion byte = 1
+
+// ErrNotPassphraseHeader is returned when the data does not start with the passphrase header magic bytes
+var ErrNotPassphraseHeader = errors.New("not a passphrase header")
+
+// PassphraseParams are the KDF, salt and costs used to derive a key from a passphrase.
+// Only the fields of the chosen KDF are used.
+type PassphraseParams struct {
+	KDF  PassphraseKDF
+	Salt []byte
+	// Argon2id costs
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	// scrypt costs, N = 2^LogN
+	LogN uint8
+	R    uint32
+	P    uint32
+}
+
+// NewPassphraseParams returns the default costs of the KDF with a fresh random salt.
+func NewPassphraseParams(kdf PassphraseKDF) (PassphraseParams, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return PassphraseParams{}, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	params := PassphraseParams{KDF: kdf, Salt: salt}
+	switch kdf {
+	case KDFArgon2id:
+		params.Time, params.Memory, params.Threads = DefaultArgon2Time, DefaultArgon2Memory, DefaultArgon2Threads
+	case KDFScrypt:
+		params.LogN, params.R, params.P = DefaultScryptLogN, DefaultScryptR, DefaultScryptP
+	default:
+		return PassphraseParams{}, fmt.Errorf("unknown passphrase KDF: %d", kdf)
+	}
+
+	return params, nil
+}
+
+// Validate checks that the costs are usable and within the bounds a reader accepts.
+func (p PassphraseParams) Validate() error {
+	if len(p.Salt) != passphraseSaltSize {
+		return fmt.Errorf("invalid salt size: %d bytes; must be %d bytes", len(p.Salt), passphraseSaltSize)
+	}
+
+	switch p.KDF {
+	case KDFArgon2id:
+		if p.Time < 1 || p.Time > maxArgon2Time {
+			return fmt.Errorf("argon2id time must be between 1 and %d", maxArgon2Time)
+		}
+		if p.Threads < 1 || p.Threads > maxArgon2Threads {
+			return fmt.Errorf("argon2id threads must be between 1 and %d", maxArgon2Threads)
+		}
+		if p.Memory < 8*uint32(p.Threads) || p.Memory > maxArgon2Memory {
+			return fmt.Errorf("argon2id memory must be between %d and %d KiB", 8*uint32(p.Threads), maxArgon2Memory)
+		}
+	case KDFScrypt:
+		if p.LogN < 10 || p.LogN > maxScryptLogN {
+			return fmt.Errorf("scrypt log2 N must be between 10 and %d", maxScryptLogN)
+		}
+		if p.R < 1 || p.R > maxScryptR {
+			return fmt.Errorf("scrypt r must be between 1 and %d", maxScryptR)
+		}
+		if p.P < 1 || p.P > maxScryptP {
+			return fmt.Errorf("scrypt p must be between 1 and %d", maxScryptP)
+		}
+	default:
+		return fmt.Errorf("unknown passphrase KDF: %d", p.KDF)
+	}
+
+	return nil
+}
+
+// DeriveKeyFromPassphrase stretches the passphrase into a 32 byte key with the KDF and costs of params.
+func DeriveKeyFromPassphrase(passphrase []byte, params PassphraseParams) (SecretBytes, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch params.KDF {
+	case KDFArgon2id:
+		return argon2.IDKey(passphrase, params.Salt, params.Time, params.Memory, params.Threads, passphraseKeySize), nil
+	case KDFScrypt:
+		key, err := scrypt.Key(passphrase, params.Salt, 1<<params.LogN, int(params.R), int(params.P), passphraseKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unknown passphrase KDF: %d", params.KDF)
+	}
+}
+
+// MarshalBinary encodes the parameters as stored in the passphrase header, without magic and version.
+func (p PassphraseParams) MarshalBinary() ([]byte, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, passphraseParamsSize)
+	out = append(out, byte(p.KDF))
+	out = append(out, p.Salt...)
+
+	switch p.KDF {
+	case KDFArgon2id:
+		out = binary.BigEndian.AppendUint32(out, p.Time)
+		out = binary.BigEndian.AppendUint32(out, p.Memory)
+		out = append(out, p.Threads)
+	case KDFScrypt:
+		out = binary.BigEndian.AppendUint32(out, p.R)
+		out = binary.BigEndian.AppendUint32(out, p.P)
+		out = append(out, p.LogN)
+	}
+
+	return out, nil
+}
+
+// UnmarshalBinary decodes parameters written by MarshalBinary and validates them.
+func (p *PassphraseParams) UnmarshalBinary(data []byte) error {
+	if len(data) != passphraseParamsSize {
+		return fmt.Errorf("invalid passphrase parameters size: %d bytes", len(data))
+	}
+
+	params := PassphraseParams{
+		KDF:  PassphraseKDF(data[0]),
+		Salt: bytes.Clone(data[1 : 1+passphraseSaltSize]),
+	}
+	costs := data[1+passphraseSaltSize:]
+
+	switch params.KDF {
+	case KDFArgon2id:
+		params.Time = binary.BigEndian.Uint32(costs[0:4])
+		params.Memory = binary.BigEndian.Uint32(costs[4:8])
+		params.Threads = costs[8]
+	case KDFScrypt:
+		params.R = binary.BigEndian.Uint32(costs[0:4])
+		params.P = binary.BigEndian.Uint32(costs[4:8])
+		params.LogN = costs[8]
+	}
+
+	if err := params.Validate(); err != nil {
+		return err
+	}
+
+	*p = params
+	return nil
+}
+
+// HasPassphraseMagic reports whether b starts with the magic bytes of a passphrase header.
+func HasPassphraseMagic(b []byte) bool {
+	return bytes.HasPrefix(b, passphraseMagic)
+}
+
+// WritePassphraseHeader writes the passphrase header holding params to w.
+func WritePassphraseHeader(w io.Writer, params PassphraseParams) error {
+	encoded, err := params.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, len(passphraseMagic)+1+len(encoded))
+	header = append(header, passphraseMagic...)
+	header = append(header, PassphraseHeaderVersion)
+	header = append(header, encoded...)
+
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write passphrase header: %w", err)
+	}
+	return nil
+}
+
+// ReadPassphraseHeader reads the header written by WritePassphraseHeader from r, leaving r at the data that follows.
+func ReadPassphraseHeader(r io.Reader) (PassphraseParams, error) {
+	header := make([]byte, len(passphraseMagic)+1+passphraseParamsSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return PassphraseParams{}, ErrNotPassphraseHeader
+		}
+		return PassphraseParams{}, fmt.Errorf("failed to read passphrase header: %w", err)
+	}
+	if !HasPassphraseMagic(header) {
+		return PassphraseParams{}, ErrNotPassphraseHeader
+	}
+	if version := header[len(passphraseMagic)]; version != PassphraseHeaderVersion {
+		return PassphraseParams{}, fmt.Errorf("unsupported passphrase header version: %d", version)
+	}
+
+	var params PassphraseParams
+	if err := params.UnmarshalBinary(header[len(passphraseMagic)+1:]); err != nil {
+		return PassphraseParams{}, err
+	}
+
+	return params, nil
+}
@@ -0,0 +1,438 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Double Ratchet (Perrin, Marlinspike), as described in the Signal specification:
+// every message is encrypted with its own key taken from a symmetric chain, and each time the conversation
+// changes direction both sides mix a fresh X25519 exchange into the root key. A leaked state then decrypts
+// neither past messages (forward secrecy) nor, once the peer ratchets again, future ones (post-compromise recovery).
+//
+// A ratchet message is header | ciphertext, the header is ratchet public key (32) | previous chain length (4) | message number (4).
+const (
+	// MaxRatchetSkip bounds how many message keys of a chain are derived ahead for messages still to arrive
+	MaxRatchetSkip = 1000
+	// maxSkippedKeys bounds the message keys kept for late messages, the oldest are dropped first
+	maxSkippedKeys = 2 * MaxRatchetSkip
+
+	ratchetHeaderSize = KeyExchangePublicKeySize + 4 + 4
+	ratchetKeySize    = 32
+	ratchetStateVer   = 1
+
+	ratchetRootInfo    = "tp-ts-go ratchet v1 root"
+	ratchetMessageInfo = "tp-ts-go ratchet v1 message"
+)
+
+var (
+	// ErrRatchetNotReady is returned when encrypting before the ratchet has a sending chain,
+	// the responder of a conversation can only send after the first message of the initiator
+	ErrRatchetNotReady = errors.New("ratchet can not send yet")
+	// ErrTooManySkipped is returned when a message claims more skipped messages than MaxRatchetSkip
+	ErrTooManySkipped = errors.New("too many skipped ratchet messages")
+)
+
+type skippedKey struct {
+	public [KeyExchangePublicKeySize]byte
+	n      uint32
+}
+
+// ratchetState is copied before decrypting, so a message that fails to authenticate leaves the ratchet untouched.
+type ratchetState struct {
+	rootKey   []byte
+	self      *ecdh.PrivateKey
+	remote    []byte
+	sendChain []byte
+	recvChain []byte
+	sendN     uint32
+	recvN     uint32
+	prevN     uint32
+}
+
+// Ratchet is one side of a Double Ratchet conversation. It is safe for concurrent use.
+type Ratchet struct {
+	mu    sync.Mutex
+	state ratchetState
+	// skipped keeps the keys of messages that have not arrived yet, in arrival order of their chains
+	skipped      map[skippedKey][]byte
+	skippedOrder []skippedKey
+}
+
+// NewRatchetInitiator starts the ratchet of the side that sends first. The secret comes from an authenticated
+// key exchange with the peer, whose public key from that exchange is used as its first ratchet key.
+func NewRatchetInitiator(secret []byte, peerPublic []byte) (*Ratchet, error) {
+	if len(secret) != ratchetKeySize {
+		return nil, fmt.Errorf("invalid ratchet secret size: %d bytes; must be %d bytes", len(secret), ratchetKeySize)
+	}
+
+	self, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate X25519 key: %w", err)
+	}
+
+	r := newRatchet(ratchetState{self: self, remote: bytes.Clone(peerPublic)})
+	r.state.rootKey, r.state.sendChain, err = ratchetRootStep(secret, self, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// NewRatchetResponder starts the ratchet of the side that answered the key exchange with kx,
+// it can send once the first message of the initiator was decrypted.
+func NewRatchetResponder(secret []byte, kx *KeyExchange) (*Ratchet, error) {
+	if len(secret) != ratchetKeySize {
+		return nil, fmt.Errorf("invalid ratchet secret size: %d bytes; must be %d bytes", len(secret), ratchetKeySize)
+	}
+
+	return newRatchet(ratchetState{rootKey: bytes.Clone(secret), self: kx.private}), nil
+}
+
+func newRatchet(state ratchetState) *Ratchet {
+	return &Ratchet{state: state, skipped: make(map[skippedKey][]byte)}
+}
+
+// CanSend reports whether Encrypt can be used, see ErrRatchetNotReady.
+func (r *Ratchet) CanSend() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state.sendChain != nil
+}
+
+// Encrypt seals plaintext with the next message key of the sending chain.
+// The associated data is authenticated along with the ratchet header.
+func (r *Ratchet) Encrypt(plaintext, ad []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state.sendChain == nil {
+		return nil, ErrRatchetNotReady
+	}
+	if r.state.sendN == ^uint32(0) {
+		return nil, fmt.Errorf("ratchet sending chain exhausted")
+	}
+
+	var messageKey []byte
+	r.state.sendChain, messageKey = ratchetChainStep(r.state.sendChain)
+
+	header := make([]byte, 0, ratchetHeaderSize)
+	header = append(header, r.state.self.PublicKey().Bytes()...)
+	header = binary.BigEndian.AppendUint32(header, r.state.prevN)
+	header = binary.BigEndian.AppendUint32(header, r.state.sendN)
+	r.state.sendN++
+
+	return sealWithMessageKey(messageKey, ratchetMessageInfo, header, plaintext, ad)
+}
+
+// Decrypt opens a message made by the peer's Encrypt, messages may arrive out of order.
+func (r *Ratchet) Decrypt(message, ad []byte) ([]byte, error) {
+	if len(message) < ratchetHeaderSize {
+		return nil, fmt.Errorf("ratchet message too short")
+	}
+
+	header := message[:ratchetHeaderSize]
+	var key skippedKey
+	copy(key.public[:], header)
+	prevN := binary.BigEndian.Uint32(header[KeyExchangePublicKeySize:])
+	key.n = binary.BigEndian.Uint32(header[KeyExchangePublicKeySize+4:])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A late message of a chain we already moved past
+	if messageKey, ok := r.skipped[key]; ok {
+		plaintext, err := openWithMessageKey(messageKey, ratchetMessageInfo, ratchetHeaderSize, message, ad)
+		if err != nil {
+			return nil, err
+		}
+		r.dropSkipped(key)
+		return plaintext, nil
+	}
+
+	state := r.state
+	newSkipped := make(map[skippedKey][]byte)
+	var newOrder []skippedKey
+
+	if !bytes.Equal(key.public[:], state.remote) {
+		if err := state.skipUntil(prevN, newSkipped, &newOrder); err != nil {
+			return nil, err
+		}
+		if err := state.dhStep(key.public[:]); err != nil {
+			return nil, err
+		}
+	}
+	if err := state.skipUntil(key.n, newSkipped, &newOrder); err != nil {
+		return nil, err
+	}
+
+	var messageKey []byte
+	state.recvChain, messageKey = ratchetChainStep(state.recvChain)
+	state.recvN++
+
+	plaintext, err := openWithMessageKey(messageKey, ratchetMessageInfo, ratchetHeaderSize, message, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	// Authenticated, the new state can replace the old one
+	r.state = state
+	for _, k := range newOrder {
+		r.skipped[k] = newSkipped[k]
+		r.skippedOrder = append(r.skippedOrder, k)
+	}
+	for len(r.skippedOrder) > maxSkippedKeys {
+		delete(r.skipped, r.skippedOrder[0])
+		r.skippedOrder = r.skippedOrder[1:]
+	}
+
+	return plaintext, nil
+}
+
+func (r *Ratchet) dropSkipped(key skippedKey) {
+	delete(r.skipped, key)
+	for i, k := range r.skippedOrder {
+		if k == key {
+			r.skippedOrder = append(r.skippedOrder[:i], r.skippedOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// skipUntil stores the keys of the receiving chain up to message number until, for messages that arrive later.
+func (st *ratchetState) skipUntil(until uint32, skipped map[skippedKey][]byte, order *[]skippedKey) error {
+	if st.recvChain == nil {
+		return nil
+	}
+	if until > st.recvN && until-st.recvN > MaxRatchetSkip {
+		return ErrTooManySkipped
+	}
+
+	var key skippedKey
+	copy(key.public[:], st.remote)
+	for st.recvN < until {
+		var messageKey []byte
+		st.recvChain, messageKey = ratchetChainStep(st.recvChain)
+		key.n = st.recvN
+		skipped[key] = messageKey
+		*order = append(*order, key)
+		st.recvN++
+	}
+
+	return nil
+}
+
+// dhStep answers a new ratchet key of the peer: one root step for the receiving chain, and one with a fresh key of ours for the sending chain.
+func (st *ratchetState) dhStep(remote []byte) error {
+	var err error
+
+	st.prevN = st.sendN
+	st.sendN, st.recvN = 0, 0
+	st.remote = bytes.Clone(remote)
+
+	st.rootKey, st.recvChain, err = ratchetRootStep(st.rootKey, st.self, st.remote)
+	if err != nil {
+		return err
+	}
+
+	st.self, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate X25519 key: %w", err)
+	}
+
+	st.rootKey, st.sendChain, err = ratchetRootStep(st.rootKey, st.self, st.remote)
+	return err
+}
+
+// ratchetRootStep mixes an X25519 exchange into the root key, returning the next root key and a new chain key.
+func ratchetRootStep(rootKey []byte, self *ecdh.PrivateKey, remote []byte) ([]byte, []byte, error) {
+	peer, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ratchet public key: %w", err)
+	}
+
+	shared, err := self.ECDH(peer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+
+	out, err := GenerateSecret(shared, SecretParams{
+		Version: KDFHKDFSHA256,
+		Salt:    rootKey,
+		Info:    []byte(ratchetRootInfo),
+		Size:    2 * ratchetKeySize,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return out[:ratchetKeySize], out[ratchetKeySize:], nil
+}
+
+// ratchetChainStep returns the next chain key and the message key of the current step.
+func ratchetChainStep(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	messageKey := mac.Sum(nil)
+
+	mac.Reset()
+	mac.Write([]byte{0x02})
+	return mac.Sum(nil), messageKey
+}
+
+// messageKeyAEAD expands a message key into an AES-256-GCM key and nonce, each message key is used once.
+// The info label keeps the keys of different constructions apart.
+func messageKeyAEAD(messageKey []byte, info string) (cipher.AEAD, []byte, error) {
+	out, err := GenerateSecret(messageKey, SecretParams{
+		Version: KDFHKDFSHA256,
+		Info:    []byte(info),
+		Size:    32 + 12,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newAESGCM(out[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, out[32:], nil
+}
+
+// sealWithMessageKey returns header | ciphertext, the header is authenticated after the associated data
+func sealWithMessageKey(messageKey []byte, info string, header, plaintext, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageKeyAEAD(messageKey, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(header, nonce, plaintext, append(bytes.Clone(ad), header...)), nil
+}
+
+// openWithMessageKey opens a message made by sealWithMessageKey with a header of headerSize bytes
+func openWithMessageKey(messageKey []byte, info string, headerSize int, message, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageKeyAEAD(messageKey, info)
+	if err != nil {
+		return nil, err
+	}
+
+	header := message[:headerSize]
+	plaintext, err := aead.Open(nil, nonce, message[headerSize:], append(bytes.Clone(ad), header...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message: %w", err)
+	}
+	return plaintext, nil
+}
+
+// MarshalBinary encodes the ratchet state, including private keys, so a conversation can go on after a restart.
+// The output is as sensitive as the keys themselves.
+func (r *Ratchet) MarshalBinary() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st := r.state
+	out := []byte{ratchetStateVer}
+	out = appendShortBytes(out, st.rootKey)
+	out = appendShortBytes(out, st.self.Bytes())
+	out = appendShortBytes(out, st.remote)
+	out = appendShortBytes(out, st.sendChain)
+	out = appendShortBytes(out, st.recvChain)
+	out = binary.BigEndian.AppendUint32(out, st.sendN)
+	out = binary.BigEndian.AppendUint32(out, st.recvN)
+	out = binary.BigEndian.AppendUint32(out, st.prevN)
+
+	out = binary.BigEndian.AppendUint16(out, uint16(len(r.skippedOrder)))
+	for _, k := range r.skippedOrder {
+		out = append(out, k.public[:]...)
+		out = binary.BigEndian.AppendUint32(out, k.n)
+		out = append(out, r.skipped[k]...)
+	}
+
+	return out, nil
+}
+
+// UnmarshalBinary restores a ratchet encoded by MarshalBinary.
+func (r *Ratchet) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 || data[0] != ratchetStateVer {
+		return fmt.Errorf("unsupported ratchet state version")
+	}
+	data = data[1:]
+
+	var fields [5][]byte
+	for i := range fields {
+		var ok bool
+		if fields[i], data, ok = readShortBytes(data); !ok {
+			return fmt.Errorf("truncated ratchet state")
+		}
+	}
+	if len(data) < 3*4+2 {
+		return fmt.Errorf("truncated ratchet state")
+	}
+
+	self, err := ecdh.X25519().NewPrivateKey(fields[1])
+	if err != nil {
+		return fmt.Errorf("invalid ratchet private key: %w", err)
+	}
+
+	state := ratchetState{
+		rootKey: fields[0],
+		self:    self,
+		sendN:   binary.BigEndian.Uint32(data[0:4]),
+		recvN:   binary.BigEndian.Uint32(data[4:8]),
+		prevN:   binary.BigEndian.Uint32(data[8:12]),
+	}
+	// Empty fields were nil before encoding
+	if len(fields[2]) > 0 {
+		state.remote = fields[2]
+	}
+	if len(fields[3]) > 0 {
+		state.sendChain = fields[3]
+	}
+	if len(fields[4]) > 0 {
+		state.recvChain = fields[4]
+	}
+
+	count := int(binary.BigEndian.Uint16(data[12:14]))
+	data = data[14:]
+	entrySize := KeyExchangePublicKeySize + 4 + ratchetKeySize
+	if len(data) != count*entrySize {
+		return fmt.Errorf("invalid ratchet skipped keys")
+	}
+
+	restored := newRatchet(state)
+	for i := 0; i < count; i++ {
+		entry := data[i*entrySize : (i+1)*entrySize]
+		var k skippedKey
+		copy(k.public[:], entry)
+		k.n = binary.BigEndian.Uint32(entry[KeyExchangePublicKeySize:])
+		restored.skipped[k] = bytes.Clone(entry[KeyExchangePublicKeySize+4:])
+		restored.skippedOrder = append(restored.skippedOrder, k)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state, r.skipped, r.skippedOrder = restored.state, restored.skipped, restored.skippedOrder
+	return nil
+}
+
+func appendShortBytes(out, b []byte) []byte {
+	out = append(out, byte(len(b)))
+	return append(out, b...)
+}
+
+func readShortBytes(data []byte) ([]byte, []byte, bool) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, nil, false
+	}
+	size := int(data[0])
+	return bytes.Clone(data[1 : 1+size]), data[1+size:], true
+}
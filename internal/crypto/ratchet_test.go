@@ -0,0 +1,273 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// newRatchetPair returns the initiator and responder of a conversation, as set up after the signed key exchange
+func newRatchetPair(t *testing.T) (*Ratchet, *Ratchet) {
+	t.Helper()
+
+	kx, err := NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := testKey()
+
+	alice, err := NewRatchetInitiator(secret, kx.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRatchetResponder(secret, kx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+func mustEncrypt(t *testing.T, r *Ratchet, plaintext string) []byte {
+	t.Helper()
+
+	message, err := r.Encrypt([]byte(plaintext), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func expectDecrypt(t *testing.T, r *Ratchet, message []byte, want string) {
+	t.Helper()
+
+	plaintext, err := r.Decrypt(message, []byte("ad"))
+	if err != nil {
+		t.Fatalf("decrypt %q: %v", want, err)
+	}
+	if string(plaintext) != want {
+		t.Fatalf("got %q, want %q", plaintext, want)
+	}
+}
+
+func TestRatchetConversation(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	if bob.CanSend() {
+		t.Fatal("responder can send before the first message")
+	}
+	if _, err := bob.Encrypt([]byte("too early"), nil); !errors.Is(err, ErrRatchetNotReady) {
+		t.Fatalf("got %v, want ErrRatchetNotReady", err)
+	}
+
+	// Several changes of direction, each one a DH step
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 3; i++ {
+			text := fmt.Sprintf("alice %d.%d", round, i)
+			expectDecrypt(t, bob, mustEncrypt(t, alice, text), text)
+		}
+		for i := 0; i < 2; i++ {
+			text := fmt.Sprintf("bob %d.%d", round, i)
+			expectDecrypt(t, alice, mustEncrypt(t, bob, text), text)
+		}
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	var first [5][]byte
+	for i := range first {
+		first[i] = mustEncrypt(t, alice, fmt.Sprintf("first %d", i))
+	}
+	for _, i := range []int{3, 0, 4} {
+		expectDecrypt(t, bob, first[i], fmt.Sprintf("first %d", i))
+	}
+
+	// Bob answers, Alice moves to a new chain while 1 and 2 of the old one are still on their way
+	expectDecrypt(t, alice, mustEncrypt(t, bob, "reply"), "reply")
+	second := mustEncrypt(t, alice, "second")
+	expectDecrypt(t, bob, second, "second")
+
+	expectDecrypt(t, bob, first[2], "first 2")
+	expectDecrypt(t, bob, first[1], "first 1")
+}
+
+func TestRatchetTooManySkipped(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	first := mustEncrypt(t, alice, "first")
+	var far []byte
+	for i := 0; i < MaxRatchetSkip+1; i++ {
+		far = mustEncrypt(t, alice, "far")
+	}
+
+	if _, err := bob.Decrypt(far, []byte("ad")); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("got %v, want ErrTooManySkipped", err)
+	}
+	// The rejected message left the ratchet as it was
+	expectDecrypt(t, bob, first, "first")
+}
+
+func TestRatchetRejectsReplay(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	m0 := mustEncrypt(t, alice, "m0")
+	m1 := mustEncrypt(t, alice, "m1")
+	expectDecrypt(t, bob, m1, "m1")
+	expectDecrypt(t, bob, m0, "m0")
+
+	// Both keys are consumed, the in order one and the skipped one
+	for _, message := range [][]byte{m0, m1} {
+		if _, err := bob.Decrypt(message, []byte("ad")); err == nil {
+			t.Fatal("replayed message decrypted")
+		}
+	}
+
+	// The conversation goes on
+	expectDecrypt(t, bob, mustEncrypt(t, alice, "m2"), "m2")
+}
+
+func TestRatchetRejectsTampering(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	message := mustEncrypt(t, alice, "content")
+	if _, err := bob.Decrypt(message, []byte("other ad")); err == nil {
+		t.Fatal("message decrypted with another ad")
+	}
+
+	flipped := bytes.Clone(message)
+	flipped[len(flipped)-1] ^= 1
+	if _, err := bob.Decrypt(flipped, []byte("ad")); err == nil {
+		t.Fatal("tampered message decrypted")
+	}
+
+	// The failures did not move the ratchet
+	expectDecrypt(t, bob, message, "content")
+}
+
+func TestRatchetMarshalBinary(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	late := mustEncrypt(t, alice, "late")
+	expectDecrypt(t, bob, mustEncrypt(t, alice, "on time"), "on time")
+
+	state, err := bob.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &Ratchet{}
+	if err := restored.UnmarshalBinary(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restored ratchet keeps the skipped keys and can answer
+	expectDecrypt(t, restored, late, "late")
+	expectDecrypt(t, alice, mustEncrypt(t, restored, "answer"), "answer")
+}
+
+func TestSenderKeyOutOfOrder(t *testing.T) {
+	sender, err := NewSenderKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := ParseSenderKey(sender.Distribution())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages [4][]byte
+	for i := range messages {
+		if messages[i], err = sender.Encrypt([]byte(fmt.Sprintf("room %d", i)), []byte("ad")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, i := range []int{2, 0, 3, 1} {
+		plaintext, err := receiver.Decrypt(messages[i], []byte("ad"))
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("room %d", i); string(plaintext) != want {
+			t.Fatalf("got %q, want %q", plaintext, want)
+		}
+	}
+
+	for i, message := range messages {
+		if _, err := receiver.Decrypt(message, []byte("ad")); err == nil {
+			t.Fatalf("replayed message %d decrypted", i)
+		}
+	}
+}
+
+func TestSenderKeyTooManySkipped(t *testing.T) {
+	sender, err := NewSenderKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := ParseSenderKey(sender.Distribution())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var far []byte
+	for i := 0; i < MaxRatchetSkip+2; i++ {
+		if far, err = sender.Encrypt([]byte("far"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := receiver.Decrypt(far, nil); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("got %v, want ErrTooManySkipped", err)
+	}
+}
+
+func TestSenderKeyMismatchAfterRotation(t *testing.T) {
+	sender, err := NewSenderKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := ParseSenderKey(sender.Distribution())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A member left, the sender rotates and the new distribution has not arrived yet
+	rotated, err := NewSenderKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ID() == sender.ID() {
+		t.Fatal("rotated key kept the same id")
+	}
+	distribution := rotated.Distribution()
+
+	message, err := rotated.Encrypt([]byte("after rotation"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Decrypt(message, nil); !errors.Is(err, ErrSenderKeyMismatch) {
+		t.Fatalf("got %v, want ErrSenderKeyMismatch", err)
+	}
+
+	// Once the new distribution arrives the message opens
+	current, err := ParseSenderKey(distribution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := current.Decrypt(message, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "after rotation" {
+		t.Fatalf("got %q", plaintext)
+	}
+
+	// A member that joins later only gets the chain from that point on
+	later, err := ParseSenderKey(rotated.Distribution())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := later.Decrypt(message, nil); err == nil {
+		t.Fatal("message sent before the distribution decrypted")
+	}
+}
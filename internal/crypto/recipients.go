@@ -0,0 +1,344 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Recipients header layout, written in front of a stream encrypted with a random file key:
+//
+//	magic "TPR" | version (1) | stanza count (2, big endian) | stanza ... | header MAC (32)
+//
+// Each stanza wraps the file key for one recipient: ephemeral X25519 public key (32) | wrapped file key (48).
+// The wrapping key is derived from X25519(ephemeral, recipient), so only the recipient's identity can unwrap it.
+// The MAC is an HMAC-SHA256 of everything before it, keyed from the file key, so stanzas can not be added or
+// swapped by someone who is not a recipient.
+var recipientsMagic = []byte("TPR")
+
+const (
+	// RecipientsHeaderVersion is the recipients header format written by WriteRecipientsHeader
+	RecipientsHeaderVersion byte = 1
+	// MaxRecipients is the largest number of stanzas a header can carry
+	MaxRecipients = 1024
+
+	// RecipientPrefix and IdentityPrefix start the text forms of X25519 public and private keys
+	RecipientPrefix = "tpr1"
+	IdentityPrefix  = "TP-SECRET-KEY-1"
+
+	fileKeySize        = 32
+	wrappedFileKeySize = fileKeySize + chacha20poly1305.Overhead
+	stanzaSize         = KeyExchangePublicKeySize + wrappedFileKeySize
+	recipientsMACSize  = sha256.Size
+	recipientWrapInfo  = "tp-ts-go recipient wrap v1"
+	recipientsMACInfo  = "tp-ts-go recipients header mac v1"
+)
+
+var (
+	// ErrNotRecipientsHeader is returned when the data does not start with the recipients header magic bytes
+	ErrNotRecipientsHeader = errors.New("not a recipients header")
+	// ErrNoMatchingIdentity is returned when none of the identities is a recipient of the file
+	ErrNoMatchingIdentity = errors.New("no identity matches any of the file recipients")
+)
+
+// X25519Identity is the private key of a file recipient, its public half is the recipient.
+type X25519Identity struct {
+	private *ecdh.PrivateKey
+}
+
+// GenerateX25519Identity creates a new random identity.
+func GenerateX25519Identity() (*X25519Identity, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate X25519 key: %w", err)
+	}
+	return &X25519Identity{private: private}, nil
+}
+
+// ParseX25519Identity decodes the text form written by X25519Identity.String.
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, IdentityPrefix) {
+		return nil, fmt.Errorf("identity must start with %s", IdentityPrefix)
+	}
+
+	raw, err := hex.DecodeString(strings.TrimPrefix(s, IdentityPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("identity is not hex encoded: %w", err)
+	}
+
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity: %w", err)
+	}
+	return &X25519Identity{private: private}, nil
+}
+
+// String returns the text form of the identity, it is a secret and must be stored as such.
+func (id *X25519Identity) String() string {
+	return IdentityPrefix + strings.ToUpper(hex.EncodeToString(id.private.Bytes()))
+}
+
+// Recipient returns the public key files are encrypted to.
+func (id *X25519Identity) Recipient() []byte {
+	return id.private.PublicKey().Bytes()
+}
+
+// FormatRecipient returns the text form of a recipient public key.
+func FormatRecipient(public []byte) string {
+	return RecipientPrefix + hex.EncodeToString(public)
+}
+
+// ParseRecipient decodes the text form written by FormatRecipient.
+func ParseRecipient(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, RecipientPrefix) {
+		return nil, fmt.Errorf("recipient must start with %s", RecipientPrefix)
+	}
+
+	public, err := hex.DecodeString(strings.TrimPrefix(s, RecipientPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("recipient is not hex encoded: %w", err)
+	}
+	if _, err := ecdh.X25519().NewPublicKey(public); err != nil {
+		return nil, fmt.Errorf("invalid recipient: %w", err)
+	}
+
+	return public, nil
+}
+
+// ParseRecipients reads one recipient per line, empty lines and lines starting with # are skipped.
+// A whole team can be kept in one file this way.
+func ParseRecipients(r io.Reader) ([][]byte, error) {
+	var recipients [][]byte
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		public, err := ParseRecipient(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		recipients = append(recipients, public)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
+
+// ParseIdentities reads the identities in r, one per line, skipping empty lines and # comments.
+func ParseIdentities(r io.Reader) ([]*X25519Identity, error) {
+	var identities []*X25519Identity
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		identity, err := ParseX25519Identity(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+// NewFileKey returns a random key to encrypt one file with.
+func NewFileKey() (SecretBytes, error) {
+	return NewSecretBytes(fileKeySize)
+}
+
+// HasRecipientsMagic reports whether b starts with the magic bytes of a recipients header.
+func HasRecipientsMagic(b []byte) bool {
+	return bytes.HasPrefix(b, recipientsMagic)
+}
+
+// WriteRecipientsHeader wraps fileKey once per recipient and writes the header to w.
+func WriteRecipientsHeader(w io.Writer, fileKey []byte, recipients [][]byte) error {
+	if len(fileKey) != fileKeySize {
+		return fmt.Errorf("invalid file key size: %d bytes; must be %d bytes", len(fileKey), fileKeySize)
+	}
+	if len(recipients) == 0 || len(recipients) > MaxRecipients {
+		return fmt.Errorf("invalid number of recipients: %d; must be between 1 and %d", len(recipients), MaxRecipients)
+	}
+
+	header := make([]byte, 0, len(recipientsMagic)+3+len(recipients)*stanzaSize+recipientsMACSize)
+	header = append(header, recipientsMagic...)
+	header = append(header, RecipientsHeaderVersion)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(recipients)))
+
+	for _, recipient := range recipients {
+		stanza, err := wrapFileKey(fileKey, recipient)
+		if err != nil {
+			return err
+		}
+		header = append(header, stanza...)
+	}
+
+	mac, err := recipientsHeaderMAC(fileKey, header)
+	if err != nil {
+		return err
+	}
+	header = append(header, mac...)
+
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write recipients header: %w", err)
+	}
+	return nil
+}
+
+// ReadRecipientsHeader reads the header written by WriteRecipientsHeader from r and returns the file key,
+// unwrapped with whichever of the identities is a recipient. r is left at the data that follows.
+func ReadRecipientsHeader(r io.Reader, identities []*X25519Identity) (SecretBytes, error) {
+	prefix := make([]byte, len(recipientsMagic)+3)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotRecipientsHeader
+		}
+		return nil, fmt.Errorf("failed to read recipients header: %w", err)
+	}
+	if !HasRecipientsMagic(prefix) {
+		return nil, ErrNotRecipientsHeader
+	}
+	if version := prefix[len(recipientsMagic)]; version != RecipientsHeaderVersion {
+		return nil, fmt.Errorf("unsupported recipients header version: %d", version)
+	}
+
+	count := int(binary.BigEndian.Uint16(prefix[len(recipientsMagic)+1:]))
+	if count == 0 || count > MaxRecipients {
+		return nil, fmt.Errorf("invalid number of recipients: %d", count)
+	}
+
+	header := make([]byte, len(prefix)+count*stanzaSize+recipientsMACSize)
+	copy(header, prefix)
+	if _, err := io.ReadFull(r, header[len(prefix):]); err != nil {
+		return nil, fmt.Errorf("recipients header is truncated: %w", err)
+	}
+
+	body, mac := header[:len(header)-recipientsMACSize], header[len(header)-recipientsMACSize:]
+	stanzas := body[len(prefix):]
+
+	for i := 0; i < count; i++ {
+		stanza := stanzas[i*stanzaSize : (i+1)*stanzaSize]
+
+		for _, identity := range identities {
+			fileKey, err := unwrapFileKey(stanza, identity)
+			if err != nil {
+				continue
+			}
+
+			expected, err := recipientsHeaderMAC(fileKey, body)
+			if err != nil {
+				clear(fileKey)
+				return nil, err
+			}
+			if !hmac.Equal(mac, expected) {
+				clear(fileKey)
+				return nil, fmt.Errorf("recipients header has been tampered with")
+			}
+
+			return fileKey, nil
+		}
+	}
+
+	return nil, ErrNoMatchingIdentity
+}
+
+// wrapFileKey seals the file key for one recipient with a fresh ephemeral key, returning the stanza.
+func wrapFileKey(fileKey, recipient []byte) ([]byte, error) {
+	kx, err := NewKeyExchange()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := recipientWrapAEAD(kx.private, recipient, kx.PublicKey(), recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	// The wrapping key is used exactly once, a zero nonce is safe
+	stanza := make([]byte, 0, stanzaSize)
+	stanza = append(stanza, kx.PublicKey()...)
+	return aead.Seal(stanza, make([]byte, aead.NonceSize()), fileKey, nil), nil
+}
+
+// unwrapFileKey opens a stanza with identity, failing if the stanza was not made for it.
+func unwrapFileKey(stanza []byte, identity *X25519Identity) ([]byte, error) {
+	ephemeral := stanza[:KeyExchangePublicKeySize]
+
+	aead, err := recipientWrapAEAD(identity.private, ephemeral, ephemeral, identity.Recipient())
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, make([]byte, aead.NonceSize()), stanza[KeyExchangePublicKeySize:], nil)
+}
+
+// recipientWrapAEAD derives the stanza wrapping AEAD from X25519(private, peer),
+// salted with the ephemeral and recipient public keys so it is bound to both.
+func recipientWrapAEAD(private *ecdh.PrivateKey, peerPublic, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+
+	salt := make([]byte, 0, 2*KeyExchangePublicKeySize)
+	salt = append(salt, ephemeral...)
+	salt = append(salt, recipient...)
+
+	wrapKey, err := GenerateSecret(shared, SecretParams{
+		Version: KDFHKDFSHA256,
+		Salt:    salt,
+		Info:    []byte(recipientWrapInfo),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chacha20poly1305.New(wrapKey)
+}
+
+// recipientsHeaderMAC authenticates the header with a key derived from the file key.
+func recipientsHeaderMAC(fileKey, header []byte) ([]byte, error) {
+	macKey, err := GenerateSecret(fileKey, SecretParams{
+		Version: KDFHKDFSHA256,
+		Info:    []byte(recipientsMACInfo),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(header)
+	return mac.Sum(nil), nil
+}
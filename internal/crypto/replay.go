@@ -0,0 +1,108 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultReplayWindowSize is how many sequence numbers behind the highest one a ReplayWindow still accepts,
+// enough for messages reordered by concurrent writers on the same connection.
+const DefaultReplayWindowSize = 1024
+
+// ErrReplay is returned for a sequence number that was already accepted, or that fell behind the window.
+var ErrReplay = errors.New("replayed or too old message")
+
+// ReplayWindow is the receiving side of a sequence numbered channel, in the style of the IPsec anti-replay window:
+// a bitmap of the last size sequence numbers, sliding forward as higher numbers arrive.
+// Sequence numbers start at 1 and must only be checked once their message authenticated. It is safe for concurrent use.
+type ReplayWindow struct {
+	mu       sync.Mutex
+	size     uint64
+	highest  uint64
+	bitmap   []uint64
+	rejected atomic.Uint64
+}
+
+// NewReplayWindow creates a window of size sequence numbers, rounded up to a multiple of 64.
+func NewReplayWindow(size int) *ReplayWindow {
+	if size < 64 {
+		size = 64
+	}
+	words := (size + 63) / 64
+
+	return &ReplayWindow{
+		size:   uint64(words * 64),
+		bitmap: make([]uint64, words),
+	}
+}
+
+// Check accepts seq once, rejecting it with ErrReplay (and counting it) when seen before or too old.
+func (w *ReplayWindow) Check(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if seq == 0 {
+		w.rejected.Add(1)
+		return fmt.Errorf("%w: sequence number 0", ErrReplay)
+	}
+
+	if seq > w.highest {
+		// Forget the slots the window slides over
+		if seq-w.highest >= w.size {
+			clear(w.bitmap)
+		} else {
+			for n := w.highest + 1; n < seq; n++ {
+				w.clearBit(n)
+			}
+		}
+		w.highest = seq
+		w.setBit(seq)
+		return nil
+	}
+
+	if w.highest-seq >= w.size {
+		w.rejected.Add(1)
+		return fmt.Errorf("%w: sequence number %d is behind the window", ErrReplay, seq)
+	}
+	if w.hasBit(seq) {
+		w.rejected.Add(1)
+		return fmt.Errorf("%w: sequence number %d", ErrReplay, seq)
+	}
+
+	w.setBit(seq)
+	return nil
+}
+
+// SetFloor rejects every sequence number up to last, as if they were all accepted already.
+// A receiver kept across restarts calls it with the highest number a previous run accepted.
+func (w *ReplayWindow) SetFloor(last uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.highest = last
+	for i := range w.bitmap {
+		w.bitmap[i] = ^uint64(0)
+	}
+}
+
+// Rejected returns how many sequence numbers were rejected.
+func (w *ReplayWindow) Rejected() uint64 {
+	return w.rejected.Load()
+}
+
+func (w *ReplayWindow) setBit(seq uint64) {
+	slot := seq % w.size
+	w.bitmap[slot/64] |= 1 << (slot % 64)
+}
+
+func (w *ReplayWindow) clearBit(seq uint64) {
+	slot := seq % w.size
+	w.bitmap[slot/64] &^= 1 << (slot % 64)
+}
+
+func (w *ReplayWindow) hasBit(seq uint64) bool {
+	slot := seq % w.size
+	return w.bitmap[slot/64]&(1<<(slot%64)) != 0
+}
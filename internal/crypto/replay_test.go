@@ -0,0 +1,95 @@
+package crypto
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func expectAccepted(t *testing.T, w *ReplayWindow, seqs ...uint64) {
+	t.Helper()
+	for _, seq := range seqs {
+		if err := w.Check(seq); err != nil {
+			t.Fatalf("sequence number %d: %v", seq, err)
+		}
+	}
+}
+
+func expectReplay(t *testing.T, w *ReplayWindow, seqs ...uint64) {
+	t.Helper()
+	for _, seq := range seqs {
+		if err := w.Check(seq); !errors.Is(err, ErrReplay) {
+			t.Fatalf("sequence number %d: got %v, want ErrReplay", seq, err)
+		}
+	}
+}
+
+func TestReplayWindowSize(t *testing.T) {
+	for size, want := range map[int]uint64{0: 64, 1: 64, 64: 64, 65: 128, DefaultReplayWindowSize: DefaultReplayWindowSize} {
+		if got := NewReplayWindow(size).size; got != want {
+			t.Errorf("NewReplayWindow(%d) has %d slots, want %d", size, got, want)
+		}
+	}
+}
+
+func TestReplayWindowDuplicates(t *testing.T) {
+	w := NewReplayWindow(64)
+
+	expectAccepted(t, w, 1, 2, 3)
+	expectReplay(t, w, 1, 2, 3)
+
+	// Out of order inside the window is fine, once
+	expectAccepted(t, w, 10, 7, 5, 4)
+	expectReplay(t, w, 7, 10)
+	expectAccepted(t, w, 6, 8, 9)
+
+	if got := w.Rejected(); got != 5 {
+		t.Fatalf("%d rejected, want 5", got)
+	}
+}
+
+func TestReplayWindowSlide(t *testing.T) {
+	w := NewReplayWindow(64)
+
+	expectAccepted(t, w, 1, 100)
+	// 100-63 is the oldest number still in the window
+	expectAccepted(t, w, 37)
+	expectReplay(t, w, 36, 1, 37)
+
+	// A short slide (the window is now 101 to 164) reuses the slots of 37 to 100,
+	// the numbers it passes over must not look received
+	expectAccepted(t, w, 164)
+	expectAccepted(t, w, 163, 101)
+	expectReplay(t, w, 100, 101)
+
+	// A jump past the whole window clears it
+	expectAccepted(t, w, 10_000)
+	expectAccepted(t, w, 10_000-63)
+	expectReplay(t, w, 10_000-64, 10_000)
+}
+
+func TestReplayWindowEdges(t *testing.T) {
+	w := NewReplayWindow(64)
+
+	// Sequence numbers start at 1, 0 is never valid
+	expectReplay(t, w, 0)
+	expectAccepted(t, w, 1)
+	expectReplay(t, w, 0)
+
+	expectAccepted(t, w, math.MaxUint64)
+	expectReplay(t, w, math.MaxUint64, 1)
+	expectAccepted(t, w, math.MaxUint64-1, math.MaxUint64-63)
+	expectReplay(t, w, math.MaxUint64-64)
+}
+
+func TestReplayWindowFloor(t *testing.T) {
+	w := NewReplayWindow(64)
+	w.SetFloor(500)
+
+	// Everything up to the floor was accepted by a previous run, inside the window or not
+	expectReplay(t, w, 1, 436, 437, 499, 500)
+	expectAccepted(t, w, 503)
+	// The numbers the window slid over are new
+	expectAccepted(t, w, 501, 502)
+	expectReplay(t, w, 500, 501, 503)
+}
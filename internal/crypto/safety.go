@@ -0,0 +1,90 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// A safety number lets two users check, out of band (in person, over the phone), that each holds the other's
+// real identity key and not one swapped in by whoever relays the messages. Like Signal's, each key is hashed
+// into 30 digits with an iterated SHA-512 (slow enough to make finding a key with the same digits costly),
+// the two halves are sorted so both users see the same 60 digits, shown in 12 groups of 5.
+// The word form is the same comparison, shorter and easier to read out, at a lower security level.
+const (
+	safetyNumberVersion    = 0
+	safetyNumberIterations = 5200
+	// each key gives 6 groups of 5 digits, each from 5 bytes of the hash
+	safetyGroupsPerKey = 6
+	safetyGroupDigits  = 5
+	// SafetyWordCount is the number of words of the word form
+	SafetyWordCount = 8
+)
+
+// SafetyNumber is the fingerprint of a pair of identity keys, the same on both ends of the conversation.
+type SafetyNumber struct {
+	digits string
+	words  []string
+}
+
+// ComputeSafetyNumber returns the safety number of our identity key and the peer's identity key.
+func ComputeSafetyNumber(localKey, peerKey []byte) (SafetyNumber, error) {
+	if len(localKey) == 0 || len(peerKey) == 0 {
+		return SafetyNumber{}, fmt.Errorf("safety number needs both identity keys")
+	}
+
+	halves := []string{keyDigits(localKey), keyDigits(peerKey)}
+	if halves[1] < halves[0] {
+		halves[0], halves[1] = halves[1], halves[0]
+	}
+	digits := halves[0] + halves[1]
+
+	digest := sha256.Sum256([]byte("tp-ts-go safety words v1" + digits))
+	words := make([]string, SafetyWordCount)
+	for i := range words {
+		words[i] = safetyWords[digest[i]]
+	}
+
+	return SafetyNumber{digits: digits, words: words}, nil
+}
+
+// keyDigits hashes one identity key into its half of the safety number
+func keyDigits(key []byte) string {
+	digest := make([]byte, 0, sha512.Size)
+	digest = binary.BigEndian.AppendUint16(digest, safetyNumberVersion)
+	digest = append(digest, key...)
+
+	for i := 0; i < safetyNumberIterations; i++ {
+		sum := sha512.Sum512(append(digest, key...))
+		digest = append(digest[:0], sum[:]...)
+	}
+
+	var out strings.Builder
+	for i := 0; i < safetyGroupsPerKey; i++ {
+		chunk := digest[i*5 : i*5+5]
+		value := uint64(chunk[0])<<32 | uint64(chunk[1])<<24 | uint64(chunk[2])<<16 | uint64(chunk[3])<<8 | uint64(chunk[4])
+		fmt.Fprintf(&out, "%0*d", safetyGroupDigits, value%100000)
+	}
+	return out.String()
+}
+
+// Groups returns the 60 digits in 12 groups of 5.
+func (s SafetyNumber) Groups() []string {
+	groups := make([]string, 0, len(s.digits)/safetyGroupDigits)
+	for i := 0; i+safetyGroupDigits <= len(s.digits); i += safetyGroupDigits {
+		groups = append(groups, s.digits[i:i+safetyGroupDigits])
+	}
+	return groups
+}
+
+// Words returns the word form.
+func (s SafetyNumber) Words() []string {
+	return append([]string(nil), s.words...)
+}
+
+// String returns the groups separated by spaces.
+func (s SafetyNumber) String() string {
+	return strings.Join(s.Groups(), " ")
+}
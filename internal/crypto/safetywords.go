@@ -0,0 +1,38 @@
+package crypto
+
+// safetyWords maps a byte to a word for the word form of a safety number, short common words that are easy to
+// read out over the phone. The order is part of the format: changing it changes every safety number.
+var safetyWords = [256]string{
+	"acid", "acorn", "actor", "adult", "aisle", "alarm", "album", "alert",
+	"alley", "amber", "angel", "ankle", "apple", "apron", "arena", "armor",
+	"arrow", "atlas", "attic", "audio", "avenue", "bacon", "badge", "bagel",
+	"baker", "bamboo", "banjo", "barn", "basil", "basket", "beach", "beard",
+	"bell", "berry", "bison", "blade", "blossom", "boat", "bonus", "boot",
+	"bottle", "box", "bread", "brick", "bridge", "broom", "bubble", "bucket",
+	"bullet", "butter", "cabin", "cable", "cactus", "camel", "camera", "candle",
+	"canoe", "canyon", "carpet", "carrot", "castle", "cedar", "cello", "chalk",
+	"cherry", "chess", "cider", "circus", "clock", "cloud", "clover", "coast",
+	"cobra", "cocoa", "comet", "copper", "coral", "cotton", "cousin", "cowboy",
+	"crane", "crayon", "cricket", "crystal", "curtain", "cushion", "daisy", "dancer",
+	"delta", "desert", "diamond", "dinner", "dolphin", "donkey", "dragon", "drum",
+	"eagle", "echo", "eclipse", "elbow", "ember", "engine", "falcon", "feather",
+	"fence", "ferry", "fiddle", "flag", "flute", "forest", "fossil", "fox",
+	"galaxy", "garden", "garlic", "geyser", "ginger", "giraffe", "glacier", "glove",
+	"goat", "grape", "gravel", "guitar", "hammer", "harbor", "harp", "hazel",
+	"helmet", "hockey", "honey", "horizon", "hotel", "husky", "igloo", "island",
+	"ivory", "jacket", "jaguar", "jelly", "jigsaw", "jungle", "kayak", "kettle",
+	"kiwi", "koala", "ladder", "lagoon", "lamp", "lantern", "lemon", "lens",
+	"lily", "lion", "lizard", "lobster", "locket", "magnet", "mango", "maple",
+	"marble", "meadow", "melon", "mirror", "monkey", "moose", "mosaic", "motor",
+	"muffin", "napkin", "needle", "nest", "noodle", "nutmeg", "oasis", "ocean",
+	"olive", "onion", "orange", "orbit", "orchid", "otter", "owl", "oyster",
+	"paddle", "palace", "panda", "paper", "parrot", "peach", "peanut", "pebble",
+	"pencil", "pepper", "piano", "pickle", "pigeon", "pillow", "pilot", "pine",
+	"planet", "plum", "pocket", "pony", "potato", "pumpkin", "puzzle", "quartz",
+	"quilt", "rabbit", "radar", "radio", "raven", "ribbon", "river", "robot",
+	"rocket", "saddle", "salmon", "sandal", "satin", "scarf", "shell", "shovel",
+	"silver", "skate", "sled", "snail", "spider", "spoon", "squid", "statue",
+	"sugar", "summit", "sunset", "swan", "table", "tiger", "toast", "tomato",
+	"torch", "tractor", "trumpet", "tulip", "tunnel", "turtle", "valley", "velvet",
+	"violin", "wagon", "walnut", "whale", "window", "wizard", "yogurt", "zebra",
+}
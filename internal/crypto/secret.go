@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+)
+
+// redacted is what SecretBytes prints as, with every fmt verb
+const redacted = "[REDACTED]"
+
+// SecretBytes holds key material. It formats as [REDACTED] with every fmt verb (%v, %x, %s, %#v, ...), so a key passed
+// to a log call does not end up in the log, and Destroy wipes it once it is no longer needed.
+//
+// It converts to and from []byte without a copy, where the bytes are really needed (an AEAD, a file) they are used
+// as they are: the redaction only guards against accidental printing.
+type SecretBytes []byte
+
+// NewSecretBytes returns size random bytes.
+func NewSecretBytes(size int) (SecretBytes, error) {
+	secret, err := GenerateRawRandomBytes(size)
+	if err != nil {
+		return nil, err
+	}
+	return SecretBytes(secret), nil
+}
+
+// Destroy overwrites the bytes with zeros. The slice keeps its length, using it afterwards uses an all zero key.
+func (s SecretBytes) Destroy() {
+	clear(s)
+}
+
+// Clone returns a copy, to be destroyed on its own.
+func (s SecretBytes) Clone() SecretBytes {
+	if s == nil {
+		return nil
+	}
+	return append(SecretBytes(nil), s...)
+}
+
+// Equal compares in constant time.
+func (s SecretBytes) Equal(other []byte) bool {
+	return subtle.ConstantTimeCompare(s, other) == 1
+}
+
+// String returns [REDACTED].
+func (s SecretBytes) String() string {
+	return redacted
+}
+
+// GoString returns [REDACTED], for %#v.
+func (s SecretBytes) GoString() string {
+	return redacted
+}
+
+// Format prints [REDACTED] whatever the verb, %x and %X included.
+func (s SecretBytes) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
@@ -0,0 +1,170 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Sender keys, as used by Signal for groups: each member encrypts its room messages once, with the next key of its
+// own symmetric chain, and hands the chain to every other member over a pairwise channel. The server relays a
+// single ciphertext it can not read. A member that receives the chain can only decrypt messages from that point on.
+//
+// A sender key message is header | ciphertext, the header is key id (4) | chain iteration (4).
+// A distribution is key id (4) | chain iteration (4) | chain key (32).
+const (
+	senderKeyHeaderSize       = 4 + 4
+	senderKeyDistributionSize = senderKeyHeaderSize + ratchetKeySize
+	senderKeyMessageInfo      = "tp-ts-go sender key v1 message"
+)
+
+// ErrSenderKeyMismatch is returned when a message was encrypted with another sender key than the one known for its sender,
+// usually because the sender rotated its key and the new distribution did not arrive yet
+var ErrSenderKeyMismatch = errors.New("message encrypted with an unknown sender key")
+
+// SenderKey is the chain of one member of a room. The member creates it with NewSenderKey to encrypt,
+// the others rebuild it from its Distribution to decrypt. It is safe for concurrent use.
+type SenderKey struct {
+	mu        sync.Mutex
+	id        uint32
+	chain     []byte
+	iteration uint32
+	// skipped keeps the keys of messages that have not arrived yet, oldest first
+	skipped      map[uint32][]byte
+	skippedOrder []uint32
+}
+
+// NewSenderKey creates a fresh sender key with a random id and chain.
+func NewSenderKey() (*SenderKey, error) {
+	seed := make([]byte, 4+ratchetKeySize)
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		return nil, fmt.Errorf("failed to generate sender key: %w", err)
+	}
+
+	return &SenderKey{
+		id:      binary.BigEndian.Uint32(seed),
+		chain:   seed[4:],
+		skipped: make(map[uint32][]byte),
+	}, nil
+}
+
+// ParseSenderKey rebuilds the sender key of another member from its Distribution.
+func ParseSenderKey(distribution []byte) (*SenderKey, error) {
+	if len(distribution) != senderKeyDistributionSize {
+		return nil, fmt.Errorf("invalid sender key distribution size: %d bytes; must be %d bytes", len(distribution), senderKeyDistributionSize)
+	}
+
+	return &SenderKey{
+		id:        binary.BigEndian.Uint32(distribution),
+		iteration: binary.BigEndian.Uint32(distribution[4:]),
+		chain:     bytes.Clone(distribution[senderKeyHeaderSize:]),
+		skipped:   make(map[uint32][]byte),
+	}, nil
+}
+
+// ID returns the random id of the key, a rotated key gets a new one.
+func (k *SenderKey) ID() uint32 {
+	return k.id
+}
+
+// Distribution returns the current state of the chain, to be sent to the other members over a pairwise encrypted channel.
+func (k *SenderKey) Distribution() []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	out := make([]byte, 0, senderKeyDistributionSize)
+	out = binary.BigEndian.AppendUint32(out, k.id)
+	out = binary.BigEndian.AppendUint32(out, k.iteration)
+	return append(out, k.chain...)
+}
+
+// Encrypt seals plaintext with the next key of the chain, the associated data is authenticated with the header.
+func (k *SenderKey) Encrypt(plaintext, ad []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.iteration == ^uint32(0) {
+		return nil, fmt.Errorf("sender key chain exhausted")
+	}
+
+	var messageKey []byte
+	k.chain, messageKey = ratchetChainStep(k.chain)
+
+	header := make([]byte, 0, senderKeyHeaderSize)
+	header = binary.BigEndian.AppendUint32(header, k.id)
+	header = binary.BigEndian.AppendUint32(header, k.iteration)
+	k.iteration++
+
+	return sealWithMessageKey(messageKey, senderKeyMessageInfo, header, plaintext, ad)
+}
+
+// Decrypt opens a message made by the member's Encrypt, messages may arrive out of order.
+func (k *SenderKey) Decrypt(message, ad []byte) ([]byte, error) {
+	if len(message) < senderKeyHeaderSize {
+		return nil, fmt.Errorf("sender key message too short")
+	}
+
+	id := binary.BigEndian.Uint32(message)
+	iteration := binary.BigEndian.Uint32(message[4:])
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if id != k.id {
+		return nil, ErrSenderKeyMismatch
+	}
+
+	if iteration < k.iteration {
+		messageKey, ok := k.skipped[iteration]
+		if !ok {
+			return nil, fmt.Errorf("sender key message %d already received or too old", iteration)
+		}
+
+		plaintext, err := openWithMessageKey(messageKey, senderKeyMessageInfo, senderKeyHeaderSize, message, ad)
+		if err != nil {
+			return nil, err
+		}
+		delete(k.skipped, iteration)
+		return plaintext, nil
+	}
+
+	if iteration-k.iteration > MaxRatchetSkip {
+		return nil, ErrTooManySkipped
+	}
+
+	// Move a copy of the chain, it only replaces ours once the message authenticates
+	chain := k.chain
+	var skipped []uint32
+	var skippedKeys [][]byte
+	for n := k.iteration; n < iteration; n++ {
+		var messageKey []byte
+		chain, messageKey = ratchetChainStep(chain)
+		skipped = append(skipped, n)
+		skippedKeys = append(skippedKeys, messageKey)
+	}
+
+	var messageKey []byte
+	chain, messageKey = ratchetChainStep(chain)
+
+	plaintext, err := openWithMessageKey(messageKey, senderKeyMessageInfo, senderKeyHeaderSize, message, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	k.chain = chain
+	k.iteration = iteration + 1
+	for i, n := range skipped {
+		k.skipped[n] = skippedKeys[i]
+		k.skippedOrder = append(k.skippedOrder, n)
+	}
+	for len(k.skippedOrder) > maxSkippedKeys {
+		delete(k.skipped, k.skippedOrder[0])
+		k.skippedOrder = k.skippedOrder[1:]
+	}
+
+	return plaintext, nil
+}
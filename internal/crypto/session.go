@@ -0,0 +1,184 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// ErrSessionExhausted is returned by Session.Seal once the key reached its usage limit, it must be replaced.
+var ErrSessionExhausted = errors.New("session key usage limit reached, rekey needed")
+
+// Usage limits per key. With random 96 bit nonces the collision risk passes 2^-32 after 2^32 messages,
+// the 192 bit XChaCha20 nonces push that far beyond any realistic volume.
+const (
+	randomNonceKeyLimit   = 1 << 32
+	extendedNonceKeyLimit = 1 << 62
+)
+
+// Session holds a prepared AEAD for one key, so the cipher is set up once instead of on every message.
+// Once set up (SetPadding, SetSequence, SetReceived) it is safe for concurrent use: the AEADs of every suite are stateless
+// and the counters are atomic.
+//
+// Each side numbers the messages it sends with NextSequence, and checks the numbers it receives with CheckSequence.
+// The number must be part of the associated data, so it can not be changed to get a replay past the window.
+type Session struct {
+	suite    CipherSuite
+	aead     cipher.AEAD
+	keyID    []byte
+	header   []byte
+	limit    uint64
+	sealed   atomic.Uint64
+	opened   atomic.Uint64
+	sequence atomic.Uint64
+	replay   *ReplayWindow
+	padding  PaddingPolicy
+}
+
+// NewSession prepares the AEAD of the given suite for the secret. A zero suite means SuiteAESGCM.
+func NewSession(suiteID CipherSuiteID, secret []byte) (*Session, error) {
+	if suiteID == 0 {
+		suiteID = SuiteAESGCM
+	}
+
+	suite, err := SuiteByID(suiteID)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := suite.NewAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := KeyIDFor(secret)
+	header, err := marshalEnvelopeHeader(EnvelopeOptions{Suite: suiteID, KeyID: keyID})
+	if err != nil {
+		return nil, err
+	}
+
+	limit := uint64(randomNonceKeyLimit)
+	if aead.NonceSize() >= 24 {
+		limit = extendedNonceKeyLimit
+	}
+
+	return &Session{
+		suite:  suite,
+		aead:   aead,
+		keyID:  keyID,
+		header: header,
+		limit:  limit,
+		replay: NewReplayWindow(DefaultReplayWindowSize),
+	}, nil
+}
+
+// Suite returns the cipher suite of the session.
+func (s *Session) Suite() CipherSuite {
+	return s.suite
+}
+
+// KeyID returns the key ID written in the envelopes sealed by the session.
+func (s *Session) KeyID() []byte {
+	return s.keyID
+}
+
+// SetPadding makes Seal pad the content with the policy, hiding its length. It is part of the setup of the session,
+// it must not be called once the session is shared.
+func (s *Session) SetPadding(policy PaddingPolicy) error {
+	header, err := marshalEnvelopeHeader(EnvelopeOptions{Suite: s.suite.ID(), KeyID: s.keyID, Padding: policy})
+	if err != nil {
+		return err
+	}
+
+	s.header = header
+	s.padding = policy
+	return nil
+}
+
+// Uses returns how many messages were sealed and opened with the session key.
+func (s *Session) Uses() (sealed uint64, opened uint64) {
+	return s.sealed.Load(), s.opened.Load()
+}
+
+// NextSequence returns the sequence number of the next message sent on the session, starting at 1.
+func (s *Session) NextSequence() uint64 {
+	return s.sequence.Add(1)
+}
+
+// SetSequence makes NextSequence continue after last. A session kept across restarts must not number
+// its messages from 1 again, the peer would reject them as replays.
+func (s *Session) SetSequence(last uint64) {
+	s.sequence.Store(last)
+}
+
+// SetReceived makes CheckSequence reject every sequence number up to last, the highest one accepted
+// by a previous run on the same key: its window starts empty and would take them again.
+func (s *Session) SetReceived(last uint64) {
+	s.replay.SetFloor(last)
+}
+
+// CheckSequence rejects, with ErrReplay, a sequence number already received on the session or too old for its window.
+// It must be called after the message was opened, so forged numbers can not fill the window.
+func (s *Session) CheckSequence(seq uint64) error {
+	return s.replay.Check(seq)
+}
+
+// Replays returns how many received messages were rejected by CheckSequence.
+func (s *Session) Replays() uint64 {
+	return s.replay.Rejected()
+}
+
+// NeedsRekey reports whether the key is close to its usage limit (3/4 of it),
+// callers should negotiate a new key before Seal starts failing with ErrSessionExhausted.
+func (s *Session) NeedsRekey() bool {
+	return s.sealed.Load() >= s.limit-s.limit/4
+}
+
+// Seal encrypts content into an envelope bound to ad, like EncryptWithAD does.
+func (s *Session) Seal(content, ad []byte) ([]byte, error) {
+	if s.sealed.Add(1) > s.limit {
+		return nil, ErrSessionExhausted
+	}
+
+	content, err := Pad(content, s.padding)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	out := make([]byte, 0, len(s.header)+len(nonce)+len(content)+s.aead.Overhead())
+	out = append(out, s.header...)
+	out = append(out, nonce...)
+	return s.aead.Seal(out, nonce, content, envelopeAD(s.header, ad)), nil
+}
+
+// Open decrypts an envelope sealed with the session key and bound to ad.
+// Envelopes of another suite or key are rejected, the session only speaks the suite it was negotiated with.
+func (s *Session) Open(ciphertext, ad []byte) ([]byte, error) {
+	env, err := ParseEnvelope(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if env.Suite != s.suite.ID() {
+		return nil, fmt.Errorf("unexpected cipher suite: %d; session uses %d", env.Suite, s.suite.ID())
+	}
+	if len(env.KeyID) != 0 && !bytes.Equal(env.KeyID, s.keyID) {
+		return nil, fmt.Errorf("%w: %x", ErrUnknownKeyID, env.KeyID)
+	}
+
+	plaintext, err := s.aead.Open(nil, env.Nonce, env.Ciphertext, envelopeAD(env.header, ad))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	s.opened.Add(1)
+	return env.unpad(plaintext)
+}
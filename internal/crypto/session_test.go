@@ -0,0 +1,53 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+// broadcastRoomSize is the room the relay benchmarks broadcast to
+const broadcastRoomSize = 500
+
+// BenchmarkBroadcast500 relays one 256 byte message to a room of 500 clients, each with its own key:
+// preparing the AEAD on every call (Encrypt) against the Sessions prepared once per client.
+func BenchmarkBroadcast500(b *testing.B) {
+	secrets := make([][]byte, broadcastRoomSize)
+	sessions := make([]*Session, broadcastRoomSize)
+	for i := range secrets {
+		secrets[i] = make([]byte, 32)
+		if _, err := rand.Read(secrets[i]); err != nil {
+			b.Fatal(err)
+		}
+
+		session, err := NewSession(SuiteAESGCM, secrets[i])
+		if err != nil {
+			b.Fatal(err)
+		}
+		sessions[i] = session
+	}
+
+	content := make([]byte, 256)
+	ad := []byte("tp-ts-go bench ad")
+
+	b.Run("Encrypt", func(b *testing.B) {
+		b.SetBytes(int64(len(content) * broadcastRoomSize))
+		for n := 0; n < b.N; n++ {
+			for _, secret := range secrets {
+				if _, err := EncryptWithAD(content, secret, ad); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("Session", func(b *testing.B) {
+		b.SetBytes(int64(len(content) * broadcastRoomSize))
+		for n := 0; n < b.N; n++ {
+			for _, session := range sessions {
+				if _, err := session.Seal(content, ad); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
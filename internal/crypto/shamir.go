@@ -0,0 +1,225 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Shamir secret sharing over GF(2^8): every byte of the secret is the constant term of its own random polynomial
+// of degree threshold-1, share i holds the polynomials evaluated at x = i. Any threshold shares rebuild the secret
+// by Lagrange interpolation at x = 0, fewer reveal nothing about it.
+//
+// A share is set id (4) | threshold (1) | x (1) | y, where y is as long as the secret plus a checksum.
+// The checksum (the start of the secret's SHA-256) is shared along with the secret, so it tells a wrong or
+// incomplete set of shares apart without leaking anything to whoever holds less than a quorum.
+const (
+	// SharePrefix starts the text form of a share
+	SharePrefix = "tpss1"
+	// MaxShares is the number of distinct non-zero x in GF(2^8)
+	MaxShares = 255
+
+	shareSetIDSize    = 4
+	shareHeaderSize   = shareSetIDSize + 1 + 1
+	shareChecksumSize = 8
+)
+
+var (
+	// ErrNotEnoughShares is returned when fewer shares than the threshold are given
+	ErrNotEnoughShares = errors.New("not enough shares to rebuild the secret")
+	// ErrShareChecksum is returned when the shares do not rebuild the secret they were split from
+	ErrShareChecksum = errors.New("shares do not rebuild a valid secret")
+)
+
+// SplitSecret splits secret into n shares, any threshold of which rebuild it with CombineShares.
+func SplitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	if threshold < 2 || threshold > n || n > MaxShares {
+		return nil, fmt.Errorf("invalid %d of %d split: need 2 <= threshold <= shares <= %d", threshold, n, MaxShares)
+	}
+
+	checksum := sha256.Sum256(secret)
+	shared := append(bytes.Clone(secret), checksum[:shareChecksumSize]...)
+	defer clear(shared)
+
+	setID := make([]byte, shareSetIDSize)
+	if _, err := io.ReadFull(rand.Reader, setID); err != nil {
+		return nil, fmt.Errorf("failed to generate share set id: %w", err)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		share := make([]byte, shareHeaderSize, shareHeaderSize+len(shared))
+		copy(share, setID)
+		share[shareSetIDSize] = byte(threshold)
+		share[shareSetIDSize+1] = byte(i + 1)
+		shares[i] = share
+	}
+
+	// coefficients[0] is the secret byte, the others are random
+	coefficients := make([]byte, threshold)
+	defer clear(coefficients)
+	for _, b := range shared {
+		coefficients[0] = b
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, fmt.Errorf("failed to generate polynomial: %w", err)
+		}
+
+		for i := range shares {
+			shares[i] = append(shares[i], gfEvaluate(coefficients, byte(i+1)))
+		}
+	}
+
+	return shares, nil
+}
+
+// CombineShares rebuilds the secret from at least threshold shares of the same split.
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, ErrNotEnoughShares
+	}
+
+	first := shares[0]
+	if len(first) <= shareHeaderSize+shareChecksumSize {
+		return nil, fmt.Errorf("share too short: %d bytes", len(first))
+	}
+	threshold := int(first[shareSetIDSize])
+	if threshold < 2 {
+		return nil, fmt.Errorf("invalid share threshold: %d", threshold)
+	}
+
+	xs := make([]byte, 0, len(shares))
+	seen := make(map[byte]bool, len(shares))
+	for i, share := range shares {
+		if len(share) != len(first) || !bytes.Equal(share[:shareSetIDSize+1], first[:shareSetIDSize+1]) {
+			return nil, fmt.Errorf("share %d does not belong to the same split as share 1", i+1)
+		}
+
+		x := share[shareSetIDSize+1]
+		if x == 0 {
+			return nil, fmt.Errorf("share %d has an invalid index", i+1)
+		}
+		if seen[x] {
+			continue
+		}
+		seen[x] = true
+		xs = append(xs, x)
+	}
+
+	if len(xs) < threshold {
+		return nil, fmt.Errorf("%w: %d of %d", ErrNotEnoughShares, len(xs), threshold)
+	}
+	// threshold points define the polynomial, more only cost time
+	xs = xs[:threshold]
+	points := make([][]byte, 0, threshold)
+	for _, x := range xs {
+		for _, share := range shares {
+			if share[shareSetIDSize+1] == x {
+				points = append(points, share[shareHeaderSize:])
+				break
+			}
+		}
+	}
+
+	// Lagrange basis at x = 0: l_j = prod x_m / (x_m - x_j), subtraction is xor in GF(2^8)
+	basis := make([]byte, threshold)
+	for j := range xs {
+		numerator, denominator := byte(1), byte(1)
+		for m := range xs {
+			if m == j {
+				continue
+			}
+			numerator = gfMul(numerator, xs[m])
+			denominator = gfMul(denominator, xs[m]^xs[j])
+		}
+		basis[j] = gfMul(numerator, gfInverse(denominator))
+	}
+
+	shared := make([]byte, len(points[0]))
+	for i := range shared {
+		var b byte
+		for j := range points {
+			b ^= gfMul(basis[j], points[j][i])
+		}
+		shared[i] = b
+	}
+
+	secretSize := len(shared) - shareChecksumSize
+	secret, checksum := shared[:secretSize], shared[secretSize:]
+	expected := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare(checksum, expected[:shareChecksumSize]) != 1 {
+		clear(shared)
+		return nil, ErrShareChecksum
+	}
+
+	return secret, nil
+}
+
+// ShareThreshold returns how many shares of the share's split are needed to rebuild the secret.
+func ShareThreshold(share []byte) int {
+	if len(share) < shareHeaderSize {
+		return 0
+	}
+	return int(share[shareSetIDSize])
+}
+
+// FormatShare returns the text form of a share, SharePrefix followed by the hex encoded share.
+func FormatShare(share []byte) string {
+	return SharePrefix + hex.EncodeToString(share)
+}
+
+// ParseShare decodes the text form written by FormatShare.
+func ParseShare(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, SharePrefix) {
+		return nil, fmt.Errorf("share must start with %s", SharePrefix)
+	}
+
+	share, err := hex.DecodeString(strings.TrimPrefix(s, SharePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("share is not hex encoded: %w", err)
+	}
+	if len(share) <= shareHeaderSize+shareChecksumSize {
+		return nil, fmt.Errorf("share too short: %d bytes", len(share))
+	}
+
+	return share, nil
+}
+
+// gfEvaluate evaluates the polynomial with the coefficients (lowest degree first) at x, by Horner's rule
+func gfEvaluate(coefficients []byte, x byte) byte {
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coefficients[i]
+	}
+	return y
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x + 1 (the AES field), without branches or tables on secret data
+func gfMul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		b >>= 1
+		a = a<<1 ^ -(a>>7)&0x1b
+	}
+	return product
+}
+
+// gfInverse returns a^254 = a^-1 (a must not be zero)
+func gfInverse(a byte) byte {
+	result := a
+	for i := 0; i < 6; i++ {
+		a = gfMul(a, a)
+		result = gfMul(result, a)
+	}
+	return gfMul(result, result)
+}
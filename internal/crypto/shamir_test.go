@@ -0,0 +1,161 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if product := gfMul(byte(a), gfInverse(byte(a))); product != 1 {
+			t.Fatalf("%#02x * inverse(%#02x) = %#02x, want 1", a, a, product)
+		}
+	}
+}
+
+func TestGFMul(t *testing.T) {
+	// FIPS-197, section 4.2
+	if product := gfMul(0x57, 0x83); product != 0xc1 {
+		t.Fatalf("0x57 * 0x83 = %#02x, want 0xc1", product)
+	}
+	if product := gfMul(0x57, 0x13); product != 0xfe {
+		t.Fatalf("0x57 * 0x13 = %#02x, want 0xfe", product)
+	}
+
+	for a := 0; a < 256; a++ {
+		if gfMul(byte(a), 0) != 0 || gfMul(byte(a), 1) != byte(a) {
+			t.Fatalf("%#02x: 0 and 1 are not the field's zero and one", a)
+		}
+		for b := 0; b < 256; b++ {
+			if gfMul(byte(a), byte(b)) != gfMul(byte(b), byte(a)) {
+				t.Fatalf("%#02x * %#02x is not commutative", a, b)
+			}
+		}
+	}
+}
+
+// subsets calls fn with every subset of size k of the indexes 0 to n-1
+func subsets(n, k int, fn func([]int)) {
+	subset := make([]int, 0, k)
+	var walk func(start int)
+	walk = func(start int) {
+		if len(subset) == k {
+			fn(subset)
+			return
+		}
+		for i := start; i < n; i++ {
+			subset = append(subset, i)
+			walk(i + 1)
+			subset = subset[:len(subset)-1]
+		}
+	}
+	walk(0)
+}
+
+func pick(shares [][]byte, indexes []int) [][]byte {
+	out := make([][]byte, 0, len(indexes))
+	for _, i := range indexes {
+		out = append(out, shares[i])
+	}
+	return out
+}
+
+func TestShamirEveryQuorum(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+
+	for _, split := range []struct{ n, k int }{{2, 2}, {3, 2}, {5, 3}, {6, 6}} {
+		shares, err := SplitSecret(secret, split.n, split.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shares) != split.n {
+			t.Fatalf("%d of %d: got %d shares", split.k, split.n, len(shares))
+		}
+
+		for k := split.k; k <= split.n; k++ {
+			subsets(split.n, k, func(indexes []int) {
+				rebuilt, err := CombineShares(pick(shares, indexes))
+				if err != nil {
+					t.Fatalf("%d of %d, shares %v: %v", split.k, split.n, indexes, err)
+				}
+				if !bytes.Equal(rebuilt, secret) {
+					t.Fatalf("%d of %d, shares %v: rebuilt %q", split.k, split.n, indexes, rebuilt)
+				}
+			})
+		}
+
+		subsets(split.n, split.k-1, func(indexes []int) {
+			if _, err := CombineShares(pick(shares, indexes)); !errors.Is(err, ErrNotEnoughShares) {
+				t.Fatalf("%d of %d, shares %v: got %v, want ErrNotEnoughShares", split.k, split.n, indexes, err)
+			}
+		})
+	}
+}
+
+func TestShamirRejectsBadSets(t *testing.T) {
+	secret := []byte("the vault key")
+	a, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A share given twice does not count twice
+	if _, err := CombineShares([][]byte{a[0], a[1], a[1]}); !errors.Is(err, ErrNotEnoughShares) {
+		t.Fatalf("repeated share: got %v, want ErrNotEnoughShares", err)
+	}
+
+	// Shares of two splits of the same secret
+	if _, err := CombineShares([][]byte{a[0], a[1], b[2]}); err == nil {
+		t.Fatal("shares of two splits combined")
+	}
+
+	// Even relabeled as part of the first split, the checksum catches it
+	relabeled := bytes.Clone(b[2])
+	copy(relabeled, a[0][:shareSetIDSize])
+	if _, err := CombineShares([][]byte{a[0], a[1], relabeled}); !errors.Is(err, ErrShareChecksum) {
+		t.Fatalf("relabeled share: got %v, want ErrShareChecksum", err)
+	}
+
+	corrupted := bytes.Clone(a[2])
+	corrupted[shareHeaderSize] ^= 1
+	if _, err := CombineShares([][]byte{a[0], a[1], corrupted}); !errors.Is(err, ErrShareChecksum) {
+		t.Fatalf("corrupted share: got %v, want ErrShareChecksum", err)
+	}
+}
+
+func TestShamirInvalidSplit(t *testing.T) {
+	for _, split := range []struct{ n, k int }{{3, 1}, {2, 3}, {256, 2}, {0, 0}} {
+		if _, err := SplitSecret([]byte("secret"), split.n, split.k); err == nil {
+			t.Errorf("%d of %d split accepted", split.k, split.n)
+		}
+	}
+	if _, err := SplitSecret(nil, 3, 2); err == nil {
+		t.Error("empty secret split")
+	}
+}
+
+func TestShareTextForm(t *testing.T) {
+	shares, err := SplitSecret([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseShare(" " + FormatShare(shares[1]) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed, shares[1]) || ShareThreshold(parsed) != 2 {
+		t.Fatalf("parsed share %x, threshold %d", parsed, ShareThreshold(parsed))
+	}
+
+	for _, text := range []string{"", "tpss1", "tpss1zz", "xx" + FormatShare(shares[1])[2:], SharePrefix + "00"} {
+		if _, err := ParseShare(text); err == nil {
+			t.Errorf("%q parsed", text)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrInvalidSignature is returned when a signature does not verify under the given public key.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// IdentityKey is a long-term Ed25519 signing key, it proves who wrote a message no matter who relayed it.
+type IdentityKey struct {
+	private ed25519.PrivateKey
+}
+
+// GenerateIdentityKey creates a new random identity key.
+func GenerateIdentityKey() (*IdentityKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate Ed25519 key: %w", err)
+	}
+	return &IdentityKey{private: private}, nil
+}
+
+// NewIdentityKeyFromSeed rebuilds an identity key from the seed returned by Seed.
+func NewIdentityKeyFromSeed(seed []byte) (*IdentityKey, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid identity seed size: %d bytes; must be %d bytes", len(seed), ed25519.SeedSize)
+	}
+	return &IdentityKey{private: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// Seed returns the 32 byte private seed, it is what must be stored to keep the identity.
+func (k *IdentityKey) Seed() SecretBytes {
+	return k.private.Seed()
+}
+
+// Destroy wipes the private key, the identity can not sign anymore.
+func (k *IdentityKey) Destroy() {
+	clear(k.private)
+}
+
+// PublicKey returns the public half, shared with peers to verify our signatures.
+func (k *IdentityKey) PublicKey() []byte {
+	return bytes.Clone(k.private.Public().(ed25519.PublicKey))
+}
+
+// Sign signs message with the identity key.
+func (k *IdentityKey) Sign(message []byte) []byte {
+	return ed25519.Sign(k.private, message)
+}
+
+// VerifySignature checks that signature was made over message by the owner of public.
+func VerifySignature(public, message, signature []byte) error {
+	if len(public) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: public key size %d", ErrInvalidSignature, len(public))
+	}
+	if !ed25519.Verify(public, message, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Fingerprint returns a short printable digest of a public key, SHA256: followed by the base64 SHA-256 of the key,
+// for users to compare out of band and for pinning files.
+func Fingerprint(public []byte) string {
+	digest := sha256.Sum256(public)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(digest[:])
+}
+
+// PeerStatus is the outcome of checking a peer's signature against the key pinned for it.
+type PeerStatus int
+
+const (
+	// PeerUnverified means the signature is missing or invalid, the sender can not be trusted
+	PeerUnverified PeerStatus = iota
+	// PeerKeyChanged means the signature is valid, but under a different key than the one pinned for the peer
+	PeerKeyChanged
+	// PeerNew means the signature is valid and the key was pinned for the peer, trust on first use
+	PeerNew
+	// PeerKnown means the signature is valid under the key pinned for the peer
+	PeerKnown
+	// PeerVerified means the signature is valid under the key pinned for the peer, and the user compared
+	// the safety number of that key with the peer out of band
+	PeerVerified
+)
+
+// Trusted reports whether the message can be attributed to the peer.
+func (s PeerStatus) Trusted() bool {
+	return s == PeerNew || s == PeerKnown || s == PeerVerified
+}
+
+// PeerKeys pins the identity key of each peer ID the first time it is seen (trust on first use),
+// so a peer ID can not later be taken over by someone with another key. It is safe for concurrent use.
+type PeerKeys struct {
+	mu       sync.Mutex
+	keys     map[string][]byte
+	verified map[string]bool
+}
+
+// NewPeerKeys returns a store holding the already pinned keys, which may be nil.
+func NewPeerKeys(pinned map[string][]byte) *PeerKeys {
+	keys := make(map[string][]byte, len(pinned))
+	for id, key := range pinned {
+		keys[id] = bytes.Clone(key)
+	}
+	return &PeerKeys{keys: keys, verified: make(map[string]bool)}
+}
+
+// Verify checks signature over message with public, and public against the key pinned for peerId.
+func (pk *PeerKeys) Verify(peerId string, public, message, signature []byte) PeerStatus {
+	if len(signature) == 0 || VerifySignature(public, message, signature) != nil {
+		return PeerUnverified
+	}
+
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pinned, known := pk.keys[peerId]
+	switch {
+	case !known:
+		pk.keys[peerId] = bytes.Clone(public)
+		return PeerNew
+	case bytes.Equal(pinned, public) && pk.verified[peerId]:
+		return PeerVerified
+	case bytes.Equal(pinned, public):
+		return PeerKnown
+	default:
+		return PeerKeyChanged
+	}
+}
+
+// MarkVerified records that the user checked the safety number of key with peerId.
+// It fails if key is not the one pinned for the peer, a verification only holds for the key it was made with.
+func (pk *PeerKeys) MarkVerified(peerId string, key []byte) bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pinned, known := pk.keys[peerId]
+	if !known || !bytes.Equal(pinned, key) {
+		return false
+	}
+	pk.verified[peerId] = true
+	return true
+}
+
+// Key returns the key pinned for peerId.
+func (pk *PeerKeys) Key(peerId string) ([]byte, bool) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	key, ok := pk.keys[peerId]
+	return bytes.Clone(key), ok
+}
+
+// Pinned returns a copy of every pinned key, to be persisted.
+func (pk *PeerKeys) Pinned() map[string][]byte {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	out := make(map[string][]byte, len(pk.keys))
+	for id, key := range pk.keys {
+		out[id] = bytes.Clone(key)
+	}
+	return out
+}
@@ -0,0 +1,458 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Stream layout, in the style of the STREAM construction (Hoang, Reyhanitabar, Rogaway, Vizár):
+//
+//	magic "TPS" | version (1) | suite (1) | chunk size (4, big endian) | flags (1) | salt (16) | chunk 0 | chunk 1 | ... | last chunk
+//
+// Version 1 streams have no flags byte. With StreamFlagPadded the plaintext ends with the padding of Pad,
+// stripped by the reader without holding the zeros in memory.
+//
+// Every chunk is chunkSize bytes of plaintext sealed on its own, the last one may be shorter (or empty).
+// The nonce of a chunk is zeros || chunk counter (4, big endian) || last chunk flag (1), so chunks can not be
+// reordered, dropped or duplicated, and a stream cut at a chunk boundary is detected because no chunk carried the flag.
+// The chunk key is derived from the caller's key and the random salt, so a key can be reused across streams.
+var streamMagic = []byte("TPS")
+
+const (
+	// StreamVersion is the stream format written by StreamWriter, version 1 streams are still read
+	StreamVersion byte = 2
+	// StreamFlagPadded means the plaintext was padded to hide its length
+	StreamFlagPadded byte = 1 << 0
+	// DefaultStreamChunkSize is the amount of plaintext sealed per chunk
+	DefaultStreamChunkSize = 64 * 1024
+	// MaxStreamChunkSize bounds the memory a reader will allocate for a chunk
+	MaxStreamChunkSize = 16 * 1024 * 1024
+
+	streamSaltSize     = 16
+	streamHeaderSizeV1 = 3 + 1 + 1 + 4 + streamSaltSize
+	streamHeaderSize   = streamHeaderSizeV1 + 1
+	streamInfo         = "tp-ts-go stream v1"
+	lastChunkFlag      = 0x01
+)
+
+var (
+	// ErrNotStream is returned when the data does not start with the stream magic bytes
+	ErrNotStream = errors.New("not an encrypted stream")
+	// ErrStreamTruncated is returned when the stream ends before its last chunk
+	ErrStreamTruncated = errors.New("encrypted stream is truncated")
+)
+
+// HasStreamMagic reports whether b starts with the magic bytes of a stream written by StreamWriter.
+func HasStreamMagic(b []byte) bool {
+	return bytes.HasPrefix(b, streamMagic)
+}
+
+// streamState is shared by the writer and the reader: the chunk AEAD, the authenticated header and the chunk counter.
+type streamState struct {
+	aead    cipher.AEAD
+	header  []byte
+	counter uint32
+	nonce   []byte
+}
+
+func newStreamState(key []byte, header []byte, suiteID CipherSuiteID, salt []byte) (*streamState, error) {
+	suite, err := SuiteByID(suiteID)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkKey, err := GenerateSecret(key, SecretParams{
+		Version: KDFHKDFSHA256,
+		Salt:    salt,
+		Info:    []byte(streamInfo),
+		Size:    suite.KeySize(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := suite.NewAEAD(chunkKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamState{
+		aead:   aead,
+		header: header,
+		nonce:  make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+// nextNonce returns the nonce of the next chunk and moves the counter forward.
+func (st *streamState) nextNonce(last bool) ([]byte, error) {
+	if st.counter == ^uint32(0) {
+		return nil, fmt.Errorf("stream too long, chunk counter exhausted")
+	}
+
+	size := len(st.nonce)
+	binary.BigEndian.PutUint32(st.nonce[size-5:size-1], st.counter)
+	st.nonce[size-1] = 0
+	if last {
+		st.nonce[size-1] = lastChunkFlag
+	}
+
+	st.counter++
+	return st.nonce, nil
+}
+
+// StreamOptions are the caller chosen stream parameters.
+type StreamOptions struct {
+	// Suite is the AEAD used for the chunks, defaults to SuiteAESGCM
+	Suite CipherSuiteID
+	// ChunkSize is the amount of plaintext sealed per chunk, defaults to DefaultStreamChunkSize
+	ChunkSize int
+	// Padding hides the length of the plaintext in a size bucket
+	Padding PaddingPolicy
+}
+
+// StreamWriter encrypts everything written to it as a chunked stream, using constant memory.
+// Close must be called to seal the last chunk, a stream without it is rejected as truncated.
+type StreamWriter struct {
+	w       io.Writer
+	state   *streamState
+	buf     []byte
+	sealed  []byte
+	closed  bool
+	written uint64
+	padding PaddingPolicy
+}
+
+// NewStreamWriter writes the stream header to w and returns a writer that seals chunks of DefaultStreamChunkSize.
+// A zero suite means SuiteAESGCM.
+func NewStreamWriter(w io.Writer, key []byte, suiteID CipherSuiteID) (*StreamWriter, error) {
+	return NewStreamWriterSize(w, key, suiteID, DefaultStreamChunkSize)
+}
+
+// NewStreamWriterSize is NewStreamWriter with the chunk size chosen by the caller.
+func NewStreamWriterSize(w io.Writer, key []byte, suiteID CipherSuiteID, chunkSize int) (*StreamWriter, error) {
+	return NewStreamWriterOptions(w, key, StreamOptions{Suite: suiteID, ChunkSize: chunkSize})
+}
+
+// NewStreamWriterOptions is NewStreamWriter with every stream parameter chosen by the caller.
+func NewStreamWriterOptions(w io.Writer, key []byte, opts StreamOptions) (*StreamWriter, error) {
+	chunkSize, suiteID := opts.ChunkSize, opts.Suite
+	if chunkSize == 0 {
+		chunkSize = DefaultStreamChunkSize
+	}
+	if chunkSize < 0 || chunkSize > MaxStreamChunkSize {
+		return nil, fmt.Errorf("invalid chunk size: %d; must be between 1 and %d bytes", chunkSize, MaxStreamChunkSize)
+	}
+	if suiteID == 0 {
+		suiteID = SuiteAESGCM
+	}
+	if _, err := opts.Padding.PaddedSize(0); err != nil {
+		return nil, err
+	}
+
+	flags := byte(0)
+	if opts.Padding != PaddingNone {
+		flags |= StreamFlagPadded
+	}
+
+	salt := make([]byte, streamSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	header := make([]byte, 0, streamHeaderSize)
+	header = append(header, streamMagic...)
+	header = append(header, StreamVersion, byte(suiteID))
+	header = binary.BigEndian.AppendUint32(header, uint32(chunkSize))
+	header = append(header, flags)
+	header = append(header, salt...)
+
+	state, err := newStreamState(key, header, suiteID, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write stream header: %w", err)
+	}
+
+	return &StreamWriter{
+		w:       w,
+		state:   state,
+		buf:     make([]byte, 0, chunkSize),
+		sealed:  make([]byte, 0, chunkSize+state.aead.Overhead()),
+		padding: opts.Padding,
+	}, nil
+}
+
+// Write buffers p and seals every full chunk. A full chunk is only sealed once more data arrives,
+// since until then it may still turn out to be the last one.
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, fmt.Errorf("write on a closed stream")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(sw.buf) == cap(sw.buf) {
+			if err := sw.flushChunk(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	sw.written += uint64(written)
+	return written, nil
+}
+
+// Close pads the plaintext, if asked to, and seals the buffered data as the last chunk.
+// It does not close the underlying writer.
+func (sw *StreamWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+
+	if sw.padding != PaddingNone {
+		if err := sw.writePadding(); err != nil {
+			return err
+		}
+	}
+
+	sw.closed = true
+	return sw.flushChunk(true)
+}
+
+// writePadding writes the marker and the zeros of Pad, a chunk of zeros at a time.
+func (sw *StreamWriter) writePadding() error {
+	size, err := sw.padding.PaddedSize(sw.written)
+	if err != nil {
+		return err
+	}
+
+	if _, err := sw.Write([]byte{paddingMarker}); err != nil {
+		return err
+	}
+
+	zeros := make([]byte, cap(sw.buf))
+	for remaining := size - sw.written; remaining > 0; {
+		n := uint64(len(zeros))
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := sw.Write(zeros[:n]); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+
+	return nil
+}
+
+func (sw *StreamWriter) flushChunk(last bool) error {
+	nonce, err := sw.state.nextNonce(last)
+	if err != nil {
+		return err
+	}
+
+	sw.sealed = sw.state.aead.Seal(sw.sealed[:0], nonce, sw.buf, sw.state.header)
+	sw.buf = sw.buf[:0]
+
+	if _, err := sw.w.Write(sw.sealed); err != nil {
+		return fmt.Errorf("failed to write chunk: %w", err)
+	}
+	return nil
+}
+
+// StreamReader decrypts a stream written by StreamWriter, releasing plaintext one authenticated chunk at a time.
+type StreamReader struct {
+	r     *bufio.Reader
+	state *streamState
+	chunk []byte
+	plain []byte
+	done  bool
+	err   error
+
+	// padded streams hold back a trailing marker and zeros until a later byte shows they are content
+	padded     bool
+	heldMarker bool
+	heldZeros  uint64
+	// outMarker and outZeros are held back bytes that turned out to be content, released before plain
+	outMarker bool
+	outZeros  uint64
+}
+
+// NewStreamReader reads the stream header from r and returns a reader of the decrypted content.
+func NewStreamReader(r io.Reader, key []byte) (*StreamReader, error) {
+	br := bufio.NewReader(r)
+
+	prefix, err := br.Peek(len(streamMagic) + 1)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrNotStream
+		}
+		return nil, fmt.Errorf("failed to read stream header: %w", err)
+	}
+	if !bytes.HasPrefix(prefix, streamMagic) {
+		return nil, ErrNotStream
+	}
+
+	version := prefix[3]
+	headerSize := streamHeaderSize
+	switch version {
+	case 1:
+		headerSize = streamHeaderSizeV1
+	case StreamVersion:
+	default:
+		return nil, fmt.Errorf("unsupported stream version: %d", version)
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotStream
+		}
+		return nil, fmt.Errorf("failed to read stream header: %w", err)
+	}
+
+	suiteID := CipherSuiteID(header[4])
+	chunkSize := binary.BigEndian.Uint32(header[5:9])
+	if chunkSize == 0 || chunkSize > MaxStreamChunkSize {
+		return nil, fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+
+	flags := byte(0)
+	if version != 1 {
+		flags = header[9]
+	}
+	if flags&^StreamFlagPadded != 0 {
+		return nil, fmt.Errorf("unknown stream flags: %#x", flags)
+	}
+
+	state, err := newStreamState(key, header, suiteID, header[headerSize-streamSaltSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamReader{
+		r:      br,
+		state:  state,
+		chunk:  make([]byte, int(chunkSize)+state.aead.Overhead()),
+		padded: flags&StreamFlagPadded != 0,
+	}, nil
+}
+
+// Read returns decrypted content, no plaintext is released before its chunk is authenticated.
+func (sr *StreamReader) Read(p []byte) (int, error) {
+	for !sr.outMarker && sr.outZeros == 0 && len(sr.plain) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		if sr.done {
+			return 0, io.EOF
+		}
+		sr.err = sr.readChunk()
+	}
+
+	n := 0
+	if sr.outMarker && len(p) > 0 {
+		p[0] = paddingMarker
+		sr.outMarker = false
+		n++
+	}
+	if sr.outZeros > 0 {
+		zeros := uint64(len(p) - n)
+		if sr.outZeros < zeros {
+			zeros = sr.outZeros
+		}
+		clear(p[n : n+int(zeros)])
+		sr.outZeros -= zeros
+		n += int(zeros)
+	}
+	if sr.outMarker || sr.outZeros > 0 {
+		return n, nil
+	}
+
+	copied := copy(p[n:], sr.plain)
+	sr.plain = sr.plain[copied:]
+	return n + copied, nil
+}
+
+func (sr *StreamReader) readChunk() error {
+	n, err := io.ReadFull(sr.r, sr.chunk)
+
+	last := false
+	switch {
+	case errors.Is(err, io.EOF):
+		// Nothing after the previous chunk, which was not flagged as the last one
+		return ErrStreamTruncated
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case err != nil:
+		return fmt.Errorf("failed to read chunk: %w", err)
+	default:
+		// A full chunk is the last one only if the stream ends right after it
+		if _, peekErr := sr.r.Peek(1); errors.Is(peekErr, io.EOF) {
+			last = true
+		}
+	}
+
+	if n < sr.state.aead.Overhead() {
+		return ErrStreamTruncated
+	}
+
+	nonce, err := sr.state.nextNonce(last)
+	if err != nil {
+		return err
+	}
+
+	plain, err := sr.state.aead.Open(sr.chunk[:0], nonce, sr.chunk[:n], sr.state.header)
+	if err != nil {
+		if last {
+			// Either tampered with, or cut exactly at a chunk boundary
+			return fmt.Errorf("%w or corrupted: %w", ErrStreamTruncated, err)
+		}
+		return fmt.Errorf("failed to decrypt chunk: %w", err)
+	}
+
+	sr.done = last
+	if !sr.padded {
+		sr.plain = plain
+		return nil
+	}
+	return sr.unpadChunk(plain, last)
+}
+
+// unpadChunk releases the content of a chunk of a padded stream. The last marker and the zeros after it
+// may be padding, they are held back (as a count, the padding can span many chunks) until more content shows up.
+func (sr *StreamReader) unpadChunk(plain []byte, last bool) error {
+	i := len(bytes.TrimRight(plain, "\x00")) - 1
+	if i < 0 {
+		sr.heldZeros += uint64(len(plain))
+		sr.plain = nil
+	} else {
+		sr.outMarker, sr.outZeros = sr.heldMarker, sr.heldZeros
+		sr.heldMarker = plain[i] == paddingMarker
+		if sr.heldMarker {
+			sr.plain = plain[:i]
+		} else {
+			sr.plain = plain[:i+1]
+		}
+		sr.heldZeros = uint64(len(plain) - i - 1)
+	}
+
+	if last && !sr.heldMarker {
+		sr.plain, sr.outMarker, sr.outZeros = nil, false, 0
+		return ErrInvalidPadding
+	}
+	return nil
+}
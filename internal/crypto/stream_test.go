@@ -0,0 +1,195 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testChunkSize keeps the streams of the tests a few chunks long
+const testChunkSize = 64
+
+func sealStream(t *testing.T, key, content []byte, opts StreamOptions) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	sw, err := NewStreamWriterOptions(&out, key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func openStream(key, sealed []byte) ([]byte, error) {
+	sr, err := NewStreamReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(sr)
+}
+
+// streamChunks splits a sealed stream into its header and its sealed chunks
+func streamChunks(t *testing.T, sealed []byte, suiteID CipherSuiteID) ([]byte, [][]byte) {
+	t.Helper()
+
+	suite, err := SuiteByID(suiteID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := suite.NewAEAD(make([]byte, suite.KeySize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, rest := sealed[:streamHeaderSize], sealed[streamHeaderSize:]
+	var chunks [][]byte
+	for size := testChunkSize + aead.Overhead(); len(rest) > size; rest = rest[size:] {
+		chunks = append(chunks, rest[:size])
+	}
+	return header, append(chunks, rest)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testKey()
+	sizes := []int{0, 1, testChunkSize - 1, testChunkSize, testChunkSize + 1, 3 * testChunkSize}
+
+	for _, id := range allSuites {
+		for _, padding := range []PaddingPolicy{PaddingNone, PaddingPadme} {
+			for _, size := range sizes {
+				content := bytes.Repeat([]byte{0xab}, size)
+				// Content ending like padding must not be mistaken for it
+				if size > 2 {
+					content[size-2], content[size-1] = paddingMarker, 0
+				}
+
+				sealed := sealStream(t, key, content, StreamOptions{Suite: id, ChunkSize: testChunkSize, Padding: padding})
+				opened, err := openStream(key, sealed)
+				if err != nil {
+					t.Fatalf("suite %d, padding %s, %d bytes: %v", id, padding, size, err)
+				}
+				if !bytes.Equal(opened, content) {
+					t.Fatalf("suite %d, padding %s, %d bytes: content differs", id, padding, size)
+				}
+			}
+		}
+	}
+}
+
+// TestStreamRoundTripSmallWrites writes a byte at a time, the chunks must come out the same
+func TestStreamRoundTripSmallWrites(t *testing.T) {
+	key := testKey()
+	content := bytes.Repeat([]byte("0123456789"), 20)
+
+	var out bytes.Buffer
+	sw, err := NewStreamWriterSize(&out, key, SuiteAESGCM, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range content {
+		if _, err := sw.Write(content[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := openStream(key, out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, content) {
+		t.Fatal("content differs")
+	}
+}
+
+func TestStreamRejectsTruncationAtChunkBoundary(t *testing.T) {
+	key := testKey()
+
+	for _, size := range []int{testChunkSize, testChunkSize + 1, 3 * testChunkSize} {
+		sealed := sealStream(t, key, bytes.Repeat([]byte{1}, size), StreamOptions{ChunkSize: testChunkSize})
+		header, chunks := streamChunks(t, sealed, SuiteAESGCM)
+
+		// Every cut that keeps whole chunks only, the header alone included
+		for keep := 0; keep < len(chunks); keep++ {
+			cut := bytes.Clone(header)
+			for _, chunk := range chunks[:keep] {
+				cut = append(cut, chunk...)
+			}
+
+			if _, err := openStream(key, cut); !errors.Is(err, ErrStreamTruncated) {
+				t.Fatalf("%d bytes, %d of %d chunks: got %v, want ErrStreamTruncated", size, keep, len(chunks), err)
+			}
+		}
+	}
+}
+
+func TestStreamRejectsDroppedFinalChunk(t *testing.T) {
+	key := testKey()
+	sealed := sealStream(t, key, bytes.Repeat([]byte{2}, 2*testChunkSize+10), StreamOptions{ChunkSize: testChunkSize})
+	header, chunks := streamChunks(t, sealed, SuiteAESGCM)
+
+	dropped := bytes.Clone(header)
+	for _, chunk := range chunks[:len(chunks)-1] {
+		dropped = append(dropped, chunk...)
+	}
+
+	opened, err := openStream(key, dropped)
+	if !errors.Is(err, ErrStreamTruncated) {
+		t.Fatalf("got %v, want ErrStreamTruncated", err)
+	}
+	if len(opened) > 2*testChunkSize {
+		t.Fatalf("released %d bytes past the authenticated chunks", len(opened))
+	}
+}
+
+func TestStreamRejectsReorderedChunks(t *testing.T) {
+	key := testKey()
+	content := append(bytes.Repeat([]byte{3}, testChunkSize), bytes.Repeat([]byte{4}, 2*testChunkSize+5)...)
+	sealed := sealStream(t, key, content, StreamOptions{ChunkSize: testChunkSize})
+	header, chunks := streamChunks(t, sealed, SuiteAESGCM)
+
+	reordered := bytes.Clone(header)
+	reordered = append(reordered, chunks[1]...)
+	reordered = append(reordered, chunks[0]...)
+	for _, chunk := range chunks[2:] {
+		reordered = append(reordered, chunk...)
+	}
+	if _, err := openStream(key, reordered); err == nil {
+		t.Fatal("stream with reordered chunks opened")
+	}
+
+	duplicated := bytes.Clone(header)
+	duplicated = append(duplicated, chunks[0]...)
+	for _, chunk := range chunks {
+		duplicated = append(duplicated, chunk...)
+	}
+	if _, err := openStream(key, duplicated); err == nil {
+		t.Fatal("stream with a duplicated chunk opened")
+	}
+}
+
+func TestStreamRejectsTamperedHeader(t *testing.T) {
+	key := testKey()
+	sealed := sealStream(t, key, []byte("content"), StreamOptions{ChunkSize: testChunkSize})
+
+	// chunk size and salt are authenticated with every chunk
+	for _, offset := range []int{8, streamHeaderSize - 1} {
+		tampered := bytes.Clone(sealed)
+		tampered[offset] ^= 1
+		if _, err := openStream(key, tampered); err == nil {
+			t.Fatalf("stream with header byte %d flipped opened", offset)
+		}
+	}
+
+	if _, err := openStream(key, []byte("TPX")); !errors.Is(err, ErrNotStream) {
+		t.Fatalf("got %v, want ErrNotStream", err)
+	}
+}
@@ -0,0 +1,147 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"runtime"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// CipherSuiteID identifies the AEAD that sealed an envelope, it is written in the envelope header
+// and exchanged during the handshake.
+type CipherSuiteID byte
+
+const (
+	// SuiteAESGCM is AES-GCM with a random 12 byte nonce, the key size picks AES-128/192/256
+	SuiteAESGCM CipherSuiteID = 1
+	// SuiteChaCha20Poly1305 is ChaCha20-Poly1305 (RFC 8439) with a random 12 byte nonce, fast without AES hardware
+	SuiteChaCha20Poly1305 CipherSuiteID = 2
+	// SuiteXChaCha20Poly1305 is ChaCha20-Poly1305 with a 24 byte nonce, random nonces are safe for any message volume
+	SuiteXChaCha20Poly1305 CipherSuiteID = 3
+)
+
+// CipherSuite builds the AEAD for a key, so envelopes can be sealed and opened with any supported algorithm.
+type CipherSuite interface {
+	ID() CipherSuiteID
+	Name() string
+	// KeySize is the size of the keys the suite expects, AES-GCM also accepts 16 and 24 byte keys
+	KeySize() int
+	NonceSize() int
+	NewAEAD(key []byte) (cipher.AEAD, error)
+}
+
+type aesGCMSuite struct{}
+
+func (aesGCMSuite) ID() CipherSuiteID { return SuiteAESGCM }
+func (aesGCMSuite) Name() string      { return "AES-256-GCM" }
+func (aesGCMSuite) KeySize() int      { return 32 }
+func (aesGCMSuite) NonceSize() int    { return 12 }
+
+func (aesGCMSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return newAESGCM(key)
+}
+
+type chacha20Poly1305Suite struct{}
+
+func (chacha20Poly1305Suite) ID() CipherSuiteID { return SuiteChaCha20Poly1305 }
+func (chacha20Poly1305Suite) Name() string      { return "ChaCha20-Poly1305" }
+func (chacha20Poly1305Suite) KeySize() int      { return chacha20poly1305.KeySize }
+func (chacha20Poly1305Suite) NonceSize() int    { return chacha20poly1305.NonceSize }
+
+func (chacha20Poly1305Suite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ChaCha20-Poly1305: %w", err)
+	}
+	return aead, nil
+}
+
+type xchacha20Poly1305Suite struct{}
+
+func (xchacha20Poly1305Suite) ID() CipherSuiteID { return SuiteXChaCha20Poly1305 }
+func (xchacha20Poly1305Suite) Name() string      { return "XChaCha20-Poly1305" }
+func (xchacha20Poly1305Suite) KeySize() int      { return chacha20poly1305.KeySize }
+func (xchacha20Poly1305Suite) NonceSize() int    { return chacha20poly1305.NonceSizeX }
+
+func (xchacha20Poly1305Suite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create XChaCha20-Poly1305: %w", err)
+	}
+	return aead, nil
+}
+
+var suites = map[CipherSuiteID]CipherSuite{
+	SuiteAESGCM:            aesGCMSuite{},
+	SuiteChaCha20Poly1305:  chacha20Poly1305Suite{},
+	SuiteXChaCha20Poly1305: xchacha20Poly1305Suite{},
+}
+
+// SuiteByID returns the cipher suite registered for id.
+func SuiteByID(id CipherSuiteID) (CipherSuite, error) {
+	suite, ok := suites[id]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher suite: %d", id)
+	}
+	return suite, nil
+}
+
+// hasAESHardware reports whether this machine has AES instructions, AES-GCM is only fast (and constant time) with them.
+func hasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	default:
+		return false
+	}
+}
+
+// PreferredSuites lists the supported suites, best first for this machine.
+// Without AES hardware the ChaCha20 suites are preferred, as they are faster in software.
+func PreferredSuites() []CipherSuiteID {
+	if hasAESHardware() {
+		return []CipherSuiteID{SuiteAESGCM, SuiteXChaCha20Poly1305, SuiteChaCha20Poly1305}
+	}
+	return []CipherSuiteID{SuiteXChaCha20Poly1305, SuiteChaCha20Poly1305, SuiteAESGCM}
+}
+
+// NegotiateSuite picks the first suite of the peer's offer that is supported, in the peer's order of preference,
+// since the peer knows best what runs fast on its hardware. An empty offer comes from a peer older than
+// suite negotiation, it gets AES-GCM.
+func NegotiateSuite(offered []CipherSuiteID) (CipherSuite, error) {
+	if len(offered) == 0 {
+		return aesGCMSuite{}, nil
+	}
+
+	for _, id := range offered {
+		if suite, ok := suites[id]; ok {
+			return suite, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no cipher suite in common with the peer")
+}
+
+// SuitesToBytes encodes a list of suite IDs for the wire, one byte per suite.
+func SuitesToBytes(ids []CipherSuiteID) []byte {
+	out := make([]byte, len(ids))
+	for i, id := range ids {
+		out[i] = byte(id)
+	}
+	return out
+}
+
+// SuitesFromBytes decodes a list of suite IDs written by SuitesToBytes.
+func SuitesFromBytes(b []byte) []CipherSuiteID {
+	out := make([]CipherSuiteID, len(b))
+	for i, id := range b {
+		out[i] = CipherSuiteID(id)
+	}
+	return out
+}
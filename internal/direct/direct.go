@@ -0,0 +1,300 @@
+package direct
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/TP-TS-Go/internal/crypto"
+	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
+)
+
+// Outgoing is a message ready to go to the server. Content is the end to end payload,
+// the caller still seals it with its session before writing it on the connection.
+type Outgoing struct {
+	Message msgpacktyps.Message
+	Content []byte
+}
+
+// Conversations keeps the Double Ratchet of each direct conversation (messages with a Target).
+// The server only relays the ratchet messages, it can not read them.
+//
+// A conversation starts with a RatchetInit carrying an ephemeral X25519 key signed with the identity key,
+// answered by a RatchetAccept. The initiator then sends an empty message, so the responder can send too.
+type Conversations struct {
+	mu       sync.Mutex
+	selfId   string
+	identity *crypto.IdentityKey
+	ratchets map[string]*crypto.Ratchet
+	// pending keeps the key exchange of each RatchetInit still waiting for its RatchetAccept
+	pending map[string]*crypto.KeyExchange
+	// handshakes keeps the last handshake of each peer, so a repeated init or accept does not start over
+	handshakes map[string]handshakeRecord
+	onUpdate   func(peerId string, ratchet *crypto.Ratchet)
+}
+
+// handshakeRecord is the public key the peer sent in the handshake of the current conversation,
+// and the accept we answered with, when the peer started it
+type handshakeRecord struct {
+	peerPublic []byte
+	accept     *Outgoing
+}
+
+func NewConversations(selfId string, identity *crypto.IdentityKey) *Conversations {
+	return &Conversations{
+		selfId:     selfId,
+		identity:   identity,
+		ratchets:   make(map[string]*crypto.Ratchet),
+		pending:    make(map[string]*crypto.KeyExchange),
+		handshakes: make(map[string]handshakeRecord),
+	}
+}
+
+// SetOnUpdate sets the function called every time the ratchet of a peer changes, to persist it
+func (c *Conversations) SetOnUpdate(function func(peerId string, ratchet *crypto.Ratchet)) {
+	c.onUpdate = function
+}
+
+// Restore brings back the ratchet of a peer saved with MarshalBinary
+func (c *Conversations) Restore(peerId string, state []byte) error {
+	ratchet := &crypto.Ratchet{}
+	if err := ratchet.UnmarshalBinary(state); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.ratchets[peerId] = ratchet
+	c.mu.Unlock()
+	return nil
+}
+
+// CanSend reports whether messages to the peer can be sealed right away
+func (c *Conversations) CanSend(peerId string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ratchet, exists := c.ratchets[peerId]
+	return exists && ratchet.CanSend()
+}
+
+// Start returns the RatchetInit that opens a conversation with the peer
+func (c *Conversations) Start(peerId string) (Outgoing, error) {
+	kx, err := crypto.NewKeyExchange()
+	if err != nil {
+		return Outgoing{}, fmt.Errorf("erro ao gerar chave efemera: %s", err.Error())
+	}
+
+	out, err := c.handshake(msgpacktyps.RatchetInit, peerId, kx)
+	if err != nil {
+		return Outgoing{}, err
+	}
+
+	c.mu.Lock()
+	c.pending[peerId] = kx
+	c.mu.Unlock()
+
+	return out, nil
+}
+
+// Seal encrypts the content with the ratchet of the peer
+func (c *Conversations) Seal(peerId string, content []byte) (Outgoing, error) {
+	return c.SealType(msgpacktyps.SendContent, peerId, content)
+}
+
+// SealType is Seal for messages of another type than SendContent, such as SenderKeyDistribution
+func (c *Conversations) SealType(msgType msgpacktyps.MessageType, peerId string, content []byte) (Outgoing, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.seal(msgType, peerId, content)
+}
+
+func (c *Conversations) seal(msgType msgpacktyps.MessageType, peerId string, content []byte) (Outgoing, error) {
+	ratchet, exists := c.ratchets[peerId]
+	if !exists {
+		return Outgoing{}, fmt.Errorf("sem conversa com %s", peerId)
+	}
+
+	msg := msgpacktyps.NewMessage(msgType, c.selfId, peerId)
+	sealed, err := ratchet.Encrypt(content, msg.AssociatedData())
+	if err != nil {
+		return Outgoing{}, err
+	}
+	c.updated(peerId, ratchet)
+
+	return Outgoing{Message: msg, Content: sealed}, nil
+}
+
+// Handle processes a direct message already opened with the session, whose signature (for handshakes) the caller
+// has checked against the pinned key of the sender. It returns the plaintext of a chat message, sender key
+// distribution or receipt, nil for protocol messages, and the reply to send back, if any.
+func (c *Conversations) Handle(msg msgpacktyps.Message, content []byte) ([]byte, *Outgoing, error) {
+	if msg.Target != c.selfId {
+		return nil, nil, fmt.Errorf("mensagem para outro cliente: %s", msg.Target)
+	}
+
+	switch msg.Type {
+	case msgpacktyps.RatchetInit:
+		reply, err := c.handleInit(msg, content)
+		return nil, reply, err
+	case msgpacktyps.RatchetAccept:
+		reply, err := c.handleAccept(msg, content)
+		return nil, reply, err
+	case msgpacktyps.SendContent, msgpacktyps.SenderKeyDistribution, msgpacktyps.Receipt:
+		plaintext, err := c.open(msg, content)
+		return plaintext, nil, err
+	default:
+		return nil, nil, fmt.Errorf("tipo de mensagem direta desconhecido: %d", msg.Type)
+	}
+}
+
+func (c *Conversations) handleInit(msg msgpacktyps.Message, content []byte) (*Outgoing, error) {
+	peerPublic, err := readHandshake(content)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The same init again, the peer did not get our accept yet
+	if record, exists := c.handshakes[msg.SenderId]; exists && record.accept != nil && bytes.Equal(record.peerPublic, peerPublic) {
+		return record.accept, nil
+	}
+
+	// Both sides started at the same time, the smallest id stays the initiator.
+	// Our init may have been sent before the peer was connected, so it goes again, with the same key.
+	if pending, started := c.pending[msg.SenderId]; started && c.selfId < msg.SenderId {
+		init, err := c.handshake(msgpacktyps.RatchetInit, msg.SenderId, pending)
+		if err != nil {
+			return nil, err
+		}
+		return &init, nil
+	}
+	delete(c.pending, msg.SenderId)
+
+	kx, err := crypto.NewKeyExchange()
+	if err != nil {
+		return nil, fmt.Errorf("erro ao gerar chave efemera: %s", err.Error())
+	}
+
+	secret, err := kx.DeriveSecret(peerPublic, ratchetInfo(msg.SenderId, c.selfId))
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Destroy()
+
+	ratchet, err := crypto.NewRatchetResponder(secret, kx)
+	if err != nil {
+		return nil, err
+	}
+
+	accept, err := c.handshake(msgpacktyps.RatchetAccept, msg.SenderId, kx)
+	if err != nil {
+		return nil, err
+	}
+
+	// A new init replaces the conversation, the peer may have lost its state
+	c.ratchets[msg.SenderId] = ratchet
+	c.handshakes[msg.SenderId] = handshakeRecord{peerPublic: bytes.Clone(peerPublic), accept: &accept}
+	c.updated(msg.SenderId, ratchet)
+	return &accept, nil
+}
+
+func (c *Conversations) handleAccept(msg msgpacktyps.Message, content []byte) (*Outgoing, error) {
+	peerPublic, err := readHandshake(content)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	kx, exists := c.pending[msg.SenderId]
+	if !exists {
+		// The answer to an init we sent twice
+		if record, known := c.handshakes[msg.SenderId]; known && record.accept == nil && bytes.Equal(record.peerPublic, peerPublic) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("resposta inesperada de %s", msg.SenderId)
+	}
+
+	secret, err := kx.DeriveSecret(peerPublic, ratchetInfo(c.selfId, msg.SenderId))
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Destroy()
+
+	ratchet, err := crypto.NewRatchetInitiator(secret, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(c.pending, msg.SenderId)
+	c.ratchets[msg.SenderId] = ratchet
+	c.handshakes[msg.SenderId] = handshakeRecord{peerPublic: bytes.Clone(peerPublic)}
+
+	// The responder can only send after our first message
+	confirm, err := c.seal(msgpacktyps.SendContent, msg.SenderId, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &confirm, nil
+}
+
+func (c *Conversations) open(msg msgpacktyps.Message, content []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ratchet, exists := c.ratchets[msg.SenderId]
+	if !exists {
+		return nil, fmt.Errorf("sem conversa com %s", msg.SenderId)
+	}
+
+	plaintext, err := ratchet.Decrypt(content, msg.AssociatedData())
+	if err != nil {
+		return nil, err
+	}
+	c.updated(msg.SenderId, ratchet)
+
+	// The confirmation that lets us send
+	if len(plaintext) == 0 {
+		return nil, nil
+	}
+	return plaintext, nil
+}
+
+// handshake builds a signed RatchetInit or RatchetAccept carrying the public key of kx
+func (c *Conversations) handshake(msgType msgpacktyps.MessageType, peerId string, kx *crypto.KeyExchange) (Outgoing, error) {
+	content, err := msgpack.Marshal(&msgpacktyps.RatchetHandshake{PublicKey: kx.PublicKey()})
+	if err != nil {
+		return Outgoing{}, err
+	}
+
+	msg := msgpacktyps.NewMessage(msgType, c.selfId, peerId)
+	msg.SignerKey = c.identity.PublicKey()
+	msg.Signature = c.identity.Sign(msg.SignedPayload(content))
+
+	return Outgoing{Message: msg, Content: content}, nil
+}
+
+func (c *Conversations) updated(peerId string, ratchet *crypto.Ratchet) {
+	if c.onUpdate != nil {
+		c.onUpdate(peerId, ratchet)
+	}
+}
+
+func readHandshake(content []byte) ([]byte, error) {
+	var handshake msgpacktyps.RatchetHandshake
+	if err := msgpack.Unmarshal(content, &handshake); err != nil {
+		return nil, fmt.Errorf("handshake mal formado: %s", err.Error())
+	}
+	return handshake.PublicKey, nil
+}
+
+// ratchetInfo binds the conversation secret to both ids, in initiator, responder order
+func ratchetInfo(initiator, responder string) []byte {
+	return []byte(msgpacktyps.RatchetInfo + initiator + " " + responder)
+}
@@ -0,0 +1,76 @@
+/* Framing - Delimits the messages of the TCP protocol with a length prefix instead of a delimiter byte. */
+package framing
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A frame is a 4 byte big endian length followed by that many bytes of payload.
+// The payload is never scanned, so it can hold any byte, the 0x0a that binary msgpack is full of included.
+const (
+	// HeaderSize is the size of the length prefix
+	HeaderSize = 4
+	// MaxFrameSize bounds the payload of a frame, a peer can not make the reader allocate more than this
+	MaxFrameSize = 1 << 20
+)
+
+// ErrFrameTooLarge is returned for a frame over MaxFrameSize. The stream can not be read any further after it.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Encode returns the payload framed, ready to be written in one go.
+func Encode(payload []byte) ([]byte, error) {
+	if len(payload) > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes; at most %d bytes", ErrFrameTooLarge, len(payload), MaxFrameSize)
+	}
+
+	frame := make([]byte, HeaderSize, HeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	return append(frame, payload...), nil
+}
+
+// WriteFrame writes the payload as one frame, with a single Write so writers sharing w only need to serialize the calls.
+func WriteFrame(w io.Writer, payload []byte) error {
+	frame, err := Encode(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// Reader reads the frames written by WriteFrame.
+type Reader struct {
+	r      io.Reader
+	header [HeaderSize]byte
+}
+
+// NewReader returns a Reader of the frames in r, r should be buffered for small frames not to cost two reads each.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadFrame returns the payload of the next frame. It returns io.EOF only when the stream ends between frames,
+// a stream cut inside a frame gives io.ErrUnexpectedEOF.
+func (fr *Reader) ReadFrame() ([]byte, error) {
+	if _, err := io.ReadFull(fr.r, fr.header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(fr.header[:])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes; at most %d bytes", ErrFrameTooLarge, size, MaxFrameSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(fr.r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,98 @@
+package framing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	payloads := [][]byte{
+		{},
+		{0x0a},
+		[]byte("msgpack\nwith\nnewlines"),
+		bytes.Repeat([]byte{0xff}, MaxFrameSize),
+	}
+
+	var stream bytes.Buffer
+	for _, payload := range payloads {
+		if err := WriteFrame(&stream, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frames := NewReader(&stream)
+	for i, want := range payloads {
+		got, err := frames.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("frame %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+
+	if _, err := frames.ReadFrame(); err != io.EOF {
+		t.Fatalf("after the last frame: got %v, want io.EOF", err)
+	}
+}
+
+func TestEncodeLayout(t *testing.T) {
+	frame, err := Encode([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0, 0, 3, 'a', 'b', 'c'}; !bytes.Equal(frame, want) {
+		t.Fatalf("got %x, want %x", frame, want)
+	}
+}
+
+// A stream cut between frames ends cleanly, one cut inside a frame (header or payload) does not
+func TestEOFBetweenAndInsideFrames(t *testing.T) {
+	var stream bytes.Buffer
+	for _, payload := range []string{"first", "second"} {
+		if err := WriteFrame(&stream, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := stream.Bytes()
+	firstEnd := HeaderSize + len("first")
+
+	for cut := 0; cut <= len(data); cut++ {
+		frames := NewReader(bytes.NewReader(data[:cut]))
+
+		var err error
+		for err == nil {
+			_, err = frames.ReadFrame()
+		}
+
+		between := cut == 0 || cut == firstEnd || cut == len(data)
+		switch {
+		case between && err != io.EOF:
+			t.Fatalf("cut at %d, between frames: got %v, want io.EOF", cut, err)
+		case !between && !errors.Is(err, io.ErrUnexpectedEOF):
+			t.Fatalf("cut at %d, inside a frame: got %v, want io.ErrUnexpectedEOF", cut, err)
+		}
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	if _, err := Encode(make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("Encode: got %v, want ErrFrameTooLarge", err)
+	}
+	if err := WriteFrame(io.Discard, make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("WriteFrame: got %v, want ErrFrameTooLarge", err)
+	}
+
+	// A peer announcing a huge frame is stopped before anything is allocated for it
+	header := binary.BigEndian.AppendUint32(nil, MaxFrameSize+1)
+	if _, err := NewReader(bytes.NewReader(header)).ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("ReadFrame: got %v, want ErrFrameTooLarge", err)
+	}
+	header = binary.BigEndian.AppendUint32(nil, 0xffffffff)
+	if _, err := NewReader(bytes.NewReader(header)).ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("ReadFrame: got %v, want ErrFrameTooLarge", err)
+	}
+}
@@ -0,0 +1,91 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/prompt"
+)
+
+// KeyFileEnv names the environment variable with the path of the key file that unlocks the keyring,
+// when it is not set the user is asked for a passphrase
+const KeyFileEnv = "CRYPTR_KEYRING_KEYFILE"
+
+// keySize is the size of a key file key, the same as the keys written by cryptr keygen
+const keySize = 32
+
+// DefaultPath returns $(home)/.config/cryptr.keyring, next to the client configuration.
+func DefaultPath() (string, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the current user: %w", err)
+	}
+
+	return filepath.Join(currentUser.HomeDir, ".config", "cryptr.keyring"), nil
+}
+
+// DefaultCredentials unlocks with the key file named by KeyFileEnv, or else a passphrase typed by the user.
+func DefaultCredentials() Credentials {
+	return Credentials{
+		KeyFile: os.Getenv(KeyFileEnv),
+		Passphrase: func(confirm bool) ([]byte, error) {
+			if confirm {
+				return prompt.ReadNewPassphrase("New keyring passphrase")
+			}
+			return prompt.ReadPassphrase("Keyring passphrase")
+		},
+	}
+}
+
+// WriteKeyFile writes a new random key hex encoded to path, only readable by the owner.
+// An existing file is never replaced.
+func WriteKeyFile(path string) error {
+	key, err := crypto.NewSecretBytes(keySize)
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintln(file, hex.EncodeToString(key)); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// ReadKeyFile reads a key written by WriteKeyFile or cryptr keygen.
+func ReadKeyFile(path string) (crypto.SecretBytes, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("key file %s is accessible by other users (mode %s), it must be 0600", path, info.Mode().Perm())
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(content)
+
+	key, err := hex.DecodeString(string(bytes.TrimSpace(content)))
+	if err != nil {
+		return nil, fmt.Errorf("key file is not hex encoded: %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("invalid key size: %d bytes; must be %d bytes", len(key), keySize)
+	}
+
+	return key, nil
+}
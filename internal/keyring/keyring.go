@@ -0,0 +1,451 @@
+/* Keyring - Keeps the client's keys encrypted at rest, unlocked by a passphrase or a key file. */
+package keyring
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/TP-TS-Go/internal/crypto"
+)
+
+// Keyring file layout:
+//
+//	magic "TPK" | version (1) | unlock method (1) | params size (1) | passphrase params | envelope
+//
+// The params are those of crypto.PassphraseParams.MarshalBinary, empty for key files. The envelope seals the
+// msgpack encoded entries with the unlock key, the header before it is bound as associated data.
+var keyringMagic = []byte("TPK")
+
+// KeyringVersion is the keyring format written on every change
+const KeyringVersion byte = 1
+
+// UnlockMethod is what the keyring key comes from.
+type UnlockMethod byte
+
+const (
+	// UnlockPassphrase derives the key from a passphrase with the KDF parameters stored in the header
+	UnlockPassphrase UnlockMethod = 1
+	// UnlockKeyFile reads the key from a key file, for scripts and machines without anyone to type a passphrase
+	UnlockKeyFile UnlockMethod = 2
+)
+
+// Kind says what an entry holds, names are unique per kind.
+type Kind string
+
+const (
+	// KindIdentity is an Ed25519 identity key seed, named after the server it is used with
+	KindIdentity Kind = "identity"
+	// KindSecret is the session secret agreed with a server in the handshake, named after the server
+	KindSecret Kind = "secret"
+	// KindPeer is the pinned identity public key of a peer, named after the peer ID
+	KindPeer Kind = "peer"
+	// KindVerified is the identity public key of a peer whose safety number the user checked, named after the peer ID
+	KindVerified Kind = "verified"
+	// KindRatchet is the Double Ratchet state of a direct conversation, named after the peer ID
+	KindRatchet Kind = "ratchet"
+)
+
+var (
+	// ErrNotKeyring is returned when the file does not start with the keyring magic bytes
+	ErrNotKeyring = errors.New("not a keyring file")
+	// ErrNotFound is returned when no entry has the kind and name asked for
+	ErrNotFound = errors.New("keyring entry not found")
+	// ErrExists is returned by Add when an entry with the same kind and name is already there
+	ErrExists = errors.New("keyring entry already exists")
+)
+
+// Entry is one key of the keyring.
+type Entry struct {
+	Kind      Kind               `msgpack:"kind"`
+	Name      string             `msgpack:"name"`
+	Material  crypto.SecretBytes `msgpack:"material"`
+	CreatedAt int64              `msgpack:"created_ts"`
+}
+
+type entryID struct {
+	kind Kind
+	name string
+}
+
+// Keyring is an unlocked keyring file. Every change is written back to disk before returning.
+// It is safe for concurrent use, but processes sharing the file do not see each other's changes: the last to save wins.
+type Keyring struct {
+	mu      sync.Mutex
+	path    string
+	key     crypto.SecretBytes
+	header  []byte
+	entries map[entryID]Entry
+}
+
+// contents is what the envelope of the file seals
+type contents struct {
+	Entries []Entry `msgpack:"entries"`
+}
+
+// Credentials unlock a keyring. A key file, when given, is used to create new keyrings and to open
+// those protected by one. Passphrase is only called for keyrings protected by a passphrase.
+type Credentials struct {
+	// KeyFile is the path of a key file written by WriteKeyFile (or cryptr keygen)
+	KeyFile string
+	// Passphrase asks for the passphrase, confirm is set when a new keyring is being created
+	Passphrase func(confirm bool) ([]byte, error)
+}
+
+// Load opens the keyring at path, or creates an empty one when there is no file yet.
+func Load(path string, creds Credentials) (*Keyring, error) {
+	ring, err := Open(path, creds)
+	if errors.Is(err, os.ErrNotExist) {
+		return Create(path, creds)
+	}
+	return ring, err
+}
+
+// Create writes a new empty keyring at path, locked with the key file of creds or else a passphrase.
+// An existing keyring is never replaced.
+func Create(path string, creds Credentials) (*Keyring, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("keyring %s already exists", path)
+	}
+
+	ring := &Keyring{path: path, entries: make(map[entryID]Entry)}
+
+	switch {
+	case creds.KeyFile != "":
+		key, err := ReadKeyFile(creds.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		ring.key = key
+		ring.header = marshalHeader(UnlockKeyFile, nil)
+	case creds.Passphrase != nil:
+		params, err := crypto.NewPassphraseParams(crypto.KDFArgon2id)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := params.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		passphrase, err := creds.Passphrase(true)
+		if err != nil {
+			return nil, err
+		}
+		ring.key, err = crypto.DeriveKeyFromPassphrase(passphrase, params)
+		if err != nil {
+			return nil, err
+		}
+		ring.header = marshalHeader(UnlockPassphrase, encoded)
+	default:
+		return nil, errors.New("no key file or passphrase to lock the keyring with")
+	}
+
+	if err := ring.save(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// Open reads and decrypts the keyring at path. A wrong passphrase or key file fails to authenticate the contents.
+func Open(path string, creds Credentials) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	method, params, sealed, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	header := data[:len(data)-len(sealed)]
+
+	var key crypto.SecretBytes
+	switch method {
+	case UnlockKeyFile:
+		if creds.KeyFile == "" {
+			return nil, errors.New("the keyring is locked with a key file, none was given")
+		}
+		if key, err = ReadKeyFile(creds.KeyFile); err != nil {
+			return nil, err
+		}
+	case UnlockPassphrase:
+		if creds.Passphrase == nil {
+			return nil, errors.New("the keyring is locked with a passphrase, none was given")
+		}
+		passphrase, err := creds.Passphrase(false)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = crypto.DeriveKeyFromPassphrase(passphrase, params); err != nil {
+			return nil, err
+		}
+	}
+
+	plaintext, err := crypto.DecryptWithAD(sealed, key, header)
+	if err != nil {
+		key.Destroy()
+		return nil, fmt.Errorf("failed to unlock keyring, wrong passphrase or key file: %w", err)
+	}
+	defer clear(plaintext)
+
+	var decoded contents
+	if err := msgpack.Unmarshal(plaintext, &decoded); err != nil {
+		key.Destroy()
+		return nil, fmt.Errorf("malformed keyring contents: %w", err)
+	}
+
+	ring := &Keyring{
+		path:    path,
+		key:     key,
+		header:  bytes.Clone(header),
+		entries: make(map[entryID]Entry, len(decoded.Entries)),
+	}
+	for _, entry := range decoded.Entries {
+		ring.entries[entryID{entry.Kind, entry.Name}] = entry
+	}
+
+	return ring, nil
+}
+
+// Close wipes the unlock key and the material of every entry, the keyring can not be used afterwards.
+func (k *Keyring) Close() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.key.Destroy()
+	for id, entry := range k.entries {
+		entry.Material.Destroy()
+		delete(k.entries, id)
+	}
+}
+
+// Path returns the file the keyring is saved to.
+func (k *Keyring) Path() string {
+	return k.path
+}
+
+// List returns the entries of the kind, or all of them when kind is empty, sorted by kind and name.
+func (k *Keyring) List(kind Kind) []Entry {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var entries []Entry
+	for id, entry := range k.entries {
+		if kind == "" || id.kind == kind {
+			entry.Material = entry.Material.Clone()
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// Get returns a copy of the material of an entry, for the caller to destroy.
+func (k *Keyring) Get(kind Kind, name string) (crypto.SecretBytes, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry, exists := k.entries[entryID{kind, name}]
+	if !exists {
+		return nil, false
+	}
+	return entry.Material.Clone(), true
+}
+
+// Add stores a new entry, failing with ErrExists if there is one with the same kind and name.
+func (k *Keyring) Add(kind Kind, name string, material []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, exists := k.entries[entryID{kind, name}]; exists {
+		return fmt.Errorf("%w: %s %s", ErrExists, kind, name)
+	}
+	return k.put(kind, name, material)
+}
+
+// Set stores an entry, replacing the one with the same kind and name.
+func (k *Keyring) Set(kind Kind, name string, material []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.put(kind, name, material)
+}
+
+func (k *Keyring) put(kind Kind, name string, material []byte) error {
+	if kind == "" || name == "" {
+		return errors.New("keyring entries need a kind and a name")
+	}
+
+	id := entryID{kind, name}
+	previous, existed := k.entries[id]
+
+	created := time.Now().Unix()
+	if existed {
+		created = previous.CreatedAt
+	}
+	k.entries[id] = Entry{Kind: kind, Name: name, Material: crypto.SecretBytes(material).Clone(), CreatedAt: created}
+
+	if err := k.save(); err != nil {
+		k.entries[id].Material.Destroy()
+		if existed {
+			k.entries[id] = previous
+		} else {
+			delete(k.entries, id)
+		}
+		return err
+	}
+	if existed {
+		previous.Material.Destroy()
+	}
+	return nil
+}
+
+// Remove deletes an entry.
+func (k *Keyring) Remove(kind Kind, name string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	id := entryID{kind, name}
+	previous, exists := k.entries[id]
+	if !exists {
+		return fmt.Errorf("%w: %s %s", ErrNotFound, kind, name)
+	}
+
+	delete(k.entries, id)
+	if err := k.save(); err != nil {
+		k.entries[id] = previous
+		return err
+	}
+	previous.Material.Destroy()
+	return nil
+}
+
+// Export writes the entries of the kind (all kinds when empty) and name (all names when empty) as
+// "kind name hex" lines, the material in the clear. It fails with ErrNotFound when nothing matches.
+func (k *Keyring) Export(w io.Writer, kind Kind, name string) error {
+	found := false
+	for _, entry := range k.List(kind) {
+		if name != "" && entry.Name != name {
+			continue
+		}
+		found = true
+
+		// The material is redacted when formatted, it is revealed on purpose here
+		_, err := fmt.Fprintf(w, "%s %s %s\n", entry.Kind, entry.Name, hex.EncodeToString(entry.Material))
+		entry.Material.Destroy()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// save seals the entries and replaces the file, through a temporary file so a failed write never loses the keyring
+func (k *Keyring) save() error {
+	decoded := contents{Entries: make([]Entry, 0, len(k.entries))}
+	for _, entry := range k.entries {
+		decoded.Entries = append(decoded.Entries, entry)
+	}
+
+	plaintext, err := msgpack.Marshal(&decoded)
+	if err != nil {
+		return err
+	}
+	defer clear(plaintext)
+
+	sealed, err := crypto.EncryptWithAD(plaintext, k.key, k.header)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(k.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".keyring-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(bytes.Clone(k.header), sealed...)); err != nil {
+		tmp.Close()
+		return err
+	}
+	// On disk before the rename, a crash must not replace the keyring with an empty file
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), k.path)
+}
+
+func marshalHeader(method UnlockMethod, params []byte) []byte {
+	header := make([]byte, 0, len(keyringMagic)+3+len(params))
+	header = append(header, keyringMagic...)
+	header = append(header, KeyringVersion, byte(method), byte(len(params)))
+	return append(header, params...)
+}
+
+// parseHeader splits a keyring file into its unlock method, the passphrase parameters and the sealed contents
+func parseHeader(data []byte) (UnlockMethod, crypto.PassphraseParams, []byte, error) {
+	var params crypto.PassphraseParams
+
+	fixed := len(keyringMagic) + 3
+	if len(data) < fixed || !bytes.HasPrefix(data, keyringMagic) {
+		return 0, params, nil, ErrNotKeyring
+	}
+	if data[3] != KeyringVersion {
+		return 0, params, nil, fmt.Errorf("unsupported keyring version: %d", data[3])
+	}
+
+	method := UnlockMethod(data[4])
+	paramsSize := int(data[5])
+	if len(data) < fixed+paramsSize {
+		return 0, params, nil, ErrNotKeyring
+	}
+
+	switch method {
+	case UnlockKeyFile:
+		if paramsSize != 0 {
+			return 0, params, nil, errors.New("unexpected passphrase parameters in a key file keyring")
+		}
+	case UnlockPassphrase:
+		if err := params.UnmarshalBinary(data[fixed : fixed+paramsSize]); err != nil {
+			return 0, params, nil, err
+		}
+	default:
+		return 0, params, nil, fmt.Errorf("unknown keyring unlock method: %d", method)
+	}
+
+	return method, params, data[fixed+paramsSize:], nil
+}
@@ -1,6 +1,22 @@
 package msgpacktyps
 
-import "time"
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// HandshakeInfo is the HKDF context label used to derive the per-client secret on the TCP protocol,
+// the client id is appended to it
+const HandshakeInfo = "tp-ts-go tcp v1 "
+
+// WsHandshakeInfo is the HKDF context label used by wserver and wserverc, the hex client id is appended to it
+const WsHandshakeInfo = "tp-ts-go wserver v1 "
+
+// RatchetInfo is the HKDF context label of the key exchange that starts a direct conversation,
+// the initiator and responder ids are appended to it
+const RatchetInfo = "tp-ts-go ratchet v1 "
 
 type MessageType byte
 
@@ -9,18 +25,45 @@ const (
 	SendContent             = iota
 	RequestIdResponse
 	SendContentResponse
+	// RatchetInit and RatchetAccept carry the signed key exchange that starts a direct (Target) conversation
+	RatchetInit
+	RatchetAccept
+	// RoomJoin and RoomLeave are sent by the server, the content is the id of the member that joined or left the room
+	RoomJoin
+	RoomLeave
+	// SenderKeyDistribution carries a member's room sender key, inside a direct conversation
+	SenderKeyDistribution
+	// Receipt carries the ids of direct messages the recipient got or read, back to their sender inside the conversation
+	Receipt
+	// Authenticate is sent by a client as soon as it connects, its sealed (empty) content proves the session,
+	// so the server registers the connection and hands over what was kept for the client right away
+	Authenticate
+	// AuthenticateResponse is the server's sealed answer to Authenticate, sent before what was kept for the client
+	AuthenticateResponse
+	// Rekey answers, in the clear, an Authenticate for a client the server knows but has no session with,
+	// as after a restart: the client runs the handshake again under its id (see KeyExchangeOffer)
+	Rekey
 )
 
 type Message struct {
+	// Id names the message end to end, the acks of the server and the receipts of the recipient refer to it.
+	// A message sent again keeps its id, so the recipient can tell it already got it.
+	Id       string      `msgpack:"id,omitempty"`
 	Created  int64       `msgpack:"time"`
 	SenderId string      `msgpack:"sender"`
 	Type     MessageType `msgpack:"msg_type"`
 	Target   string      `msgpack:"target"`
 	Content  []byte      `msgpack:"content"`
+	// Sequence numbers the messages of a session (one hop, client to server or server to client), see SessionAD
+	Sequence uint64 `msgpack:"seq"`
+	// SignerKey is the sender's Ed25519 identity key, Signature covers the metadata, the key and the plaintext content
+	SignerKey []byte `msgpack:"signer_key,omitempty"`
+	Signature []byte `msgpack:"signature,omitempty"`
 }
 
 func NewMessage(msgType MessageType, sender string, target string, content ...byte) Message {
 	return Message{
+		Id:       NewMessageId(),
 		Created:  time.Now().UnixMilli(),
 		Content:  content,
 		Target:   target,
@@ -28,3 +71,193 @@ func NewMessage(msgType MessageType, sender string, target string, content ...by
 		SenderId: sender,
 	}
 }
+
+// NewMessageId returns a random message id, hex encoded like the client ids
+func NewMessageId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("erro ao gerar id de mensagem: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// AssociatedData returns the message metadata that must be bound to the encrypted Content,
+// re-addressing or relabeling a message then makes its decryption fail.
+func (m Message) AssociatedData() []byte {
+	ad := make([]byte, 0, 40+len(m.Id)+len(m.SenderId)+len(m.Target))
+	ad = append(ad, "tp-ts-go msg v2"...)
+	ad = binary.BigEndian.AppendUint16(ad, uint16(len(m.Id)))
+	ad = append(ad, m.Id...)
+	ad = append(ad, byte(m.Type))
+	ad = binary.BigEndian.AppendUint64(ad, uint64(m.Created))
+	ad = binary.BigEndian.AppendUint16(ad, uint16(len(m.SenderId)))
+	ad = append(ad, m.SenderId...)
+	ad = binary.BigEndian.AppendUint16(ad, uint16(len(m.Target)))
+	ad = append(ad, m.Target...)
+	return ad
+}
+
+// SessionAD is the associated data of the session layer: the metadata and the sequence number of the hop.
+// The sequence number stays out of AssociatedData, the server renumbers the messages it relays
+// while the end to end encryption and the signatures must survive the relay.
+func (m Message) SessionAD() []byte {
+	return binary.BigEndian.AppendUint64(m.AssociatedData(), m.Sequence)
+}
+
+// SignedPayload returns the bytes the sender signs: the message metadata, the signer key and the plaintext content.
+// Signing the plaintext lets the signature survive the server decrypting and re-encrypting the content for each recipient.
+func (m Message) SignedPayload(content []byte) []byte {
+	payload := make([]byte, 0, 72+len(m.Id)+len(m.SenderId)+len(m.Target)+len(m.SignerKey)+len(content))
+	payload = append(payload, "tp-ts-go sig v1"...)
+	payload = append(payload, m.AssociatedData()...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(m.SignerKey)))
+	payload = append(payload, m.SignerKey...)
+	return append(payload, content...)
+}
+
+// KeyExchangeOffer starts the X25519 handshake, it carries the client's ephemeral public key
+// and the cipher suites it supports, most preferred first.
+// On the TCP protocol it is signed with the client's Ed25519 identity key: a new client registers IdentityKey
+// with the id it is given, a known one sets ClientId to get a new session under it and signs with the registered key.
+type KeyExchangeOffer struct {
+	PublicKey   []byte `msgpack:"public_key"`
+	Suites      []byte `msgpack:"suites"`
+	ClientId    string `msgpack:"client_id,omitempty"`
+	IdentityKey []byte `msgpack:"identity_key,omitempty"`
+	// Created bounds how long a captured offer can be sent again
+	Created   int64  `msgpack:"created,omitempty"`
+	Signature []byte `msgpack:"signature,omitempty"`
+}
+
+// SignedPayload returns the bytes the client signs: every field of the offer but the signature.
+func (o KeyExchangeOffer) SignedPayload() []byte {
+	payload := make([]byte, 0, 64+len(o.PublicKey)+len(o.Suites)+len(o.ClientId)+len(o.IdentityKey))
+	payload = append(payload, "tp-ts-go offer v1"...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(o.PublicKey)))
+	payload = append(payload, o.PublicKey...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(o.Suites)))
+	payload = append(payload, o.Suites...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(o.ClientId)))
+	payload = append(payload, o.ClientId...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(o.IdentityKey)))
+	payload = append(payload, o.IdentityKey...)
+	return binary.BigEndian.AppendUint64(payload, uint64(o.Created))
+}
+
+// KeyExchangeReply answers a KeyExchangeOffer with the id given to the client, the server's ephemeral public key
+// and the cipher suite chosen from the offer
+type KeyExchangeReply struct {
+	ClientId  string `msgpack:"client_id"`
+	PublicKey []byte `msgpack:"public_key"`
+	Suite     byte   `msgpack:"suite"`
+	// Padding is the length-hiding policy of the server, the client pads what it sends the same way
+	Padding byte `msgpack:"padding"`
+	// Signature is made with the server's long-term identity key over SignedPayload,
+	// it proves the ephemeral key comes from the server and not from someone in the middle
+	Signature []byte `msgpack:"signature"`
+}
+
+// SignedPayload returns the bytes the server signs: the whole offer it answers and every field of the reply,
+// so neither the client's nor the server's ephemeral key nor the negotiated parameters can be swapped.
+func (r KeyExchangeReply) SignedPayload(offer KeyExchangeOffer) []byte {
+	payload := make([]byte, 0, 64+len(offer.PublicKey)+len(offer.Suites)+len(r.ClientId)+len(r.PublicKey))
+	payload = append(payload, "tp-ts-go handshake v1"...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(offer.PublicKey)))
+	payload = append(payload, offer.PublicKey...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(offer.Suites)))
+	payload = append(payload, offer.Suites...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(r.ClientId)))
+	payload = append(payload, r.ClientId...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(r.PublicKey)))
+	payload = append(payload, r.PublicKey...)
+	return append(payload, r.Suite, r.Padding)
+}
+
+// ServerIdentity is the document served by wserver at /public/identity: its long-term Ed25519 public key,
+// signed with the key itself. The clients pin the key the first time they see it.
+type ServerIdentity struct {
+	PublicKey []byte `msgpack:"public_key"`
+	Created   int64  `msgpack:"created"`
+	Signature []byte `msgpack:"signature"`
+}
+
+// SignedPayload returns the bytes the server signs to prove it holds the private half of PublicKey.
+func (si ServerIdentity) SignedPayload() []byte {
+	payload := make([]byte, 0, 64+len(si.PublicKey))
+	payload = append(payload, "tp-ts-go server identity v1"...)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(si.Created))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(si.PublicKey)))
+	return append(payload, si.PublicKey...)
+}
+
+// BroadcastTarget as the Target of a message asks the TCP server to relay it to every connected client,
+// any other Target is the id of the only client that gets it
+const BroadcastTarget = "*"
+
+// DeliveryError says why the TCP server did not deliver a message
+type DeliveryError byte
+
+const (
+	// DeliveryNoTarget means the message had no Target, broadcasting must be asked with BroadcastTarget
+	DeliveryNoTarget DeliveryError = iota + 1
+	// DeliveryUnknownTarget means no client was ever registered with the Target id
+	DeliveryUnknownTarget
+	// DeliveryTargetOffline means the Target is registered but not connected, and its message could not be kept for it
+	DeliveryTargetOffline
+	// DeliveryQueueFull means the Target is offline with as many messages waiting as the server keeps
+	DeliveryQueueFull
+)
+
+func (e DeliveryError) String() string {
+	switch e {
+	case DeliveryNoTarget:
+		return "mensagem sem destino"
+	case DeliveryUnknownTarget:
+		return "destino desconhecido"
+	case DeliveryTargetOffline:
+		return "destino offline"
+	case DeliveryQueueFull:
+		return "destino offline com a fila cheia"
+	default:
+		return "erro de entrega desconhecido"
+	}
+}
+
+// SendResponse is the content of the SendContentResponse the server sends back for every message it is sent:
+// the ack of a message it relayed or kept, or why it could not deliver it
+type SendResponse struct {
+	MessageId string `msgpack:"message_id"`
+	Target    string `msgpack:"target"`
+	Created   int64  `msgpack:"created"`
+	// Queued is set when the target was offline and the server kept the message until it connects
+	Queued bool `msgpack:"queued"`
+	// Reason is why the message was not delivered, zero when the server accepted it
+	Reason DeliveryError `msgpack:"reason"`
+}
+
+// Accepted reports whether the server relayed or kept the message
+func (r SendResponse) Accepted() bool {
+	return r.Reason == 0
+}
+
+// ReceiptState is how far direct messages got on the recipient's side
+type ReceiptState byte
+
+const (
+	// ReceiptDelivered means the recipient's client got and decrypted the messages
+	ReceiptDelivered ReceiptState = iota + 1
+	// ReceiptRead means the messages were shown to the recipient
+	ReceiptRead
+)
+
+// ReceiptContent is the plaintext of a Receipt, only the sender's peer can write it, the server only relays it
+type ReceiptContent struct {
+	MessageIds []string     `msgpack:"message_ids"`
+	State      ReceiptState `msgpack:"state"`
+}
+
+// RatchetHandshake is the content of RatchetInit and RatchetAccept, an ephemeral X25519 public key
+// signed with the sender's identity key
+type RatchetHandshake struct {
+	PublicKey []byte `msgpack:"public_key"`
+}
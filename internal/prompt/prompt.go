@@ -0,0 +1,80 @@
+/* Prompt - Reads secrets typed by the user, without echoing them when stdin is a terminal. */
+package prompt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+var (
+	stdinOnce   sync.Once
+	stdinReader *bufio.Reader
+)
+
+// stdin returns a single buffered reader over os.Stdin, so consecutive reads do not lose buffered input
+func stdin() *bufio.Reader {
+	stdinOnce.Do(func() {
+		stdinReader = bufio.NewReader(os.Stdin)
+	})
+	return stdinReader
+}
+
+// IsTerminal reports whether stdin is attached to a terminal
+func IsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// ReadPassphrase asks for a passphrase with label. On a terminal the input is not echoed,
+// otherwise (pipes, scripts) one line is read from stdin.
+func ReadPassphrase(label string) ([]byte, error) {
+	var passphrase []byte
+
+	if IsTerminal() {
+		fmt.Fprintf(os.Stderr, "%s: ", label)
+		read, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		passphrase = read
+	} else {
+		line, err := stdin().ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			return nil, fmt.Errorf("failed to read passphrase from stdin: %w", err)
+		}
+		passphrase = bytes.TrimRight(line, "\r\n")
+	}
+
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+// ReadNewPassphrase asks for a new passphrase, on a terminal it must be typed twice to catch typos.
+func ReadNewPassphrase(label string) ([]byte, error) {
+	passphrase, err := ReadPassphrase(label)
+	if err != nil {
+		return nil, err
+	}
+
+	if !IsTerminal() {
+		return passphrase, nil
+	}
+
+	confirmation, err := ReadPassphrase("Confirm " + label)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, confirmation) {
+		return nil, errors.New("passphrases do not match")
+	}
+
+	return passphrase, nil
+}
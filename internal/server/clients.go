@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrUnknownClient is returned for an id that was never registered
+var ErrUnknownClient = errors.New("cliente desconhecido")
+
+// ClientRegistry keeps, for every id the server gave, the Ed25519 identity key the client registered with it.
+// It is what survives a restart: the sessions only live in memory, a returning client proves it owns its id
+// with a handshake signed by that key and gets a new session under it. Only public keys are written,
+// one <id>.key file each. It is safe for concurrent use, every file is written once.
+type ClientRegistry struct {
+	dir string
+}
+
+// NewClientRegistry keeps the identity keys in dir, created if needed.
+func NewClientRegistry(dir string) (*ClientRegistry, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &ClientRegistry{dir: dir}, nil
+}
+
+// Register binds the identity key to a new id, an id already registered keeps its key.
+func (r *ClientRegistry) Register(clientId string, identityKey []byte) error {
+	if !validMailboxName(clientId) {
+		return fmt.Errorf("id de cliente invalido: %q", clientId)
+	}
+	if len(identityKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("chave de identidade invalida: %d bytes", len(identityKey))
+	}
+
+	tmp, err := os.CreateTemp(r.dir, ".key-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(identityKey); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// A link fails when the name exists, unlike a rename, and is never seen half written
+	if err := os.Link(tmp.Name(), r.path(clientId)); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("cliente %s ja registado", clientId)
+		}
+		return err
+	}
+	return nil
+}
+
+// IdentityKey returns the key registered with the id, ErrUnknownClient when there is none.
+func (r *ClientRegistry) IdentityKey(clientId string) ([]byte, error) {
+	if !validMailboxName(clientId) {
+		return nil, ErrUnknownClient
+	}
+
+	key, err := os.ReadFile(r.path(clientId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrUnknownClient
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("chave de identidade de %s corrompida", clientId)
+	}
+	return key, nil
+}
+
+// Known reports whether the id was registered, even when its client has no session since the server started.
+func (r *ClientRegistry) Known(clientId string) bool {
+	_, err := r.IdentityKey(clientId)
+	return err == nil
+}
+
+func (r *ClientRegistry) path(clientId string) string {
+	return filepath.Join(r.dir, clientId+".key")
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+func TestClientRegistrySurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, ed25519.PublicKeySize)
+
+	clients, err := NewClientRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clients.Register(testRecipient, key); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// A new registry on the same directory is the server after a restart
+	restarted, err := NewClientRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := restarted.IdentityKey(testRecipient)
+	if err != nil {
+		t.Fatalf("identity key after restart: %v", err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Fatalf("got key %x, want %x", got, key)
+	}
+	if !restarted.Known(testRecipient) {
+		t.Fatal("registered client unknown after restart")
+	}
+}
+
+func TestClientRegistryKeepsFirstKey(t *testing.T) {
+	clients, err := NewClientRegistry(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := bytes.Repeat([]byte{1}, ed25519.PublicKeySize)
+	if err := clients.Register(testRecipient, first); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := clients.Register(testRecipient, bytes.Repeat([]byte{2}, ed25519.PublicKeySize)); err == nil {
+		t.Fatal("an id was registered twice")
+	}
+
+	if got, _ := clients.IdentityKey(testRecipient); !bytes.Equal(got, first) {
+		t.Fatalf("registered key replaced, got %x", got)
+	}
+}
+
+func TestClientRegistryRejects(t *testing.T) {
+	clients, err := NewClientRegistry(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clients.IdentityKey(testRecipient); !errors.Is(err, ErrUnknownClient) {
+		t.Fatalf("unregistered id: got %v, want %v", err, ErrUnknownClient)
+	}
+	if err := clients.Register("../escape", bytes.Repeat([]byte{1}, ed25519.PublicKeySize)); err == nil {
+		t.Fatal("registered an id outside the directory")
+	}
+	if err := clients.Register(testRecipient, []byte("short")); err == nil {
+		t.Fatal("registered a key of the wrong size")
+	}
+	if clients.Known(testRecipient) {
+		t.Fatal("a rejected registration left the id known")
+	}
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	crypto "github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/framing"
+)
+
+const (
+	// outboundQueueSize bounds the messages waiting to be written to one connection
+	outboundQueueSize = 64
+	// writeTimeout bounds a single write, a client that stops reading is dropped instead of holding its writer forever
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrConnectionClosed is returned when writing to a connection that was closed
+	ErrConnectionClosed = errors.New("conexao fechada")
+	// ErrQueueFull is returned when a client does not read fast enough, its connection is then closed
+	ErrQueueFull = errors.New("fila de saida cheia, cliente demasiado lento")
+)
+
+// Connection is an accepted client connection. Everything written to it goes through its own writer goroutine
+// and a bounded queue, so a slow client only ever delays itself.
+type Connection struct {
+	conn      net.Conn
+	outbound  chan outboundFrame
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// outboundFrame is a frame waiting for the writer goroutine, the result of its write goes to written when it is set
+type outboundFrame struct {
+	data    []byte
+	written chan error
+}
+
+// NewConnection wraps conn and starts its writer goroutine, Close stops it.
+func NewConnection(conn net.Conn) *Connection {
+	c := &Connection{
+		conn:     conn,
+		outbound: make(chan outboundFrame, outboundQueueSize),
+		closed:   make(chan struct{}),
+	}
+
+	go c.writeLoop()
+	return c
+}
+
+// Send queues the payload to be written as one frame without waiting for it. When the queue is full the connection is closed.
+func (c *Connection) Send(payload []byte) error {
+	select {
+	case <-c.closed:
+		return ErrConnectionClosed
+	default:
+	}
+
+	frame, err := framing.Encode(payload)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case c.outbound <- outboundFrame{data: frame}:
+		return nil
+	default:
+		c.Close()
+		return ErrQueueFull
+	}
+}
+
+// SendWritten queues the payload like Send, but waits up to timeout for room in the queue instead of closing the connection,
+// and then for the writer goroutine to write it. It is for what must not be dropped before it left, such as the
+// messages that waited for the client while it was offline: an error means the frame may not have been written.
+func (c *Connection) SendWritten(payload []byte, timeout time.Duration) error {
+	frame, err := framing.Encode(payload)
+	if err != nil {
+		return err
+	}
+
+	written := make(chan error, 1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case c.outbound <- outboundFrame{data: frame, written: written}:
+	case <-c.closed:
+		return ErrConnectionClosed
+	case <-timer.C:
+		return ErrQueueFull
+	}
+
+	// The write itself is bounded by writeTimeout
+	select {
+	case err := <-written:
+		return err
+	case <-c.closed:
+		// The frame may have been written just before the connection closed
+		select {
+		case err := <-written:
+			return err
+		default:
+			return ErrConnectionClosed
+		}
+	}
+}
+
+// Close closes the connection, which also ends the reads waiting on it. It is safe to call more than once.
+func (c *Connection) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// writeLoop writes the queued data in order until the connection is closed or a write fails
+func (c *Connection) writeLoop() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case frame := <-c.outbound:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err := c.conn.Write(frame.data)
+			if frame.written != nil {
+				frame.written <- err
+			}
+			if err != nil {
+				log.Printf("erro ao escrever para %s: %s", c.conn.RemoteAddr(), err.Error())
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// Hub keeps the session of every registered client and the connection each one is currently on.
+// It is safe for concurrent use, every connection goroutine goes through it.
+type Hub struct {
+	mu          sync.RWMutex
+	sessions    map[string]*crypto.Session
+	connections map[string]*Connection
+}
+
+// NewHub returns an empty hub.
+func NewHub() *Hub {
+	return &Hub{
+		sessions:    make(map[string]*crypto.Session),
+		connections: make(map[string]*Connection),
+	}
+}
+
+// AddSession keeps the session prepared from the client's handshake.
+func (h *Hub) AddSession(clientId string, session *crypto.Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sessions[clientId] = session
+}
+
+// Session returns the session of the client.
+func (h *Hub) Session(clientId string) (*crypto.Session, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	session, ok := h.sessions[clientId]
+	return session, ok
+}
+
+// Register makes conn the client's current connection, a reconnecting client must not be left on its old one.
+func (h *Hub) Register(clientId string, conn *Connection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.connections[clientId] = conn
+}
+
+// Unregister forgets the client's connection, unless the client already moved to another one.
+func (h *Hub) Unregister(clientId string, conn *Connection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.connections[clientId] == conn {
+		delete(h.connections, clientId)
+	}
+}
+
+// UnregisterConnection forgets conn for every client it was registered for, once it is closed.
+func (h *Hub) UnregisterConnection(conn *Connection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for clientId, current := range h.connections {
+		if current == conn {
+			delete(h.connections, clientId)
+		}
+	}
+}
+
+// Lookup returns the current connection of the client.
+func (h *Hub) Lookup(clientId string) (*Connection, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	conn, ok := h.connections[clientId]
+	return conn, ok
+}
+
+// Connected returns a snapshot of the connected clients, to be walked without holding the hub.
+func (h *Hub) Connected() map[string]*Connection {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	out := make(map[string]*Connection, len(h.connections))
+	for clientId, conn := range h.connections {
+		out[clientId] = conn
+	}
+	return out
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TP-TS-Go/internal/framing"
+)
+
+// newStalledConnection returns a connection whose writer goroutine is not running, its queue of size frames fills and stays full
+func newStalledConnection(t *testing.T, size int) (*Connection, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	c := &Connection{
+		conn:     server,
+		outbound: make(chan outboundFrame, size),
+		closed:   make(chan struct{}),
+	}
+	t.Cleanup(c.Close)
+	return c, client
+}
+
+func expectClosed(t *testing.T, c *Connection) {
+	t.Helper()
+
+	select {
+	case <-c.closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestHubConcurrentUse(t *testing.T) {
+	hub := NewHub()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		clientId := fmt.Sprintf("client%d", i%4)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range 200 {
+				conn := &Connection{}
+				hub.Register(clientId, conn)
+				hub.Lookup(clientId)
+				for range hub.Connected() {
+				}
+				hub.Unregister(clientId, conn)
+				hub.UnregisterConnection(conn)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if connected := hub.Connected(); len(connected) != 0 {
+		t.Fatalf("%d clients still registered after every connection was unregistered", len(connected))
+	}
+}
+
+func TestHubUnregisterKeepsNewerConnection(t *testing.T) {
+	hub := NewHub()
+	old, current := &Connection{}, &Connection{}
+
+	hub.Register(testRecipient, old)
+	hub.Register(testRecipient, current)
+	hub.Unregister(testRecipient, old)
+	hub.UnregisterConnection(old)
+
+	if conn, ok := hub.Lookup(testRecipient); !ok || conn != current {
+		t.Fatal("unregistering the old connection dropped the client's current one")
+	}
+}
+
+func TestSendFullQueueClosesConnection(t *testing.T) {
+	c, _ := newStalledConnection(t, 1)
+
+	if err := c.Send([]byte("first")); err != nil {
+		t.Fatalf("send into an empty queue: %v", err)
+	}
+	if err := c.Send([]byte("second")); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("send into a full queue: got %v, want %v", err, ErrQueueFull)
+	}
+	expectClosed(t, c)
+
+	if err := c.Send([]byte("third")); !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("send after close: got %v, want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestSendWrittenTimeoutKeepsConnection(t *testing.T) {
+	c, _ := newStalledConnection(t, 1)
+
+	if err := c.Send([]byte("first")); err != nil {
+		t.Fatalf("send into an empty queue: %v", err)
+	}
+
+	start := time.Now()
+	if err := c.SendWritten([]byte("second"), 50*time.Millisecond); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("send written into a full queue: got %v, want %v", err, ErrQueueFull)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("gave up after %s, before the timeout", waited)
+	}
+
+	// Unlike Send, waiting for room does not drop the client
+	select {
+	case <-c.closed:
+		t.Fatal("a send written timeout closed the connection")
+	default:
+	}
+}
+
+func TestSendWrittenWaitsForWrite(t *testing.T) {
+	server, client := net.Pipe()
+	c := NewConnection(server)
+	defer c.Close()
+
+	read := make(chan []byte, 1)
+	go func() {
+		defer client.Close()
+
+		payload, err := framing.NewReader(client).ReadFrame()
+		if err != nil {
+			t.Errorf("read frame: %v", err)
+		}
+		read <- payload
+	}()
+
+	if err := c.SendWritten([]byte("queued"), time.Second); err != nil {
+		t.Fatalf("send written: %v", err)
+	}
+
+	// It only returns once the frame left, the reader already has it
+	select {
+	case payload := <-read:
+		if string(payload) != "queued" {
+			t.Fatalf("got %q, want %q", payload, "queued")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("frame not read after send written returned")
+	}
+}
+
+func TestSendWrittenConnectionClosed(t *testing.T) {
+	// Nobody reads the other end, the write blocks until the connection is closed
+	server, client := net.Pipe()
+	defer client.Close()
+	c := NewConnection(server)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SendWritten([]byte("never read"), time.Second)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("send written reported a frame nobody read as written")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send written still waiting after the connection was closed")
+	}
+
+	if err := c.SendWritten([]byte("after close"), time.Second); !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("send written after close: got %v, want %v", err, ErrConnectionClosed)
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	msgpack "github.com/vmihailenco/msgpack/v5"
+
+	"github.com/TP-TS-Go/internal/framing"
+	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
+)
+
+// ErrQuotaExceeded is returned when a recipient already has as many messages waiting as the quota allows
+var ErrQuotaExceeded = errors.New("quota de mensagens em espera excedida")
+
+// storedMessage is one record of a mailbox: the message as the sender wrote it, with the content already out of
+// the sender's session. Only direct messages are queued, their content is still end to end encrypted (or a signed
+// ratchet handshake), so the server never writes anything it could read itself.
+type storedMessage struct {
+	Stored  int64               `msgpack:"stored"`
+	Message msgpacktyps.Message `msgpack:"message"`
+	Content []byte              `msgpack:"content"`
+}
+
+// mailbox is the file of the messages waiting for one recipient, one length prefixed msgpack record each,
+// appended in the order they arrived
+type mailbox struct {
+	mu     sync.Mutex
+	path   string
+	loaded bool
+	// count is the number of records in the file, expired ones included until the file is rewritten
+	count int
+}
+
+// OfflineQueue holds the messages of the clients that are not connected until they come back (store and forward).
+// Each recipient has its own append-only file in the queue directory, no database is needed.
+// Messages older than the TTL are dropped, and a recipient never has more than the quota waiting.
+// It is safe for concurrent use.
+type OfflineQueue struct {
+	dir   string
+	ttl   time.Duration
+	quota int
+
+	mu        sync.Mutex
+	mailboxes map[string]*mailbox
+}
+
+// NewOfflineQueue keeps the mailboxes in dir, created if needed.
+func NewOfflineQueue(dir string, ttl time.Duration, quota int) (*OfflineQueue, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("TTL da fila invalido: %s", ttl)
+	}
+	if quota <= 0 {
+		return nil, fmt.Errorf("quota da fila invalida: %d", quota)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &OfflineQueue{
+		dir:       dir,
+		ttl:       ttl,
+		quota:     quota,
+		mailboxes: make(map[string]*mailbox),
+	}, nil
+}
+
+// mailbox returns the recipient's mailbox, the ids are the hex ids given by the server
+func (q *OfflineQueue) mailbox(recipient string) (*mailbox, error) {
+	if !validMailboxName(recipient) {
+		return nil, fmt.Errorf("id de destino invalido: %q", recipient)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	box, exists := q.mailboxes[recipient]
+	if !exists {
+		box = &mailbox{path: filepath.Join(q.dir, recipient+".queue")}
+		q.mailboxes[recipient] = box
+	}
+	return box, nil
+}
+
+// Enqueue appends the message to the recipient's mailbox, synced to disk before returning.
+func (q *OfflineQueue) Enqueue(recipient string, msg msgpacktyps.Message, content []byte) error {
+	box, err := q.mailbox(recipient)
+	if err != nil {
+		return err
+	}
+
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	if err := q.load(box); err != nil {
+		return err
+	}
+	// Expired messages still count until the file is rewritten, make room before refusing
+	if box.count >= q.quota {
+		if err := q.compact(box); err != nil {
+			return err
+		}
+	}
+	if box.count >= q.quota {
+		return fmt.Errorf("%w: %d mensagens para %s", ErrQuotaExceeded, box.count, recipient)
+	}
+
+	record, err := msgpack.Marshal(&storedMessage{
+		Stored:  time.Now().UnixMilli(),
+		Message: msg,
+		Content: content,
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(box.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := framing.WriteFrame(file, record); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	box.count++
+	return file.Close()
+}
+
+// Deliver hands the unexpired messages of the recipient to send, oldest first, and drops them from the mailbox.
+// send must only return once the message is out: it stops at the first error of send, and what was not
+// delivered, the failed message included, stays queued for the next time.
+func (q *OfflineQueue) Deliver(recipient string, send func(msg msgpacktyps.Message, content []byte) error) (int, error) {
+	box, err := q.mailbox(recipient)
+	if err != nil {
+		return 0, err
+	}
+
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	if err := q.load(box); err != nil || box.count == 0 {
+		return 0, err
+	}
+
+	records, err := q.readLive(box)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, record := range records {
+		if err := send(record.Message, record.Content); err != nil {
+			// Keep the rest, in order, for the next connection of the recipient
+			if rewriteErr := q.rewrite(box, records[delivered:]); rewriteErr != nil {
+				return delivered, rewriteErr
+			}
+			return delivered, err
+		}
+		delivered++
+	}
+
+	return delivered, q.rewrite(box, nil)
+}
+
+// load counts the records of the mailbox file the first time the mailbox is used.
+// A record cut by a crash is cut off the file, or the records appended after it could not be read.
+func (q *OfflineQueue) load(box *mailbox) error {
+	if box.loaded {
+		return nil
+	}
+
+	records, torn, err := readMailbox(box.path)
+	if err != nil {
+		return err
+	}
+	if torn {
+		log.Printf("registo incompleto no fim de %s descartado", box.path)
+		if err := q.rewrite(box, records); err != nil {
+			return err
+		}
+	}
+
+	box.count = len(records)
+	box.loaded = true
+	return nil
+}
+
+// compact rewrites the mailbox without its expired messages
+func (q *OfflineQueue) compact(box *mailbox) error {
+	records, err := q.readLive(box)
+	if err != nil {
+		return err
+	}
+	return q.rewrite(box, records)
+}
+
+// readLive returns the records of the mailbox that did not expire
+func (q *OfflineQueue) readLive(box *mailbox) ([]storedMessage, error) {
+	records, _, err := readMailbox(box.path)
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := time.Now().Add(-q.ttl).UnixMilli()
+	live := records[:0]
+	for _, record := range records {
+		if record.Stored >= expiry {
+			live = append(live, record)
+		}
+	}
+	if dropped := len(records) - len(live); dropped > 0 {
+		log.Printf("%d mensagens expiradas descartadas de %s", dropped, filepath.Base(box.path))
+	}
+	return live, nil
+}
+
+// rewrite replaces the mailbox file with the records, through a temporary file so a crash never loses the queue.
+// An empty mailbox has no file.
+func (q *OfflineQueue) rewrite(box *mailbox, records []storedMessage) error {
+	if len(records) == 0 {
+		box.count = 0
+		if err := os.Remove(box.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(q.dir, ".queue-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for _, record := range records {
+		data, err := msgpack.Marshal(&record)
+		if err == nil {
+			err = framing.WriteFrame(writer, data)
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), box.path); err != nil {
+		return err
+	}
+	box.count = len(records)
+	return nil
+}
+
+// readMailbox reads every record of a mailbox file. A record cut by a crash in the middle of an append
+// ends the file, the records before it are kept and torn is set.
+func readMailbox(path string) (records []storedMessage, torn bool, err error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	frames := framing.NewReader(bufio.NewReader(file))
+	for {
+		frame, err := frames.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			return records, false, nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return records, true, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		var record storedMessage
+		if err := msgpack.Unmarshal(frame, &record); err != nil {
+			return nil, false, fmt.Errorf("%s: registo invalido: %w", path, err)
+		}
+		records = append(records, record)
+	}
+}
+
+// validMailboxName accepts the lowercase hex ids the server gives, nothing that could leave the queue directory
+func validMailboxName(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
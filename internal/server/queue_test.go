@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
+)
+
+const testRecipient = "0123456789abcdef"
+
+func newTestQueue(t *testing.T, dir string, quota int) *OfflineQueue {
+	t.Helper()
+
+	q, err := NewOfflineQueue(dir, time.Hour, quota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func enqueue(t *testing.T, q *OfflineQueue, contents ...string) {
+	t.Helper()
+
+	for _, content := range contents {
+		msg := msgpacktyps.NewMessage(msgpacktyps.SendContent, "fedcba9876543210", testRecipient)
+		if err := q.Enqueue(testRecipient, msg, []byte(content)); err != nil {
+			t.Fatalf("enqueue %q: %v", content, err)
+		}
+	}
+}
+
+// deliverAll returns the contents delivered, in order, failing the send of the message at failAt (counted from 0, -1 never)
+func deliverAll(t *testing.T, q *OfflineQueue, failAt int) ([]string, error) {
+	t.Helper()
+
+	var got []string
+	_, err := q.Deliver(testRecipient, func(msg msgpacktyps.Message, content []byte) error {
+		if len(got) == failAt {
+			return ErrConnectionClosed
+		}
+		got = append(got, string(content))
+		return nil
+	})
+	return got, err
+}
+
+func expectContents(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestQueueDeliverInOrder(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir, 10)
+
+	enqueue(t, q, "one", "two", "three")
+
+	got, err := deliverAll(t, q, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContents(t, got, "one", "two", "three")
+
+	// An empty mailbox has no file, and nothing is delivered twice
+	if _, err := os.Stat(filepath.Join(dir, testRecipient+".queue")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("mailbox file left after delivery: %v", err)
+	}
+	got, err = deliverAll(t, q, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContents(t, got)
+}
+
+func TestQueueDeliverPartialFailure(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir, 4)
+
+	enqueue(t, q, "one", "two", "three", "four")
+
+	got, err := deliverAll(t, q, 2)
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("got %v, want the error of send", err)
+	}
+	expectContents(t, got, "one", "two")
+
+	// The failed message and the ones after it are kept in order, and the room of the delivered ones is free again
+	enqueue(t, q, "five", "six")
+	got, err = deliverAll(t, q, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContents(t, got, "three", "four", "five", "six")
+
+	// The rewrite is on disk, not only in memory
+	enqueue(t, q, "seven")
+	if _, err := deliverAll(t, q, 0); !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("got %v, want the error of send", err)
+	}
+	got, err = deliverAll(t, newTestQueue(t, dir, 4), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContents(t, got, "seven")
+}
+
+func TestQueueTornTail(t *testing.T) {
+	dir := t.TempDir()
+	enqueue(t, newTestQueue(t, dir, 10), "one", "two")
+
+	// A crash in the middle of an append: a frame header announcing more than what follows it
+	path := filepath.Join(dir, testRecipient+".queue")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte{0, 0, 0, 100, 0x85, 0xa6}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	records, torn, err := readMailbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !torn || len(records) != 2 {
+		t.Fatalf("got %d records, torn %t, want 2 records and torn", len(records), torn)
+	}
+
+	// After a restart the torn record is cut off, the records appended after it are readable
+	q := newTestQueue(t, dir, 10)
+	enqueue(t, q, "three")
+	if _, torn, err := readMailbox(path); err != nil || torn {
+		t.Fatalf("mailbox still torn after load: torn %t, %v", torn, err)
+	}
+
+	got, err := deliverAll(t, q, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContents(t, got, "one", "two", "three")
+}
+
+func TestQueueQuotaAndExpiry(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir, 3)
+
+	enqueue(t, q, "one", "two", "three")
+	msg := msgpacktyps.NewMessage(msgpacktyps.SendContent, "fedcba9876543210", testRecipient)
+	if err := q.Enqueue(testRecipient, msg, []byte("four")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("got %v, want ErrQuotaExceeded", err)
+	}
+
+	// Age the first two past the TTL, they still fill the file until it is compacted
+	path := filepath.Join(dir, testRecipient+".queue")
+	records, _, err := readMailbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-2 * time.Hour).UnixMilli()
+	records[0].Stored, records[1].Stored = expired, expired
+	box, err := q.mailbox(testRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.rewrite(box, records); err != nil {
+		t.Fatal(err)
+	}
+
+	// A full mailbox is compacted before a message is refused
+	enqueue(t, q, "four", "five")
+	if err := q.Enqueue(testRecipient, msg, []byte("six")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("got %v, want ErrQuotaExceeded", err)
+	}
+
+	got, err := deliverAll(t, q, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContents(t, got, "three", "four", "five")
+}
+
+func TestQueueRejectsBadNames(t *testing.T) {
+	q := newTestQueue(t, t.TempDir(), 10)
+	msg := msgpacktyps.NewMessage(msgpacktyps.SendContent, "fedcba9876543210", "")
+
+	for _, recipient := range []string{"", "../0123", "0123/4567", "ABCDEF", "0123.queue"} {
+		if err := q.Enqueue(recipient, msg, []byte("content")); err == nil {
+			t.Errorf("message queued for %q", recipient)
+		}
+		if _, err := q.Deliver(recipient, func(msgpacktyps.Message, []byte) error { return nil }); err == nil {
+			t.Errorf("mailbox of %q delivered", recipient)
+		}
+	}
+}
+
+func TestNewOfflineQueueLimits(t *testing.T) {
+	if _, err := NewOfflineQueue(t.TempDir(), 0, 10); err == nil {
+		t.Error("queue without TTL created")
+	}
+	if _, err := NewOfflineQueue(t.TempDir(), time.Hour, 0); err == nil {
+		t.Error("queue without quota created")
+	}
+}
@@ -8,86 +8,325 @@ import (
 	"io"
 	"log"
 	"net"
-	"strconv"
-	"strings"
 	"time"
 
 	msgpack "github.com/vmihailenco/msgpack/v5"
 
 	crypto "github.com/TP-TS-Go/internal/crypto"
+	"github.com/TP-TS-Go/internal/framing"
 	msgpacktyps "github.com/TP-TS-Go/internal/msgpack_typs"
 )
 
+// offerMaxAge bounds how old the signed offer of a known client may be, a captured one can not replace its session later
+const offerMaxAge = 2 * time.Minute
+
 type ServerState struct {
-	rawMaterial []byte
+	// padding hides the length of the messages sent to the clients
+	padding crypto.PaddingPolicy
+	// hub keeps the sessions and the connections of the clients, shared by every connection goroutine
+	hub *Hub
+	// queue keeps the direct messages of the clients that are offline until they come back
+	queue *OfflineQueue
+	// clients keeps the identity key of every id given, the sessions do not outlive the server but the ids do
+	clients *ClientRegistry
 }
 
-// RegisterNewClient - Returns a new cryptographicly seccure generated ID,
-// after adding the new client id to the server state, and raw material to build a secret.
-func (ss *ServerState) RegisterNewClient(connection net.Conn) (string, string) {
-	b := make([]byte, 16)
-	_, err := rand.Read(b)
+// RegisterNewClient - Returns a new cryptographicly seccure generated ID, and the server half of the X25519 handshake.
+// The secret derived from the client's public key is stored in the server state, it never travels on the connection.
+// A known client, after a restart of the server, gets a new session under the id it already has.
+func (ss *ServerState) RegisterNewClient(connection net.Conn, offer msgpacktyps.KeyExchangeOffer) (msgpacktyps.KeyExchangeReply, error) {
+	clientId, isNew, err := ss.clientIdFor(offer)
+	if err != nil {
+		return msgpacktyps.KeyExchangeReply{}, err
+	}
+
+	kx, err := crypto.NewKeyExchange()
 	if err != nil {
-		log.Fatalf("erro ao tentar gerar id: %s", err.Error())
+		return msgpacktyps.KeyExchangeReply{}, fmt.Errorf("erro ao gerar chave efemera: %s", err.Error())
+	}
+
+	suite, err := crypto.NegotiateSuite(crypto.SuitesFromBytes(offer.Suites))
+	if err != nil {
+		return msgpacktyps.KeyExchangeReply{}, fmt.Errorf("erro ao negociar a cipher suite: %s", err.Error())
+	}
+
+	secret, err := kx.DeriveSecret(offer.PublicKey, []byte(msgpacktyps.HandshakeInfo+clientId))
+	if err != nil {
+		return msgpacktyps.KeyExchangeReply{}, fmt.Errorf("erro ao derivar o secret: %s", err.Error())
+	}
+	// Only the session's AEAD needs the key from now on
+	defer secret.Destroy()
+
+	session, err := crypto.NewSession(suite.ID(), secret)
+	if err != nil {
+		return msgpacktyps.KeyExchangeReply{}, fmt.Errorf("erro ao preparar a sessao: %s", err.Error())
+	}
+	if err := session.SetPadding(ss.padding); err != nil {
+		return msgpacktyps.KeyExchangeReply{}, fmt.Errorf("erro ao preparar a sessao: %s", err.Error())
+	}
+
+	if isNew {
+		if err := ss.clients.Register(clientId, offer.IdentityKey); err != nil {
+			return msgpacktyps.KeyExchangeReply{}, fmt.Errorf("erro ao registar o cliente: %s", err.Error())
+		}
 	}
 
-	clientId := fmt.Sprintf("%x", b)
+	ss.hub.AddSession(clientId, session)
+	log.Printf("Cliente %s usa %s", clientId, suite.Name())
 
-	return clientId, fmt.Sprintf("%x", ss.rawMaterial)
+	return msgpacktyps.KeyExchangeReply{
+		ClientId:  clientId,
+		PublicKey: kx.PublicKey(),
+		Suite:     byte(suite.ID()),
+		Padding:   byte(ss.padding),
+	}, nil
 }
 
-func NewServerState() *ServerState {
-	s, err := crypto.GenerateRawRandomBytes()
+// clientIdFor checks the signature of the offer. A new client gets a new id, bound to the key it signed with once
+// the handshake succeeds, a known one must sign with the key registered with its id.
+func (ss *ServerState) clientIdFor(offer msgpacktyps.KeyExchangeOffer) (clientId string, isNew bool, err error) {
+	if offer.ClientId == "" {
+		if err := crypto.VerifySignature(offer.IdentityKey, offer.SignedPayload(), offer.Signature); err != nil {
+			return "", false, fmt.Errorf("oferta sem assinatura valida: %s", err.Error())
+		}
+
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatalf("erro ao tentar gerar id: %s", err.Error())
+		}
+		return fmt.Sprintf("%x", b), true, nil
+	}
+
+	identityKey, err := ss.clients.IdentityKey(offer.ClientId)
 	if err != nil {
-		log.Fatalf("erro ao tentar gerar secret raw material: %s", err.Error())
+		return "", false, fmt.Errorf("novo handshake de %s recusado: %s", offer.ClientId, err.Error())
+	}
+	if age := time.Since(time.UnixMilli(offer.Created)); age > offerMaxAge || age < -offerMaxAge {
+		return "", false, fmt.Errorf("novo handshake de %s recusado: oferta com %s", offer.ClientId, age.Round(time.Second))
 	}
+	if err := crypto.VerifySignature(identityKey, offer.SignedPayload(), offer.Signature); err != nil {
+		return "", false, fmt.Errorf("novo handshake de %s recusado: %s", offer.ClientId, err.Error())
+	}
+	return offer.ClientId, false, nil
+}
+
+func NewServerState(padding crypto.PaddingPolicy, queue *OfflineQueue, clients *ClientRegistry) *ServerState {
+	return &ServerState{padding: padding, hub: NewHub(), queue: queue, clients: clients}
+}
 
-	return &ServerState{
-		rawMaterial: s,
+// known reports whether the id was given to a client, connected or not, with a session or still to re-key after a restart
+func (ss *ServerState) known(clientId string) bool {
+	if _, known := ss.hub.Session(clientId); known {
+		return true
 	}
+	return ss.clients.Known(clientId)
 }
 
-var (
-	connections        = make(map[string]net.Conn)
-	connectionsSecrets = make(map[string][]byte)
-)
+// sealFor re-encrypts the content for the target with its session, bound to the same metadata, and encodes the message
+func (ss *ServerState) sealFor(msg msgpacktyps.Message, content []byte, targetId string) ([]byte, error) {
+	targetSession, known := ss.hub.Session(targetId)
+	if !known {
+		return nil, fmt.Errorf("cliente %s sem sessao", targetId)
+	}
 
-func HandleNewConnection(con net.Conn, serverState *ServerState) {
-	log.Printf("New Connection!")
+	var err error
+	msg.Sequence = targetSession.NextSequence()
+	msg.Content, err = targetSession.Seal(content, msg.SessionAD())
+	if err != nil {
+		return nil, fmt.Errorf("erro ao encriptar mensagem: %s", err.Error())
+	}
+	if targetSession.NeedsRekey() {
+		log.Printf("[WARN] a chave do cliente %s esta perto do limite de uso, e preciso novo handshake", targetId)
+	}
 
-	buf := bufio.NewReader(con)
-	var decoder *msgpack.Decoder
+	data, err := msgpack.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao encodificar mensagem: %s", err.Error())
+	}
+	return data, nil
+}
 
-	for {
-		decoder = msgpack.NewDecoder(buf)
-		log.Printf("RECEIVED SOME DATA")
+// relay queues the message, sealed for the target, on the target's connection.
+// A connection that can not take it anymore is unregistered.
+func (ss *ServerState) relay(msg msgpacktyps.Message, content []byte, targetId string, target *Connection) error {
+	data, err := ss.sealFor(msg, content, targetId)
+	if err != nil {
+		return err
+	}
 
-		// The loop pauses here waiting for the decoder to receive any new data
-		var msg msgpacktyps.Message
+	if err := target.Send(data); err != nil {
+		ss.hub.Unregister(targetId, target)
+		return fmt.Errorf("cliente %s removido: %s", targetId, err.Error())
+	}
+	return nil
+}
+
+// store keeps a direct message for a target that is offline and acks it, or tells the sender it can not be kept
+func (ss *ServerState) store(msg msgpacktyps.Message, content []byte, connection *Connection) {
+	if err := ss.queue.Enqueue(msg.Target, msg, content); err != nil {
+		log.Printf("erro ao guardar a mensagem de %s para %s: %s", msg.SenderId, msg.Target, err.Error())
+		reason := msgpacktyps.DeliveryTargetOffline
+		if errors.Is(err, ErrQuotaExceeded) {
+			reason = msgpacktyps.DeliveryQueueFull
+		}
+		ss.reportFailure(msg, connection, reason)
+		return
+	}
+	log.Printf("mensagem de %s guardada ate %s voltar", msg.SenderId, msg.Target)
+	ss.respond(msg, connection, msgpacktyps.SendResponse{Queued: true})
+}
+
+// deliverQueued sends the client, on the connection it just authenticated on, the messages that waited for it
+func (ss *ServerState) deliverQueued(clientId string, connection *Connection) {
+	delivered, err := ss.queue.Deliver(clientId, func(msg msgpacktyps.Message, content []byte) error {
+		data, err := ss.sealFor(msg, content, clientId)
+		if err != nil {
+			return err
+		}
+		// A whole mailbox may not fit in the outbound queue at once, wait for the writer instead of dropping the client.
+		// A message only leaves the mailbox once it was written, one still in the queue would be lost with the connection
+		return connection.SendWritten(data, writeTimeout)
+	})
+	if delivered > 0 {
+		log.Printf("%d mensagens em espera entregues a %s", delivered, clientId)
+	}
+	if err != nil {
+		log.Printf("erro ao entregar as mensagens em espera de %s: %s", clientId, err.Error())
+	}
+}
+
+// authenticate opens the content of a message with the sender's session and checks its sequence number.
+// The connection then becomes the sender's current one, and what was kept for the sender while it was away is handed over.
+func (ss *ServerState) authenticate(msg msgpacktyps.Message, connection *Connection) ([]byte, bool) {
+	senderSession, known := ss.hub.Session(msg.SenderId)
+	if !known {
+		log.Printf("remetente desconhecido, mensagem ignorada: %s", msg.SenderId)
+		return nil, false
+	}
+
+	// Only the owner of the sender's secret can produce content that authenticates with its metadata
+	content, err := senderSession.Open(msg.Content, msg.SessionAD())
+	if err != nil {
+		log.Printf("mensagem rejeitada de %s: %s", msg.SenderId, err.Error())
+		return nil, false
+	}
+
+	// A captured message sent again must not be relayed again
+	if err := senderSession.CheckSequence(msg.Sequence); err != nil {
+		log.Printf("mensagem repetida de %s rejeitada (%d ate agora): %s", msg.SenderId, senderSession.Replays(), err.Error())
+		return nil, false
+	}
+
+	// The latest connection of the client, a reconnecting client must not be left on its old one,
+	// and what was kept for it while it was away goes first
+	ss.hub.Register(msg.SenderId, connection)
+	if msg.Type == msgpacktyps.Authenticate {
+		// The client waits for this answer before reading anything else
+		reply := msgpacktyps.NewMessage(msgpacktyps.AuthenticateResponse, "", msg.SenderId)
+		if err := ss.relay(reply, nil, msg.SenderId, connection); err != nil {
+			log.Printf("erro ao responder a %s: %s", msg.SenderId, err.Error())
+		}
+	}
+	ss.deliverQueued(msg.SenderId, connection)
+
+	return content, true
+}
+
+// askRekey tells, in the clear, a client the server has no session with to run the handshake again under its id.
+// Nothing it could be tricked into is lost: the new handshake must be signed with the client's registered key.
+func (ss *ServerState) askRekey(clientId string, connection *Connection) {
+	data, err := msgpack.Marshal(msgpacktyps.NewMessage(msgpacktyps.Rekey, "", clientId))
+	if err != nil {
+		log.Printf("erro ao encodificar mensagem: %s", err.Error())
+		return
+	}
+	if err := connection.Send(data); err != nil {
+		log.Printf("erro ao pedir novo handshake a %s: %s", clientId, err.Error())
+	}
+}
+
+// reportFailure tells the sender, on its connection, that the message could not be delivered and why
+func (ss *ServerState) reportFailure(msg msgpacktyps.Message, connection *Connection, reason msgpacktyps.DeliveryError) {
+	log.Printf("mensagem de %s para %s nao entregue: %s", msg.SenderId, msg.Target, reason)
+	ss.respond(msg, connection, msgpacktyps.SendResponse{Reason: reason})
+}
 
-		err := decoder.Decode(&msg)
-		log.Printf("DECODED SOME DATA")
+// respond sends the sender, on its connection, the SendContentResponse of its message: the ack, or the failure
+func (ss *ServerState) respond(msg msgpacktyps.Message, connection *Connection, response msgpacktyps.SendResponse) {
+	response.MessageId = msg.Id
+	response.Target = msg.Target
+	response.Created = msg.Created
 
-		if err != nil && errors.Is(err, io.EOF) {
+	content, err := msgpack.Marshal(&response)
+	if err != nil {
+		log.Printf("erro ao encodificar a resposta de envio: %s", err.Error())
+		return
+	}
+
+	reply := msgpacktyps.NewMessage(msgpacktyps.SendContentResponse, "", msg.SenderId)
+	if err := ss.relay(reply, content, msg.SenderId, connection); err != nil {
+		log.Printf("erro ao responder a %s: %s", msg.SenderId, err.Error())
+	}
+}
+
+func HandleNewConnection(con net.Conn, serverState *ServerState) {
+	log.Printf("New Connection!")
+
+	// Every write to con goes through the connection's writer goroutine
+	connection := NewConnection(con)
+	defer func() {
+		serverState.hub.UnregisterConnection(connection)
+		connection.Close()
+	}()
+
+	frames := framing.NewReader(bufio.NewReader(con))
+
+	for {
+		// The loop pauses here waiting for the next frame
+		frame, err := frames.ReadFrame()
+		if err != nil && (errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)) {
 			log.Println("conexao terminada")
 			break
 		}
-
+		// A broken or oversized frame leaves no way to find where the next one starts
 		if err != nil {
+			log.Printf("erro ao ler frame, conexao terminada: %s", err.Error())
+			break
+		}
+		log.Printf("RECEIVED SOME DATA")
+
+		var msg msgpacktyps.Message
+		if err := msgpack.Unmarshal(frame, &msg); err != nil {
 			log.Printf("erro ao decodificar o MsgPack packet: %s", err.Error())
+			continue
 		}
 
 		// Deal with the message type and act accordingly
 		switch msg.Type {
 		case msgpacktyps.RequestId:
 
-			id, secretRawMaterial := serverState.RegisterNewClient(con)
+			var offer msgpacktyps.KeyExchangeOffer
+			if err := msgpack.Unmarshal(msg.Content, &offer); err != nil {
+				log.Printf("erro ao decodificar o pedido de handshake: %s", err.Error())
+				continue
+			}
+
+			reply, err := serverState.RegisterNewClient(con, offer)
+			if err != nil {
+				log.Printf("erro no handshake: %s", err.Error())
+				continue
+			}
+
+			content, err := msgpack.Marshal(&reply)
+			if err != nil {
+				log.Fatalf("erro ao encodificar mensagem: %s", err.Error())
+			}
 
 			msg := msgpacktyps.NewMessage(
 				msgpacktyps.RequestIdResponse,
 				"",
 				"",
-				[]byte(fmt.Sprintf("%s|%s", id, secretRawMaterial))...,
+				content...,
 			)
 
 			data, err := msgpack.Marshal(&msg)
@@ -95,53 +334,64 @@ func HandleNewConnection(con net.Conn, serverState *ServerState) {
 				log.Fatalf("erro ao encodificar mensagem: %s", err.Error())
 			}
 
-			n, err := con.Write(append(data, 0x0a))
-			if err != nil {
-				log.Fatal(err)
+			if err := connection.Send(data); err != nil {
+				log.Printf("erro ao responder ao pedido de id: %s", err.Error())
 			}
-			log.Printf("Wrote on RequestId: %d", n)
 
-		case msgpacktyps.SendContent:
+		case msgpacktyps.Authenticate:
 
-			log.Println("SEND CONTENT==============================")
-
-			if _, exists := connections[msg.SenderId]; !exists {
-				connections[msg.SenderId] = con
+			// Known but without a session, the server restarted since the client's handshake
+			if _, known := serverState.hub.Session(msg.SenderId); !known && serverState.clients.Known(msg.SenderId) {
+				log.Printf("cliente %s sem sessao, pedido novo handshake", msg.SenderId)
+				serverState.askRekey(msg.SenderId, connection)
+				continue
 			}
 
-			if strings.Contains(string(msg.Content), "#!createSecret") {
-				// Criar secret
-				clientCreatedAt, err := strconv.ParseInt(
-					string(msg.Content[len("#!createSecret")+1:]),
-					10,
-					64,
-				)
-
-				log.Println("Created AT: ", clientCreatedAt)
+			if _, ok := serverState.authenticate(msg, connection); ok {
+				log.Printf("cliente %s autenticado", msg.SenderId)
+			}
 
-				if err != nil {
-					log.Fatal("Cant parsse the date/time")
-				}
+		// The handshakes and receipts of direct conversations are relayed like any other content
+		case msgpacktyps.SendContent, msgpacktyps.RatchetInit, msgpacktyps.RatchetAccept, msgpacktyps.Receipt:
 
-				t := time.Unix(clientCreatedAt, 0)
-				secret, _ := crypto.GenerateSecret(serverState.rawMaterial, t)
+			log.Println("SEND CONTENT==============================")
 
-				connectionsSecrets[msg.SenderId] = secret
-				log.Printf("SECRET: %x", secret)
+			content, ok := serverState.authenticate(msg, connection)
+			if !ok {
 				continue
 			}
 
-			data, err := msgpack.Marshal(msg)
-			if err != nil {
-				log.Fatalf("erro ao encodificar mensagem: %s", err.Error())
-			}
+			switch msg.Target {
+			case msgpacktyps.BroadcastTarget:
+				// Only queued here, the writer goroutine of each target does the writing
+				for targetId, target := range serverState.hub.Connected() {
+					if err := serverState.relay(msg, content, targetId, target); err != nil {
+						log.Printf("erro ao enviar mensagem para %s: %s", targetId, err.Error())
+					}
+				}
+				serverState.respond(msg, connection, msgpacktyps.SendResponse{})
+			case "":
+				serverState.reportFailure(msg, connection, msgpacktyps.DeliveryNoTarget)
+			default:
+				if !serverState.known(msg.Target) {
+					serverState.reportFailure(msg, connection, msgpacktyps.DeliveryUnknownTarget)
+					continue
+				}
+
+				target, online := serverState.hub.Lookup(msg.Target)
+				if !online {
+					serverState.store(msg, content, connection)
+					continue
+				}
 
-			for _, connection := range connections {
-				_, err := connection.Write(append(data, 0x0a))
-				if err != nil {
-					delete(connections, msg.SenderId)
-					log.Println(err)
+				// Never blocks the sender: what was kept for the target is drained by the target's own goroutine when it
+				// authenticates, a message relayed meanwhile may overtake it and the conversations take it out of order
+				if err := serverState.relay(msg, content, msg.Target, target); err != nil {
+					log.Printf("erro ao enviar mensagem para %s: %s", msg.Target, err.Error())
+					serverState.store(msg, content, connection)
+					continue
 				}
+				serverState.respond(msg, connection, msgpacktyps.SendResponse{})
 			}
 		default:
 			log.Println("tipo nao implementado, ignorar....")